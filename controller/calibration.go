@@ -0,0 +1,328 @@
+package controller
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"time"
+
+	"./switchreport"
+)
+
+// User calibration, written by the stick and motion calibration of the
+// Switch settings. Each block starts with a magic that is only present when
+// the user calibrated.
+const (
+	userStickCalibrationAddress = 0x8010
+	userIMUCalibrationAddress   = 0x8026
+)
+
+var userCalibrationMagic = [2]byte{0xB2, 0xA1}
+
+// In-app calibration is started by holding Capture and Home.
+const (
+	calibrationChordHold = 3 * time.Second
+	calibrationSpinTime  = 6 * time.Second
+	calibrationRestTime  = 3 * time.Second
+)
+
+func hasUserCalibration(data []byte) bool {
+	return data[0] == userCalibrationMagic[0] && data[1] == userCalibrationMagic[1]
+}
+
+// setIMUCalibration reads the 24 byte IMU calibration block shared by the
+// factory and user calibration.
+func (Controller *SwitchProController) setIMUCalibration(data []byte) {
+	for i := 0; i < 3; i++ {
+		Controller.AccNeutral[i] = binary.LittleEndian.Uint16(data[i*2:])
+		Controller.AccSensiti[i] = binary.LittleEndian.Uint16(data[6+i*2:])
+		Controller.GyrNeutral[i] = binary.LittleEndian.Uint16(data[12+i*2:])
+		Controller.GyrSensiti[i] = binary.LittleEndian.Uint16(data[18+i*2:])
+	}
+}
+
+// readUserCalibration replaces the factory calibration with the user
+// calibration of the controller where there is one.
+func (Controller *SwitchProController) readUserCalibration() error {
+	response, err := Controller.ReadSPI(userStickCalibrationAddress, 22)
+	if err != nil {
+		return err
+	}
+	if hasUserCalibration(response[0:2]) {
+		Controller.StickCalLeft.SetRange(switchreport.UnpackStick(response[2:5]), switchreport.UnpackStick(response[5:8]), switchreport.UnpackStick(response[8:11]))
+	}
+	if hasUserCalibration(response[11:13]) {
+		Controller.StickCalRight.SetRange(switchreport.UnpackStick(response[19:22]), switchreport.UnpackStick(response[13:16]), switchreport.UnpackStick(response[16:19]))
+	}
+
+	response, err = Controller.ReadSPI(userIMUCalibrationAddress, 26)
+	if err != nil {
+		return err
+	}
+	if hasUserCalibration(response[0:2]) {
+		Controller.setIMUCalibration(response[2:26])
+	}
+
+	return nil
+}
+
+// StoredCalibration is the result of the in-app calibration, kept in the
+// data directory under the serial number of the controller.
+type StoredCalibration struct {
+	Serial      string           `json:"serial"`
+	LeftStick   StickCalibration `json:"leftStick"`
+	RightStick  StickCalibration `json:"rightStick"`
+	GyroNeutral [3]int16         `json:"gyroNeutral"`
+	Time        time.Time        `json:"time"`
+}
+
+func calibrationPath(serial string) (string, error) {
+	return DataPath("calibration", SafeFileName(serial)+".json")
+}
+
+// LoadCalibration returns the stored calibration of a controller, or nil
+// if it was never calibrated.
+func LoadCalibration(serial string) (*StoredCalibration, error) {
+	path, err := calibrationPath(serial)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cal := &StoredCalibration{}
+	err = json.Unmarshal(data, cal)
+	if err != nil {
+		return nil, err
+	}
+	return cal, nil
+}
+
+func (cal *StoredCalibration) Save() error {
+	path, err := calibrationPath(cal.Serial)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(cal, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+func (Controller *SwitchProController) applyCalibration(cal *StoredCalibration) {
+	Controller.StickCalLeft = cal.LeftStick
+	Controller.StickCalRight = cal.RightStick
+	for i := 0; i < 3; i++ {
+		Controller.GyrNeutral[i] = uint16(cal.GyroNeutral[i])
+	}
+}
+
+// loadStoredCalibration applies the in-app calibration of the controller,
+// which takes precedence over the calibration in its SPI flash.
+func (Controller *SwitchProController) loadStoredCalibration() error {
+	if Controller.Serial == "" {
+		return nil
+	}
+
+	cal, err := LoadCalibration(Controller.Serial)
+	if err != nil || cal == nil {
+		return err
+	}
+	Controller.applyCalibration(cal)
+	return nil
+}
+
+type CalibrationPhase int
+
+const (
+	CalibrationSpin CalibrationPhase = iota
+	CalibrationRest
+	CalibrationDone
+)
+
+// InteractiveCalibration measures the stick range while the user spins both
+// sticks, then the stick centers and gyro bias while the controller rests.
+type InteractiveCalibration struct {
+	Phase      CalibrationPhase
+	phaseStart time.Time
+
+	min [2]switchreport.Stick
+	max [2]switchreport.Stick
+
+	samples    int
+	centerSum  [2][2]float64
+	imuSamples int
+	gyroSum    [3]float64
+}
+
+func NewInteractiveCalibration(now time.Time) *InteractiveCalibration {
+	cal := &InteractiveCalibration{phaseStart: now}
+	for i := range cal.min {
+		cal.min[i] = switchreport.Stick{X: 0xFFF, Y: 0xFFF}
+	}
+	return cal
+}
+
+// Update feeds one report to the calibration and reports whether it moved
+// to the next phase.
+func (cal *InteractiveCalibration) Update(input *switchreport.StandardReport, now time.Time) bool {
+	sticks := [2]switchreport.Stick{input.LeftStick, input.RightStick}
+
+	switch cal.Phase {
+	case CalibrationSpin:
+		for i, stick := range sticks {
+			if stick.X < cal.min[i].X {
+				cal.min[i].X = stick.X
+			}
+			if stick.Y < cal.min[i].Y {
+				cal.min[i].Y = stick.Y
+			}
+			if stick.X > cal.max[i].X {
+				cal.max[i].X = stick.X
+			}
+			if stick.Y > cal.max[i].Y {
+				cal.max[i].Y = stick.Y
+			}
+		}
+		if now.Sub(cal.phaseStart) < calibrationSpinTime {
+			return false
+		}
+	case CalibrationRest:
+		// Give the user a moment to let go before sampling.
+		if now.Sub(cal.phaseStart) < time.Second {
+			return false
+		}
+		for i, stick := range sticks {
+			cal.centerSum[i][0] += float64(stick.X)
+			cal.centerSum[i][1] += float64(stick.Y)
+		}
+		if input.HasIMU {
+			for _, frame := range input.IMU {
+				for axis := 0; axis < 3; axis++ {
+					cal.gyroSum[axis] += float64(frame.Gyro[axis]) / 3
+				}
+			}
+			cal.imuSamples++
+		}
+		cal.samples++
+		if now.Sub(cal.phaseStart) < calibrationRestTime+time.Second {
+			return false
+		}
+	default:
+		return false
+	}
+
+	cal.Phase++
+	cal.phaseStart = now
+	return true
+}
+
+// Result builds the stored calibration of a controller. The dead zones are
+// kept from its current calibration, and so is the gyro neutral when no
+// IMU sample was taken.
+func (cal *InteractiveCalibration) Result(Controller *SwitchProController) *StoredCalibration {
+	result := &StoredCalibration{
+		Serial:     Controller.Serial,
+		LeftStick:  Controller.StickCalLeft,
+		RightStick: Controller.StickCalRight,
+		Time:       time.Now(),
+	}
+	for axis := 0; axis < 3; axis++ {
+		result.GyroNeutral[axis] = int16(Controller.GyrNeutral[axis])
+	}
+	if cal.samples == 0 {
+		return result
+	}
+
+	for i, stickCal := range []*StickCalibration{&result.LeftStick, &result.RightStick} {
+		center := switchreport.Stick{
+			X: uint16(cal.centerSum[i][0] / float64(cal.samples)),
+			Y: uint16(cal.centerSum[i][1] / float64(cal.samples)),
+		}
+		// Ignore a stick that was not moved past its center.
+		if cal.max[i].X <= center.X || cal.max[i].Y <= center.Y || cal.min[i].X >= center.X || cal.min[i].Y >= center.Y {
+			continue
+		}
+		stickCal.SetRange(
+			switchreport.Stick{X: cal.max[i].X - center.X, Y: cal.max[i].Y - center.Y},
+			center,
+			switchreport.Stick{X: center.X - cal.min[i].X, Y: center.Y - cal.min[i].Y},
+		)
+	}
+	if cal.imuSamples > 0 {
+		for axis := 0; axis < 3; axis++ {
+			result.GyroNeutral[axis] = int16(cal.gyroSum[axis] / float64(cal.imuSamples))
+		}
+	}
+
+	return result
+}
+
+// calibrationStep runs the in-app calibration for one report. It returns
+// true while calibrating, when the report must not reach the virtual pad,
+// and clears Home and Capture from input while they are held as the chord.
+func (Controller *SwitchProController) calibrationStep(input *switchreport.StandardReport, now time.Time) bool {
+	chord := byte(1<<SwitchProControllerButtonCapture | 1<<SwitchProControllerButtonHome)
+	held := input.Buttons.Shared & chord
+	if held == chord {
+		Controller.chordHeld = true
+	} else if held == 0 {
+		Controller.chordHeld = false
+	}
+	// Home and Capture stay off the virtual pad from the moment they make
+	// the chord until both are released, so holding it does not press Guide.
+	if Controller.chordHeld {
+		input.Buttons.Shared &^= chord
+	}
+
+	if Controller.calibration == nil {
+		if held != chord {
+			Controller.chordSince = time.Time{}
+			return false
+		}
+		if Controller.chordSince.IsZero() {
+			Controller.chordSince = now
+		}
+		if now.Sub(Controller.chordSince) < calibrationChordHold {
+			return false
+		}
+
+		if Controller.Serial == "" {
+			NotifyWarning(Controller.Name, "Calibration needs a controller with a serial number")
+			Controller.chordSince = now
+			return false
+		}
+		Controller.chordSince = time.Time{}
+		Controller.calibration = NewInteractiveCalibration(now)
+		NotifyInfo(Controller.Name, "Calibration: rotate both sticks fully a few times")
+		return true
+	}
+
+	if !Controller.calibration.Update(input, now) {
+		return true
+	}
+
+	switch Controller.calibration.Phase {
+	case CalibrationRest:
+		NotifyInfo(Controller.Name, "Calibration: release the sticks and put the controller down")
+	case CalibrationDone:
+		result := Controller.calibration.Result(Controller)
+		Controller.calibration = nil
+		Controller.applyCalibration(result)
+		err := result.Save()
+		if err != nil {
+			NotifyError(Controller.Name, "unable to save calibration: "+err.Error())
+		} else {
+			NotifyInfo(Controller.Name, "Calibration saved")
+		}
+	}
+	return true
+}
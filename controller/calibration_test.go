@@ -0,0 +1,91 @@
+package controller
+
+import (
+	"testing"
+	"time"
+
+	"./switchreport"
+)
+
+// quietNotifications drops the notifications of a test and keeps its data
+// directory out of the user's.
+func quietNotifications(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	SetNotifications(NewNotifications(nil, SeverityInfo, 0))
+}
+
+func switchInput(shared byte, imu bool) *switchreport.StandardReport {
+	input := &switchreport.StandardReport{
+		ID:         switchreport.StandardReportID,
+		Buttons:    switchreport.Buttons{Shared: shared},
+		LeftStick:  switchreport.Stick{X: 0x800, Y: 0x800},
+		RightStick: switchreport.Stick{X: 0x800, Y: 0x800},
+		HasIMU:     imu,
+	}
+	if imu {
+		for i := range input.IMU {
+			input.IMU[i].Gyro = [3]int16{12, -9, 4}
+		}
+	}
+	return input
+}
+
+func runCalibration(controller *SwitchProController, imu bool) *StoredCalibration {
+	start := time.Now()
+	cal := NewInteractiveCalibration(start)
+	for at := time.Duration(0); cal.Phase != CalibrationDone; at += 15 * time.Millisecond {
+		cal.Update(switchInput(0, imu), start.Add(at))
+	}
+	return cal.Result(controller)
+}
+
+func TestCalibrationKeepsGyroNeutralWithoutIMU(t *testing.T) {
+	controller := &SwitchProController{Serial: "XAW1", GyrNeutral: [3]uint16{3, 0xFFF9, 1}}
+
+	result := runCalibration(controller, false)
+	if result.GyroNeutral != [3]int16{3, -7, 1} {
+		t.Errorf("gyro neutral %v without IMU samples, want the current one", result.GyroNeutral)
+	}
+
+	result = runCalibration(controller, true)
+	if result.GyroNeutral != [3]int16{12, -9, 4} {
+		t.Errorf("gyro neutral %v, want the measured one", result.GyroNeutral)
+	}
+}
+
+func TestCalibrationChordHidesGuide(t *testing.T) {
+	quietNotifications(t)
+	controller := &SwitchProController{Name: "Pro Controller", Serial: "XAW1"}
+	home := byte(1 << SwitchProControllerButtonHome)
+	capture := byte(1 << SwitchProControllerButtonCapture)
+	start := time.Now()
+
+	guide := func(shared byte, at time.Duration) (bool, bool) {
+		input := switchInput(shared, true)
+		calibrating := controller.calibrationStep(input, start.Add(at))
+		report := Xbox360ControllerReport{}
+		report.SetButtonsFromSwitch(input.Buttons.Right, input.Buttons.Shared, input.Buttons.Left)
+		return report.GetButtons()&(1<<Xbox360ControllerButtonGuide) != 0, calibrating
+	}
+
+	if pressed, _ := guide(home, 0); !pressed {
+		t.Error("Home alone does not press Guide")
+	}
+	if pressed, calibrating := guide(home|capture, 100*time.Millisecond); pressed || calibrating {
+		t.Errorf("chord pressed Guide %v, calibrating %v", pressed, calibrating)
+	}
+	// Letting go of Capture first does not press Guide either.
+	if pressed, _ := guide(home, 200*time.Millisecond); pressed {
+		t.Error("Home still held after the chord presses Guide")
+	}
+	guide(0, 300*time.Millisecond)
+	if pressed, _ := guide(home, 400*time.Millisecond); !pressed {
+		t.Error("Home after the chord was released does not press Guide")
+	}
+
+	// Held long enough, the chord starts the calibration.
+	guide(home|capture, time.Second)
+	if _, calibrating := guide(home|capture, time.Second+calibrationChordHold); !calibrating {
+		t.Error("calibration not started")
+	}
+}
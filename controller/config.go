@@ -0,0 +1,42 @@
+package controller
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DataDir returns the directory the server keeps its own files in,
+// creating it if needed.
+func DataDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	dir = filepath.Join(dir, "GamepadServer")
+	return dir, os.MkdirAll(dir, 0755)
+}
+
+// DataPath joins elem to the data directory and creates the parent
+// directory of the result.
+func DataPath(elem ...string) (string, error) {
+	dir, err := DataDir()
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(append([]string{dir}, elem...)...)
+	return path, os.MkdirAll(filepath.Dir(path), 0755)
+}
+
+// SafeFileName replaces the characters of name that are not safe in a file
+// name, so serial numbers and device names can be used as keys.
+func SafeFileName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
@@ -0,0 +1,284 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/boombuler/hid"
+)
+
+const (
+	DefaultScanInterval = time.Second
+	DefaultDebounce     = time.Second
+
+	// Delay before a device whose handler returned is started again, so a
+	// pad that fails to init does not restart on every scan.
+	DefaultRetryDelay = 5 * time.Second
+
+	// Time a handler gets to return after cancellation before its device
+	// is closed under it to unblock a pending Read.
+	deviceCloseGrace = time.Second
+)
+
+// DeviceEnumerator lists the HID devices currently attached.
+type DeviceEnumerator interface {
+	Devices() []*hid.DeviceInfo
+}
+
+// DeviceEnumeratorFunc turns a function, like a fake device list, into a
+// DeviceEnumerator.
+type DeviceEnumeratorFunc func() []*hid.DeviceInfo
+
+func (f DeviceEnumeratorFunc) Devices() []*hid.DeviceInfo {
+	return f()
+}
+
+type HIDEnumerator struct{}
+
+func (HIDEnumerator) Devices() []*hid.DeviceInfo {
+	var devices []*hid.DeviceInfo
+	for dev := range hid.Devices() {
+		devices = append(devices, dev)
+	}
+	return devices
+}
+
+// DeviceHandler runs a device until ctx is cancelled or the device goes away.
+type DeviceHandler func(ctx context.Context, DeviceInfo *hid.DeviceInfo)
+
+type DeviceEventType int
+
+const (
+	DeviceAdded DeviceEventType = iota
+	DeviceRemoved
+)
+
+func (t DeviceEventType) String() string {
+	if t == DeviceAdded {
+		return "added"
+	}
+	return "removed"
+}
+
+type DeviceEvent struct {
+	Type   DeviceEventType
+	Device *hid.DeviceInfo
+}
+
+type managedDevice struct {
+	info      *hid.DeviceInfo
+	firstSeen time.Time
+	lastSeen  time.Time
+	started   bool
+	cancel    context.CancelFunc
+	done      chan struct{}
+	exited    time.Time
+	// skipped is set by SkipDevice, the device is left alone until it is
+	// unplugged.
+	skipped bool
+}
+
+type skipDeviceKey struct{}
+
+// SkipDevice tells the device manager running a handler that its device
+// cannot be supported, so it is not started again until it is unplugged
+// and comes back. The reason is logged once.
+func SkipDevice(ctx context.Context, reason error) {
+	if skip, ok := ctx.Value(skipDeviceKey{}).(func(error)); ok {
+		skip(reason)
+	}
+}
+
+// DeviceManager polls an enumerator and runs a handler for every supported
+// device. A device has to be present for Debounce before it is started and
+// absent for Debounce before it is stopped, which hides the flapping of
+// pads that are pairing or waking up.
+type DeviceManager struct {
+	Enumerator DeviceEnumerator
+	Handler    func(DeviceInfo *hid.DeviceInfo) DeviceHandler
+	OnEvent    func(event DeviceEvent)
+	Interval   time.Duration
+	Debounce   time.Duration
+	RetryDelay time.Duration
+
+	mutex   sync.Mutex
+	devices map[string]*managedDevice
+	seen    map[string]bool
+	wg      sync.WaitGroup
+}
+
+func NewDeviceManager(enumerator DeviceEnumerator) *DeviceManager {
+	return &DeviceManager{
+		Enumerator: enumerator,
+		Handler:    DeviceHandlerFor,
+		Interval:   DefaultScanInterval,
+		Debounce:   DefaultDebounce,
+		RetryDelay: DefaultRetryDelay,
+		devices:    make(map[string]*managedDevice),
+		seen:       make(map[string]bool),
+	}
+}
+
+// Run scans until ctx is cancelled, then stops every device and waits for
+// their handlers to return.
+func (manager *DeviceManager) Run(ctx context.Context) {
+	ticker := time.NewTicker(manager.Interval)
+	defer ticker.Stop()
+
+	for {
+		manager.Scan(ctx, time.Now())
+
+		select {
+		case <-ctx.Done():
+			manager.stopAll()
+			manager.wg.Wait()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Scan runs a single enumeration at the given time.
+func (manager *DeviceManager) Scan(ctx context.Context, now time.Time) {
+	present := make(map[string]*hid.DeviceInfo)
+	for _, dev := range manager.Enumerator.Devices() {
+		if manager.Handler(dev) != nil {
+			present[dev.Path] = dev
+		}
+	}
+
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	for path, dev := range present {
+		device, ok := manager.devices[path]
+		if !ok {
+			device = &managedDevice{info: dev, firstSeen: now}
+			manager.devices[path] = device
+		}
+		device.lastSeen = now
+
+		if device.started || device.skipped || now.Sub(device.firstSeen) < manager.Debounce {
+			continue
+		}
+		if !device.exited.IsZero() && now.Sub(device.exited) < manager.RetryDelay {
+			continue
+		}
+		manager.start(ctx, device)
+	}
+
+	for path, device := range manager.devices {
+		if _, ok := present[path]; ok || now.Sub(device.lastSeen) < manager.Debounce {
+			continue
+		}
+		if device.started {
+			device.cancel()
+		} else {
+			delete(manager.devices, path)
+		}
+	}
+}
+
+// start runs the handler of a device, the mutex must be held.
+func (manager *DeviceManager) start(ctx context.Context, device *managedDevice) {
+	handler := manager.Handler(device.info)
+	deviceCtx, cancel := context.WithCancel(ctx)
+	deviceCtx = context.WithValue(deviceCtx, skipDeviceKey{}, func(reason error) {
+		slog.Warn("device not supported", "device", device.info.Path, "product", device.info.Product, "err", reason)
+
+		manager.mutex.Lock()
+		defer manager.mutex.Unlock()
+		device.skipped = true
+	})
+	if manager.seen[device.info.Path] {
+		metricHIDReconnects.Inc()
+	}
+	slog.Info("device started", "device", device.info.Path, "product", device.info.Product,
+		"vid", fmt.Sprintf("%04x", device.info.VendorId), "pid", fmt.Sprintf("%04x", device.info.ProductId))
+	manager.seen[device.info.Path] = true
+	device.started = true
+	device.cancel = cancel
+	device.done = make(chan struct{})
+	manager.emit(DeviceEvent{DeviceAdded, device.info})
+
+	manager.wg.Add(1)
+	go func() {
+		defer manager.wg.Done()
+		defer close(device.done)
+
+		handler(deviceCtx, device.info)
+		cancel()
+		slog.Info("device stopped", "device", device.info.Path)
+
+		manager.mutex.Lock()
+		defer manager.mutex.Unlock()
+		device.started = false
+		device.exited = time.Now()
+		manager.emit(DeviceEvent{DeviceRemoved, device.info})
+	}()
+}
+
+func (manager *DeviceManager) stopAll() {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	for _, device := range manager.devices {
+		if device.started {
+			device.cancel()
+		}
+	}
+}
+
+func (manager *DeviceManager) emit(event DeviceEvent) {
+	if manager.OnEvent != nil {
+		manager.OnEvent(event)
+	}
+}
+
+// Devices returns the devices that currently have a running handler.
+func (manager *DeviceManager) Devices() []*hid.DeviceInfo {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	var devices []*hid.DeviceInfo
+	for _, device := range manager.devices {
+		if device.started {
+			devices = append(devices, device.info)
+		}
+	}
+	return devices
+}
+
+// closeOnCancel closes device when ctx is cancelled and the handler has not
+// returned within deviceCloseGrace, since a pending Read cannot be
+// cancelled otherwise. The returned function closes the device and must be
+// deferred by the handler in place of device.Close.
+func closeOnCancel(ctx context.Context, device hid.Device) func() {
+	var once sync.Once
+	closeDevice := func() {
+		once.Do(device.Close)
+	}
+
+	returned := make(chan struct{})
+	go func() {
+		select {
+		case <-returned:
+			return
+		case <-ctx.Done():
+		}
+
+		select {
+		case <-returned:
+		case <-time.After(deviceCloseGrace):
+			closeDevice()
+		}
+	}()
+
+	return func() {
+		close(returned)
+		closeDevice()
+	}
+}
@@ -0,0 +1,258 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/boombuler/hid"
+)
+
+// fakeDevices is a device list the tests plug and unplug devices in.
+type fakeDevices struct {
+	mutex   sync.Mutex
+	devices map[string]*hid.DeviceInfo
+}
+
+func newFakeDevices() *fakeDevices {
+	return &fakeDevices{devices: make(map[string]*hid.DeviceInfo)}
+}
+
+func (fake *fakeDevices) plug(path string) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	fake.devices[path] = &hid.DeviceInfo{Path: path, Product: path}
+}
+
+func (fake *fakeDevices) unplug(path string) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	delete(fake.devices, path)
+}
+
+func (fake *fakeDevices) Devices() []*hid.DeviceInfo {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	var devices []*hid.DeviceInfo
+	for _, device := range fake.devices {
+		devices = append(devices, device)
+	}
+	return devices
+}
+
+// fakeHandlers records the handlers the manager runs. Each handler calls
+// run, then waits for its context unless run returns true.
+type fakeHandlers struct {
+	started chan string
+	stopped chan string
+	run     func(ctx context.Context, path string) bool
+}
+
+func newFakeHandlers(run func(ctx context.Context, path string) bool) *fakeHandlers {
+	return &fakeHandlers{
+		started: make(chan string, 16),
+		stopped: make(chan string, 16),
+		run:     run,
+	}
+}
+
+func (fake *fakeHandlers) handler(info *hid.DeviceInfo) DeviceHandler {
+	return func(ctx context.Context, info *hid.DeviceInfo) {
+		defer func() { fake.stopped <- info.Path }()
+		fake.started <- info.Path
+		if fake.run != nil && fake.run(ctx, info.Path) {
+			return
+		}
+		<-ctx.Done()
+	}
+}
+
+func newTestManager(devices DeviceEnumerator, handlers *fakeHandlers) *DeviceManager {
+	manager := NewDeviceManager(devices)
+	manager.Handler = handlers.handler
+	manager.Debounce = time.Second
+	manager.RetryDelay = 5 * time.Second
+	return manager
+}
+
+func expect(t *testing.T, ch chan string, want string) {
+	t.Helper()
+	select {
+	case got := <-ch:
+		if got != want {
+			t.Fatalf("got %s, want %s", got, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for %s", want)
+	}
+}
+
+func expectNothing(t *testing.T, ch chan string) {
+	t.Helper()
+	select {
+	case got := <-ch:
+		t.Fatalf("unexpected %s", got)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestDeviceManagerDebounce(t *testing.T) {
+	devices := newFakeDevices()
+	handlers := newFakeHandlers(nil)
+	manager := newTestManager(devices, handlers)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var events []DeviceEvent
+	var eventsMutex sync.Mutex
+	manager.OnEvent = func(event DeviceEvent) {
+		eventsMutex.Lock()
+		defer eventsMutex.Unlock()
+		events = append(events, event)
+	}
+
+	start := time.Now()
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+
+	// A device is started once it stayed for the debounce time.
+	devices.plug("pad")
+	manager.Scan(ctx, at(0))
+	manager.Scan(ctx, at(500*time.Millisecond))
+	expectNothing(t, handlers.started)
+	manager.Scan(ctx, at(time.Second))
+	expect(t, handlers.started, "pad")
+
+	// A device flapping for less than the debounce time keeps running.
+	devices.unplug("pad")
+	manager.Scan(ctx, at(1500*time.Millisecond))
+	devices.plug("pad")
+	manager.Scan(ctx, at(1800*time.Millisecond))
+	devices.unplug("pad")
+	manager.Scan(ctx, at(2500*time.Millisecond))
+	expectNothing(t, handlers.stopped)
+	expectNothing(t, handlers.started)
+
+	// It is stopped once it stayed away for the debounce time.
+	manager.Scan(ctx, at(2800*time.Millisecond))
+	expect(t, handlers.stopped, "pad")
+	manager.wg.Wait()
+
+	eventsMutex.Lock()
+	defer eventsMutex.Unlock()
+	if len(events) != 2 || events[0].Type != DeviceAdded || events[1].Type != DeviceRemoved {
+		t.Errorf("events %v, want added and removed", events)
+	}
+	if len(manager.Devices()) != 0 {
+		t.Errorf("devices %v after removal", manager.Devices())
+	}
+}
+
+func TestDeviceManagerRetry(t *testing.T) {
+	devices := newFakeDevices()
+	var mutex sync.Mutex
+	failures := 1
+	handlers := newFakeHandlers(func(ctx context.Context, path string) bool {
+		// The first run fails to init and returns.
+		mutex.Lock()
+		defer mutex.Unlock()
+		failures--
+		return failures >= 0
+	})
+	manager := newTestManager(devices, handlers)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	start := time.Now()
+	devices.plug("pad")
+	manager.Scan(ctx, start)
+	manager.Scan(ctx, start.Add(time.Second))
+	expect(t, handlers.started, "pad")
+	expect(t, handlers.stopped, "pad")
+	manager.wg.Wait()
+
+	// No restart within the retry delay, then a restart.
+	manager.Scan(ctx, start.Add(2*time.Second))
+	expectNothing(t, handlers.started)
+	manager.Scan(ctx, start.Add(7*time.Second))
+	expect(t, handlers.started, "pad")
+	expectNothing(t, handlers.stopped)
+
+	cancel()
+	expect(t, handlers.stopped, "pad")
+}
+
+func TestDeviceManagerSkip(t *testing.T) {
+	devices := newFakeDevices()
+	handlers := newFakeHandlers(func(ctx context.Context, path string) bool {
+		SkipDevice(ctx, errors.New("not supported"))
+		return true
+	})
+	manager := newTestManager(devices, handlers)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	start := time.Now()
+	devices.plug("pad")
+	manager.Scan(ctx, start)
+	manager.Scan(ctx, start.Add(time.Second))
+	expect(t, handlers.started, "pad")
+	expect(t, handlers.stopped, "pad")
+	manager.wg.Wait()
+
+	// Skipped devices are not retried while they stay plugged.
+	manager.Scan(ctx, start.Add(10*time.Second))
+	expectNothing(t, handlers.started)
+
+	// Plugged again, they get another chance.
+	devices.unplug("pad")
+	manager.Scan(ctx, start.Add(11*time.Second))
+	manager.Scan(ctx, start.Add(12*time.Second))
+	devices.plug("pad")
+	manager.Scan(ctx, start.Add(13*time.Second))
+	manager.Scan(ctx, start.Add(14*time.Second))
+	expect(t, handlers.started, "pad")
+}
+
+func TestDeviceManagerCancel(t *testing.T) {
+	devices := newFakeDevices()
+	handlers := newFakeHandlers(nil)
+	manager := newTestManager(devices, handlers)
+	manager.Debounce = 0
+	manager.Interval = 10 * time.Millisecond
+
+	devices.plug("pad1")
+	devices.plug("pad2")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		manager.Run(ctx)
+		close(done)
+	}()
+
+	started := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case path := <-handlers.started:
+			started[path] = true
+		case <-time.After(time.Second):
+			t.Fatal("devices not started")
+		}
+	}
+	if !started["pad1"] || !started["pad2"] {
+		t.Fatalf("started %v", started)
+	}
+
+	// Run returns once every handler has returned.
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return")
+	}
+	if len(handlers.stopped) != 2 {
+		t.Errorf("%d handlers stopped, want 2", len(handlers.stopped))
+	}
+}
@@ -0,0 +1,121 @@
+package controller
+
+import (
+	"context"
+
+	"github.com/boombuler/hid"
+)
+
+const (
+	ds4USBInputReportID       = 0x01
+	ds4USBInputReportLength   = 64
+	ds4BTInputReportID        = 0x11
+	ds4BTInputReportLength    = 78
+	ds4USBOutputReportID      = 0x05
+	ds4USBOutputReportLength  = 32
+	ds4BTOutputReportID       = 0x11
+	ds4BTOutputReportLength   = 78
+	ds4USBCalibrationReportID = 0x02
+	ds4BTCalibrationReportID  = 0x05
+)
+
+type DualShock4 struct {
+	PlayStationController
+}
+
+func NewDualShock4(ctx context.Context, DeviceInfo *hid.DeviceInfo) {
+	runPlayStationController(ctx, DeviceInfo, &DualShock4{})
+}
+
+// Init reads the IMU calibration and sets the lightbar. Over Bluetooth,
+// reading the calibration report also switches the pad to 0x11 reports.
+func (ds4 *DualShock4) Init() error {
+	if ds4.Bluetooth {
+		ds4.loadCalibration(ds4BTCalibrationReportID, true)
+	} else {
+		ds4.loadCalibration(ds4USBCalibrationReportID, false)
+	}
+
+	return ds4.WriteOutput()
+}
+
+func (ds4 *DualShock4) Inputs() *OutputTarget {
+	return DualShock4Inputs
+}
+
+func (ds4 *DualShock4) ParseInput(raw []byte) (PlayStationState, error) {
+	var data []byte
+	switch {
+	case raw[0] == ds4BTInputReportID && len(raw) >= ds4BTInputReportLength:
+		if !checkPlayStationReport(raw[:ds4BTInputReportLength]) {
+			return PlayStationState{}, ErrBadChecksum
+		}
+		if !ds4.Bluetooth {
+			ds4.outputMutex.Lock()
+			ds4.Bluetooth = true
+			ds4.outputMutex.Unlock()
+		}
+		data = raw[3:]
+	case raw[0] == ds4USBInputReportID && len(raw) >= ds4USBInputReportLength && !ds4.Bluetooth:
+		data = raw[1:]
+	case raw[0] == ds4USBInputReportID:
+		return parseSimplePlayStationReport(raw[1:]), nil
+	default:
+		return PlayStationState{}, ErrUnknownReport
+	}
+
+	state := parseSimplePlayStationReport(data)
+	ds4.Calibration.Apply(&state, data[12:24])
+
+	// The level goes up to 10 on battery and to 11 (full) on the cable.
+	level := int(data[29] & 0xF)
+	if data[29]&0x10 != 0 {
+		state.Charging = level <= 10
+		level = 10 * level
+	} else {
+		level = 10*level + 5
+	}
+	if level > 100 {
+		level = 100
+	}
+	state.Battery = byte(level)
+
+	// Only the first of the touch packets is used, it holds the latest
+	// position of both fingers.
+	if data[32] > 0 {
+		state.Touch[0] = parseTouchPoint(data[34:38])
+		state.Touch[1] = parseTouchPoint(data[38:42])
+	}
+
+	return state, nil
+}
+
+func (ds4 *DualShock4) WriteOutput() error {
+	ds4.outputMutex.Lock()
+	defer ds4.outputMutex.Unlock()
+
+	var buf []byte
+	var offset int
+	if ds4.Bluetooth {
+		buf = make([]byte, ds4BTOutputReportLength)
+		buf[0] = ds4BTOutputReportID
+		buf[1] = 0xC0 // HID report with CRC
+		buf[3] = 0x07 // rumble, lightbar and flash
+		offset = 6
+	} else {
+		buf = make([]byte, ds4USBOutputReportLength)
+		buf[0] = ds4USBOutputReportID
+		buf[1] = 0x07
+		offset = 4
+	}
+
+	buf[offset] = ds4.Rumble.SmallMotor
+	buf[offset+1] = ds4.Rumble.LargeMotor
+	copy(buf[offset+2:], ds4.Lightbar[:])
+
+	if ds4.Bluetooth {
+		signPlayStationReport(buf)
+	}
+
+	return ds4.Device.Write(buf)
+}
@@ -0,0 +1,145 @@
+package controller
+
+import (
+	"context"
+
+	"github.com/boombuler/hid"
+)
+
+const (
+	dualSenseUSBInputReportID      = 0x01
+	dualSenseUSBInputReportLength  = 64
+	dualSenseBTInputReportID       = 0x31
+	dualSenseBTInputReportLength   = 78
+	dualSenseUSBOutputReportID     = 0x02
+	dualSenseUSBOutputReportLength = 48
+	dualSenseBTOutputReportID      = 0x31
+	dualSenseBTOutputReportLength  = 78
+	dualSenseCalibrationReportID   = 0x05
+)
+
+// Valid flags of the common part of the DualSense output report.
+const (
+	dualSenseFlag0CompatibleVibration = 0x01
+	dualSenseFlag0HapticsSelect       = 0x02
+	dualSenseFlag1Lightbar            = 0x04
+	dualSenseFlag1PlayerIndicator     = 0x10
+	dualSenseFlag2LightbarSetup       = 0x02
+	dualSenseLightbarSetupLightOut    = 0x02
+)
+
+type DualSense struct {
+	PlayStationController
+	PlayerLEDs byte
+
+	outputSeq         byte
+	lightbarSetupDone bool
+}
+
+func NewDualSense(ctx context.Context, DeviceInfo *hid.DeviceInfo) {
+	runPlayStationController(ctx, DeviceInfo, &DualSense{PlayerLEDs: 0x04})
+}
+
+// Init reads the IMU calibration and sets the lightbar and the player LEDs.
+// Over Bluetooth, reading the calibration report also switches the pad to
+// 0x31 reports.
+func (ds *DualSense) Init() error {
+	ds.loadCalibration(dualSenseCalibrationReportID, false)
+
+	return ds.WriteOutput()
+}
+
+func (ds *DualSense) Inputs() *OutputTarget {
+	return DualSenseInputs
+}
+
+func (ds *DualSense) ParseInput(raw []byte) (PlayStationState, error) {
+	var data []byte
+	switch {
+	case raw[0] == dualSenseBTInputReportID && len(raw) >= dualSenseBTInputReportLength:
+		if !checkPlayStationReport(raw[:dualSenseBTInputReportLength]) {
+			return PlayStationState{}, ErrBadChecksum
+		}
+		if !ds.Bluetooth {
+			ds.outputMutex.Lock()
+			ds.Bluetooth = true
+			ds.outputMutex.Unlock()
+		}
+		data = raw[2:]
+	case raw[0] == dualSenseUSBInputReportID && len(raw) >= dualSenseUSBInputReportLength && !ds.Bluetooth:
+		data = raw[1:]
+	case raw[0] == dualSenseUSBInputReportID:
+		return parseSimplePlayStationReport(raw[1:]), nil
+	default:
+		return PlayStationState{}, ErrUnknownReport
+	}
+
+	state := PlayStationState{
+		LeftX:   data[0],
+		LeftY:   data[1],
+		RightX:  data[2],
+		RightY:  data[3],
+		L2:      data[4],
+		R2:      data[5],
+		Hat:     data[7] & 0xF,
+		Buttons: uint16(data[7]>>4) | uint16(data[8])<<4 | uint16(data[9]&0x7)<<12,
+	}
+	ds.Calibration.Apply(&state, data[15:27])
+	state.Touch[0] = parseTouchPoint(data[32:36])
+	state.Touch[1] = parseTouchPoint(data[36:40])
+
+	// Capacity is in tens of percent, charging status 1 is charging and 2
+	// is full.
+	level := 10*int(data[52]&0xF) + 5
+	if level > 100 {
+		level = 100
+	}
+	state.Battery = byte(level)
+	state.Charging = data[52]>>4 == 1
+
+	return state, nil
+}
+
+func (ds *DualSense) WriteOutput() error {
+	ds.outputMutex.Lock()
+	defer ds.outputMutex.Unlock()
+
+	var buf []byte
+	var common []byte
+	if ds.Bluetooth {
+		buf = make([]byte, dualSenseBTOutputReportLength)
+		buf[0] = dualSenseBTOutputReportID
+		buf[1] = ds.outputSeq << 4
+		buf[2] = 0x10 // output tag
+		ds.outputSeq = (ds.outputSeq + 1) & 0xF
+		common = buf[3:]
+	} else {
+		buf = make([]byte, dualSenseUSBOutputReportLength)
+		buf[0] = dualSenseUSBOutputReportID
+		common = buf[1:]
+	}
+
+	common[0] = dualSenseFlag0CompatibleVibration | dualSenseFlag0HapticsSelect
+	common[1] = dualSenseFlag1Lightbar | dualSenseFlag1PlayerIndicator
+	common[2] = ds.Rumble.SmallMotor
+	common[3] = ds.Rumble.LargeMotor
+	// The pad plays a blue startup animation on the lightbar until it is
+	// told to fade it out, which would override our color.
+	if !ds.lightbarSetupDone {
+		common[38] = dualSenseFlag2LightbarSetup
+		common[41] = dualSenseLightbarSetupLightOut
+	}
+	common[43] = ds.PlayerLEDs
+	copy(common[44:47], ds.Lightbar[:])
+
+	if ds.Bluetooth {
+		signPlayStationReport(buf)
+	}
+
+	err := ds.Device.Write(buf)
+	if err == nil {
+		ds.lightbarSetupDone = true
+	}
+
+	return err
+}
@@ -1,36 +1,50 @@
 package controller
 
 import (
-	"time"
+	"context"
+	"strings"
 
 	"github.com/boombuler/hid"
-	"github.com/go-toast/toast"
 )
 
-var HIDDeviceMap map[string]*hid.DeviceInfo
+const (
+	NintendoVendorID             = 0x57e
+	JoyConLeftProductID          = 0x2006
+	JoyConRightProductID         = 0x2007
+	SwitchProControllerProductID = 0x2009
 
-func CreateLocalControllerService() {
-	HIDDeviceMap = make(map[string]*hid.DeviceInfo)
+	SonyVendorID                       = 0x54c
+	DualShock4ProductID                = 0x5c4
+	DualShock4V2ProductID              = 0x9cc
+	DualShock4WirelessAdapterProductID = 0xba0
+	DualSenseProductID                 = 0xce6
+	DualSenseEdgeProductID             = 0xdf2
+)
 
-	for {
-		for dev := range hid.Devices() {
-			if dev.VendorId == 0x57e && dev.ProductId == 0x2009 {
-				_, ok := HIDDeviceMap[dev.Path]
-				if !ok {
-					go NewSwitchProController(dev)
-				}
-			}
-		}
-		time.Sleep(time.Second * 2)
-	}
+// CreateLocalControllerService runs the HID devices until ctx is cancelled.
+func CreateLocalControllerService(ctx context.Context) {
+	NewDeviceManager(WithSimulatedDevices(HIDEnumerator{})).Run(ctx)
 }
 
-func Notification(title, message string) {
-	notification := toast.Notification{
-		AppID:   "GamepadServer",
-		Title:   title,
-		Message: message,
+// DeviceHandlerFor returns the handler of a supported device, or nil.
+func DeviceHandlerFor(dev *hid.DeviceInfo) DeviceHandler {
+	switch {
+	case dev.VendorId == NintendoVendorID && dev.ProductId == SwitchProControllerProductID:
+		return NewSwitchProController
+	case dev.VendorId == NintendoVendorID && (dev.ProductId == JoyConLeftProductID || dev.ProductId == JoyConRightProductID):
+		return NewJoyCon
+	case dev.VendorId == SonyVendorID && (dev.ProductId == DualShock4ProductID || dev.ProductId == DualShock4V2ProductID || dev.ProductId == DualShock4WirelessAdapterProductID):
+		return NewDualShock4
+	case dev.VendorId == SonyVendorID && (dev.ProductId == DualSenseProductID || dev.ProductId == DualSenseEdgeProductID):
+		return NewDualSense
+	case IsGenericGamepad(dev):
+		return NewGenericHIDController
 	}
+	return nil
+}
 
-	notification.Push()
+// IsBluetoothPath reports whether a HID device path belongs to a device
+// connected over Bluetooth, which carries the HID service class UUID.
+func IsBluetoothPath(path string) bool {
+	return strings.Contains(strings.ToLower(path), "00001124-0000-1000-8000-00805f9b34fb")
 }
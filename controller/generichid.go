@@ -0,0 +1,497 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/boombuler/hid"
+)
+
+var ErrNoReportDescriptor = errors.New("device does not provide its report descriptor")
+
+// ReportDescriptorDevice is implemented by HID devices that can return the
+// input fields of their report descriptor. Generic gamepads need them to
+// decode reports.
+type ReportDescriptorDevice interface {
+	ReportDescriptor() (*HIDReportDescriptor, error)
+}
+
+// Names of the Generic Desktop axes, as used by profiles.
+var genericHIDAxisNames = map[uint16]string{
+	HIDUsageX:      "x",
+	HIDUsageY:      "y",
+	HIDUsageZ:      "z",
+	HIDUsageRx:     "rx",
+	HIDUsageRy:     "ry",
+	HIDUsageRz:     "rz",
+	HIDUsageSlider: "slider",
+	HIDUsageDial:   "dial",
+	HIDUsageWheel:  "wheel",
+}
+
+// GenericHIDLayout picks the fields of a report descriptor a gamepad needs.
+type GenericHIDLayout struct {
+	UsesReportIDs bool
+	Buttons       []HIDReportField
+	ButtonArrays  []HIDReportField
+	Axes          map[string]HIDReportField
+	Hat           *HIDReportField
+	Sliders       int
+}
+
+// GenericHIDState is a decoded input report. Axes are scaled to -1..1,
+// Hat counts clockwise from up in eighths and is -1 when released.
+type GenericHIDState struct {
+	Buttons uint64
+	Axes    map[string]float32
+	Hat     int
+}
+
+func (state *GenericHIDState) Pressed(button int) bool {
+	return button < 64 && state.Buttons&(1<<uint(button)) != 0
+}
+
+func NewGenericHIDLayout(descriptor *HIDReportDescriptor) (*GenericHIDLayout, error) {
+	layout := &GenericHIDLayout{
+		UsesReportIDs: descriptor.UsesReportIDs,
+		Axes:          make(map[string]HIDReportField),
+	}
+
+	for _, field := range descriptor.Fields {
+		switch {
+		case field.Array && field.UsageMin.Page() == HIDUsagePageButton:
+			layout.ButtonArrays = append(layout.ButtonArrays, field)
+		case field.Array:
+			continue
+		case field.Usage.Page() == HIDUsagePageButton:
+			layout.Buttons = append(layout.Buttons, field)
+		case field.Usage.Page() != HIDUsagePageGenericDesktop:
+			continue
+		case field.Usage.ID() == HIDUsageHatSwitch:
+			if layout.Hat == nil {
+				hat := field
+				layout.Hat = &hat
+			}
+		case field.Usage.ID() == HIDUsageSlider:
+			// Pads may have several sliders, name them slider, slider2...
+			name := "slider"
+			if layout.Sliders > 0 {
+				name += string(rune('1' + layout.Sliders))
+			}
+			layout.Sliders++
+			layout.Axes[name] = field
+		default:
+			name, ok := genericHIDAxisNames[field.Usage.ID()]
+			if !ok {
+				continue
+			}
+			if _, ok := layout.Axes[name]; !ok {
+				layout.Axes[name] = field
+			}
+		}
+	}
+
+	if len(layout.Buttons) == 0 && len(layout.ButtonArrays) == 0 && len(layout.Axes) == 0 {
+		return nil, errors.New("report descriptor has no gamepad controls")
+	}
+
+	return layout, nil
+}
+
+// Decode reads an input report. Reports with another report ID than the
+// gamepad controls are rejected.
+func (layout *GenericHIDLayout) Decode(report []byte) (GenericHIDState, bool) {
+	state := GenericHIDState{Axes: make(map[string]float32), Hat: -1}
+
+	var reportID byte
+	if layout.UsesReportIDs {
+		if len(report) == 0 {
+			return state, false
+		}
+		reportID, report = report[0], report[1:]
+	}
+
+	matched := false
+	for _, field := range layout.Buttons {
+		if field.ReportID != reportID {
+			continue
+		}
+		matched = true
+		value, ok := field.Value(report)
+		button := int(field.Usage.ID()) - 1
+		if ok && value != 0 && button >= 0 && button < 64 {
+			state.Buttons |= 1 << uint(button)
+		}
+	}
+
+	for _, field := range layout.ButtonArrays {
+		if field.ReportID != reportID {
+			continue
+		}
+		matched = true
+		value, ok := field.Value(report)
+		if !ok || value < field.LogicalMin || value > field.LogicalMax {
+			continue
+		}
+		button := int(field.UsageMin.ID()) + int(value-field.LogicalMin) - 1
+		if button >= 0 && button < 64 && button < int(field.UsageMax.ID()) {
+			state.Buttons |= 1 << uint(button)
+		}
+	}
+
+	for name, field := range layout.Axes {
+		if field.ReportID != reportID {
+			continue
+		}
+		matched = true
+		value, ok := field.Value(report)
+		if !ok || field.LogicalMax <= field.LogicalMin {
+			continue
+		}
+		span := float32(field.LogicalMax) - float32(field.LogicalMin)
+		state.Axes[name] = 2*(float32(value)-float32(field.LogicalMin))/span - 1
+	}
+
+	if layout.Hat != nil && layout.Hat.ReportID == reportID {
+		matched = true
+		value, ok := layout.Hat.Value(report)
+		// Out of range values mean released. Four-way hats are spread
+		// over the eight directions.
+		positions := layout.Hat.LogicalMax - layout.Hat.LogicalMin + 1
+		if ok && value >= layout.Hat.LogicalMin && value <= layout.Hat.LogicalMax && positions > 0 {
+			state.Hat = int((value - layout.Hat.LogicalMin) * 8 / positions)
+		}
+	}
+
+	return state, matched
+}
+
+// GenericHIDProfile maps a generic gamepad to the Xbox 360 controller.
+// Buttons[i] is the target of HID button i+1. Axes maps a target to the
+// axes it reads, the first one the pad has is used, a leading "-" inverts.
+//
+// Targets are a, b, x, y, lb, rb, lt, rt, back, start, ls, rs, guide, up,
+// down, left and right for buttons, and leftx, lefty, rightx, righty, lt
+// and rt for axes. An empty button target leaves the button unmapped.
+type GenericHIDProfile struct {
+	Name      string              `json:"name"`
+	Buttons   []string            `json:"buttons"`
+	Axes      map[string][]string `json:"axes"`
+	HatAsDPad bool                `json:"hatAsDPad"`
+}
+
+// GenericHIDInputs are the inputs of a generic pad for remapping. Button1
+// to Button32 are the HID buttons the mapping leaves unmapped.
+var GenericHIDInputs = sourceInputs("Generic HID", genericHIDButtonNames()...)
+
+// genericHIDSource is the device of a generic pad session, which only has
+// its inputs to tell.
+type genericHIDSource struct{}
+
+func (genericHIDSource) Inputs() *OutputTarget {
+	return GenericHIDInputs
+}
+
+func genericHIDButtonNames() []string {
+	names := make([]string, maxExtraInputs)
+	for i := range names {
+		names[i] = fmt.Sprintf("Button%d", i+1)
+	}
+	return names
+}
+
+// DefaultGenericHIDProfile follows the order of the Gamepad API standard
+// mapping, which most DirectInput pads roughly share.
+var DefaultGenericHIDProfile = GenericHIDProfile{
+	Name:    "Generic gamepad",
+	Buttons: []string{"a", "b", "x", "y", "lb", "rb", "lt", "rt", "back", "start", "ls", "rs", "guide"},
+	Axes: map[string][]string{
+		"leftx":  {"x"},
+		"lefty":  {"-y"},
+		"rightx": {"z", "rx"},
+		"righty": {"-rz", "-ry"},
+	},
+	HatAsDPad: true,
+}
+
+// GenericHIDProfiles holds the built-in profiles of known pads, by vendor
+// and product.
+var GenericHIDProfiles = make(map[uint32]*GenericHIDProfile)
+
+func RegisterGenericHIDProfile(vendor, product uint16, profile *GenericHIDProfile) {
+	GenericHIDProfiles[uint32(vendor)<<16|uint32(product)] = profile
+}
+
+func genericHIDProfilePath(vendor, product uint16) (string, error) {
+	return DataPath("mappings", fmt.Sprintf("%04x-%04x.json", vendor, product))
+}
+
+// FindGenericHIDProfile returns the profile of a pad: the one of the
+// mappings directory of the data directory named after its vendor and
+// product IDs, as in mappings/0079-0006.json, else a registered one, else
+// the default. The default is returned with the error of a bad file.
+func FindGenericHIDProfile(vendor, product uint16) (*GenericHIDProfile, error) {
+	profile, err := LoadGenericHIDProfile(vendor, product)
+	if err != nil {
+		return &DefaultGenericHIDProfile, err
+	}
+	if profile != nil {
+		return profile, nil
+	}
+
+	if profile, ok := GenericHIDProfiles[uint32(vendor)<<16|uint32(product)]; ok {
+		return profile, nil
+	}
+	return &DefaultGenericHIDProfile, nil
+}
+
+// LoadGenericHIDProfile reads the profile file of a pad, it returns nil
+// when there is none.
+func LoadGenericHIDProfile(vendor, product uint16) (*GenericHIDProfile, error) {
+	path, err := genericHIDProfilePath(vendor, product)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	profile := &GenericHIDProfile{}
+	err = json.Unmarshal(data, profile)
+	if err == nil {
+		err = profile.Validate()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filepath.Base(path), err)
+	}
+	if profile.Name == "" {
+		profile.Name = fmt.Sprintf("%04x:%04x", vendor, product)
+	}
+	return profile, nil
+}
+
+// Validate checks the targets of the profile.
+func (profile *GenericHIDProfile) Validate() error {
+	for i, target := range profile.Buttons {
+		_, ok := genericHIDButtonTargets[target]
+		if !ok && target != "" && target != "lt" && target != "rt" {
+			return fmt.Errorf("button %d: unknown target %q", i+1, target)
+		}
+	}
+	for target := range profile.Axes {
+		switch target {
+		case "leftx", "lefty", "rightx", "righty", "lt", "rt":
+		default:
+			return fmt.Errorf("unknown axis target %q", target)
+		}
+	}
+	return nil
+}
+
+var genericHIDButtonTargets = map[string]int{
+	"a":     Xbox360ControllerButtonA,
+	"b":     Xbox360ControllerButtonB,
+	"x":     Xbox360ControllerButtonX,
+	"y":     Xbox360ControllerButtonY,
+	"lb":    Xbox360ControllerButtonLeftShoulder,
+	"rb":    Xbox360ControllerButtonRightShoulder,
+	"back":  Xbox360ControllerButtonBack,
+	"start": Xbox360ControllerButtonStart,
+	"ls":    Xbox360ControllerButtonLeftThumb,
+	"rs":    Xbox360ControllerButtonRightThumb,
+	"guide": Xbox360ControllerButtonGuide,
+	"up":    Xbox360ControllerButtonUp,
+	"down":  Xbox360ControllerButtonDown,
+	"left":  Xbox360ControllerButtonLeft,
+	"right": Xbox360ControllerButtonRight,
+}
+
+func (profile *GenericHIDProfile) axis(state *GenericHIDState, target string) (float32, bool) {
+	for _, name := range profile.Axes[target] {
+		sign := float32(1)
+		if strings.HasPrefix(name, "-") {
+			sign, name = -1, name[1:]
+		}
+		if value, ok := state.Axes[name]; ok {
+			return sign * value, true
+		}
+	}
+	return 0, false
+}
+
+// extra returns the pressed buttons the profile leaves unmapped, as extra
+// inputs of GenericHIDInputs.
+func (profile *GenericHIDProfile) extra(state *GenericHIDState) uint32 {
+	var extra uint32
+	for i := 0; i < maxExtraInputs; i++ {
+		if state.Pressed(i) && (i >= len(profile.Buttons) || profile.Buttons[i] == "") {
+			extra |= 1 << uint(i)
+		}
+	}
+	return extra
+}
+
+func (report *Xbox360ControllerReport) SetFromGenericHID(state *GenericHIDState, profile *GenericHIDProfile) {
+	for i, target := range profile.Buttons {
+		if !state.Pressed(i) {
+			continue
+		}
+		switch target {
+		case "lt":
+			report.SetLeftTrigger(255)
+		case "rt":
+			report.SetRightTrigger(255)
+		default:
+			if button, ok := genericHIDButtonTargets[target]; ok {
+				report.SetButton(button)
+			}
+		}
+	}
+
+	if profile.HatAsDPad && state.Hat >= 0 {
+		report.MaybeSetButton(Xbox360ControllerButtonUp, state.Hat == 7 || state.Hat <= 1)
+		report.MaybeSetButton(Xbox360ControllerButtonRight, state.Hat >= 1 && state.Hat <= 3)
+		report.MaybeSetButton(Xbox360ControllerButtonDown, state.Hat >= 3 && state.Hat <= 5)
+		report.MaybeSetButton(Xbox360ControllerButtonLeft, state.Hat >= 5 && state.Hat <= 7)
+	}
+
+	leftX, _ := profile.axis(state, "leftx")
+	leftY, _ := profile.axis(state, "lefty")
+	rightX, _ := profile.axis(state, "rightx")
+	rightY, _ := profile.axis(state, "righty")
+	report.SetLeftThumb(StickToInt16(leftX), StickToInt16(leftY))
+	report.SetRightThumb(StickToInt16(rightX), StickToInt16(rightY))
+
+	// Trigger axes rest at -1.
+	if value, ok := profile.axis(state, "lt"); ok {
+		report.SetLeftTrigger(byte((value + 1) / 2 * 255))
+	}
+	if value, ok := profile.axis(state, "rt"); ok {
+		report.SetRightTrigger(byte((value + 1) / 2 * 255))
+	}
+}
+
+// IsGenericGamepad reports whether a HID device declares itself a joystick
+// or gamepad. XInput devices (and the pads ViGEm emulates) expose an "IG_"
+// HID interface and are left out.
+func IsGenericGamepad(DeviceInfo *hid.DeviceInfo) bool {
+	if DeviceInfo.UsagePage != HIDUsagePageGenericDesktop {
+		return false
+	}
+	if DeviceInfo.Usage != HIDUsageJoystick && DeviceInfo.Usage != HIDUsageGamepad {
+		return false
+	}
+	return !strings.Contains(strings.ToLower(DeviceInfo.Path), "ig_")
+}
+
+func readGenericHIDLayout(device hid.Device) (*GenericHIDLayout, error) {
+	descriptorDevice, ok := device.(ReportDescriptorDevice)
+	if !ok {
+		return nil, ErrNoReportDescriptor
+	}
+	descriptor, err := descriptorDevice.ReportDescriptor()
+	if err != nil {
+		return nil, err
+	}
+	return NewGenericHIDLayout(descriptor)
+}
+
+func NewGenericHIDController(ctx context.Context, DeviceInfo *hid.DeviceInfo) {
+	device, err := OpenDevice(DeviceInfo)
+	if err != nil {
+		NotifyError("unable to open controller", err.Error())
+		return
+	}
+	defer closeOnCancel(ctx, device)()
+
+	name := DeviceInfo.Manufacturer + " " + DeviceInfo.Product
+
+	// None of this gets better on a retry, so the device is skipped until
+	// it is plugged again.
+	layout, err := readGenericHIDLayout(device)
+	if err != nil {
+		SkipDevice(ctx, err)
+		return
+	}
+	profile, err := FindGenericHIDProfile(DeviceInfo.VendorId, DeviceInfo.ProductId)
+	if err != nil {
+		NotifyWarning(name, "unable to load mapping: "+err.Error())
+	}
+
+	notifyConnected(name, " Connected as "+profile.Name)
+
+	emulator, err := NewEmulator(func(vibration Vibration) {})
+	if err != nil {
+		NotifyError("unable to start ViGEm client", err.Error())
+		return
+	}
+	defer emulator.Close()
+
+	ctr, err := emulator.CreateXbox360Controller()
+	if err != nil {
+		NotifyError("unable to create emulated Xbox 360 controller", err.Error())
+		return
+	}
+	defer ctr.Close()
+
+	err = ctr.Connect()
+	if err != nil {
+		NotifyError("unable to connect to emulated Xbox 360 controller", err.Error())
+		return
+	}
+	defer ctr.Disconnect()
+
+	session := NewSession(name, "Generic HID ("+profile.Name+")", TransportOf(DeviceInfo), DeviceInfo.Path)
+	defer session.Close()
+
+	// The mapping builds the report, the profile holds what the other
+	// sources have: layout, remapping, modes, macros and script.
+	padProfile, err := LoadProfile(HIDProfileKey(DeviceInfo))
+	if err != nil {
+		NotifyError(name, "unable to load profile: "+err.Error())
+	}
+	pipeline := padProfile.NewPipeline(name, ctr, genericHIDSource{})
+	session.SetPipeline(pipeline)
+	defer pipeline.Close()
+
+	for ctx.Err() == nil {
+		raw_buf, err := device.Read()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			session.Log.Error("read failed", "err", err)
+			NotifyError(name, err.Error())
+			return
+		}
+		readAt := time.Now()
+		if len(raw_buf) == 0 {
+			session.Log.Info("disconnected")
+			notifyDisconnected(name)
+			return
+		}
+
+		state, ok := layout.Decode(raw_buf)
+		if !ok {
+			session.Log.Debug("bad input report", "size", len(raw_buf))
+			countDecodeError(session.Kind)
+			continue
+		}
+
+		report := Xbox360ControllerReport{}
+		report.SetFromGenericHID(&state, profile)
+		pipeline.SendInput(&report, profile.extra(&state))
+		session.Telemetry.HIDToSend(readAt, time.Now())
+	}
+}
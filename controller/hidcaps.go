@@ -0,0 +1,194 @@
+package controller
+
+import "math/bits"
+
+// Longest usage range of a capability that is looked into, larger ones are
+// not gamepad controls.
+const maxCapsRange = 256
+
+// HIDCaps is a button or value capability of an input report, which is how
+// Windows describes a device instead of handing out its report descriptor.
+// UsageMin and UsageMax are equal when the capability is not a range.
+type HIDCaps struct {
+	ReportID       byte
+	UsagePage      uint16
+	UsageMin       uint16
+	UsageMax       uint16
+	LinkCollection uint16
+	Button         bool
+	// Array buttons send the indexes of the pressed buttons in ReportCount
+	// slots.
+	Array       bool
+	ReportCount int
+	// Size and range of values, buttons have neither.
+	BitSize    int
+	LogicalMin int32
+	LogicalMax int32
+}
+
+// HIDReportWriter sets usages in an input report that starts with its
+// report ID, as HidP_SetUsages and HidP_SetUsageValue do.
+type HIDReportWriter interface {
+	SetButtons(caps *HIDCaps, usages []uint16, report []byte) error
+	SetValue(caps *HIDCaps, usage uint16, value uint32, report []byte) error
+}
+
+// DescriptorFromCaps finds the fields of the capabilities in the input
+// reports by writing each usage in an empty report and looking at the bits
+// that changed. Reports are read with their report ID, which Windows always
+// puts first, 0 on devices without report IDs.
+func DescriptorFromCaps(caps []HIDCaps, reportLength int, writer HIDReportWriter) *HIDReportDescriptor {
+	descriptor := &HIDReportDescriptor{UsesReportIDs: true}
+	for i := range caps {
+		c := &caps[i]
+		if c.UsageMax < c.UsageMin || int(c.UsageMax-c.UsageMin) >= maxCapsRange {
+			continue
+		}
+		if c.Array {
+			descriptor.addCapsArray(c, reportLength, writer)
+			continue
+		}
+		for usage := int(c.UsageMin); usage <= int(c.UsageMax); usage++ {
+			descriptor.addCapsUsage(c, uint16(usage), reportLength, writer)
+		}
+	}
+	return descriptor
+}
+
+func (descriptor *HIDReportDescriptor) addCapsUsage(c *HIDCaps, usage uint16, reportLength int, writer HIDReportWriter) {
+	var set []int
+	if c.Button {
+		set = probeBits(c, reportLength, func(report []byte) error {
+			return writer.SetButtons(c, []uint16{usage}, report)
+		})
+	} else {
+		set = probeBits(c, reportLength, func(report []byte) error {
+			return writer.SetValue(c, usage, 1, report)
+		})
+	}
+	// A 1 sets a single bit, the lowest of the field.
+	if len(set) != 1 {
+		return
+	}
+
+	field := HIDReportField{
+		ReportID:   c.ReportID,
+		BitOffset:  set[0],
+		BitSize:    1,
+		Usage:      NewHIDUsage(c.UsagePage, usage),
+		LogicalMax: 1,
+	}
+	if !c.Button {
+		field.BitSize, field.LogicalMin, field.LogicalMax = c.BitSize, c.LogicalMin, c.LogicalMax
+		// Maximums like 0xFF written in a single byte come out negative.
+		if field.LogicalMin >= 0 && field.LogicalMax < 0 && field.BitSize < 32 {
+			field.LogicalMax = int32(1)<<uint(field.BitSize) - 1
+		}
+	}
+	descriptor.Fields = append(descriptor.Fields, field)
+}
+
+func (descriptor *HIDReportDescriptor) addCapsArray(c *HIDCaps, reportLength int, writer HIDReportWriter) {
+	probe := func(usages ...uint16) []int {
+		return probeBits(c, reportLength, func(report []byte) error {
+			return writer.SetButtons(c, usages, report)
+		})
+	}
+
+	// Consecutive usages have consecutive indexes, one of them odd, so
+	// between them they set the lowest bit of the slot.
+	first := probe(c.UsageMin)
+	slot := append(append([]int(nil), first...), probe(c.UsageMin+1)...)
+	if c.UsageMax == c.UsageMin {
+		slot = first
+	}
+	if len(slot) == 0 {
+		return
+	}
+	offset := lowestBit(slot)
+
+	last := probe(c.UsageMax)
+	if len(last) == 0 {
+		return
+	}
+	size := highestBit(last) - offset + 1
+
+	// The second of two usages goes to the next slot.
+	if c.ReportCount > 1 && c.UsageMax-c.UsageMin >= 2 {
+		skip := make(map[int]bool)
+		for _, bit := range probe(c.UsageMin + 2) {
+			skip[bit] = true
+		}
+		var next []int
+		for _, bit := range append(probe(c.UsageMin+2, c.UsageMin), probe(c.UsageMin+2, c.UsageMin+1)...) {
+			if !skip[bit] {
+				next = append(next, bit)
+			}
+		}
+		if len(next) > 0 && lowestBit(next) > offset {
+			size = lowestBit(next) - offset
+		}
+	}
+
+	var logicalMin int32
+	for _, bit := range first {
+		logicalMin |= 1 << uint(bit-offset)
+	}
+	count := c.ReportCount
+	if count < 1 {
+		count = 1
+	}
+	for n := 0; n < count; n++ {
+		descriptor.Fields = append(descriptor.Fields, HIDReportField{
+			ReportID:   c.ReportID,
+			BitOffset:  offset + n*size,
+			BitSize:    size,
+			UsageMin:   NewHIDUsage(c.UsagePage, c.UsageMin),
+			UsageMax:   NewHIDUsage(c.UsagePage, c.UsageMax),
+			LogicalMin: logicalMin,
+			LogicalMax: logicalMin + int32(c.UsageMax-c.UsageMin),
+			Array:      true,
+		})
+	}
+}
+
+// probeBits returns the bits past the report ID that write sets in an empty
+// report, none when it fails.
+func probeBits(c *HIDCaps, reportLength int, write func(report []byte) error) []int {
+	if reportLength < 2 {
+		return nil
+	}
+	report := make([]byte, reportLength)
+	report[0] = c.ReportID
+	if write(report) != nil {
+		return nil
+	}
+
+	var set []int
+	for i, b := range report[1:] {
+		for ; b != 0; b &= b - 1 {
+			set = append(set, i*8+bits.TrailingZeros8(b))
+		}
+	}
+	return set
+}
+
+func lowestBit(set []int) int {
+	lowest := set[0]
+	for _, bit := range set {
+		if bit < lowest {
+			lowest = bit
+		}
+	}
+	return lowest
+}
+
+func highestBit(set []int) int {
+	highest := set[0]
+	for _, bit := range set {
+		if bit > highest {
+			highest = bit
+		}
+	}
+	return highest
+}
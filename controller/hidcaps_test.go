@@ -0,0 +1,202 @@
+package controller
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// descriptorWriter writes usages where a parsed report descriptor puts
+// them, like HidP_SetUsages and HidP_SetUsageValue do with the preparsed
+// data Windows builds from the same descriptor.
+type descriptorWriter struct {
+	descriptor *HIDReportDescriptor
+}
+
+func writeBits(report []byte, offset, size int, value uint32) {
+	for b := 0; b < size; b++ {
+		bit := offset + b
+		if value&(1<<uint(b)) != 0 {
+			report[bit/8] |= 1 << uint(bit%8)
+		} else {
+			report[bit/8] &^= 1 << uint(bit%8)
+		}
+	}
+}
+
+func (writer descriptorWriter) variable(caps *HIDCaps, usage uint16, report []byte) *HIDReportField {
+	for i := range writer.descriptor.Fields {
+		field := &writer.descriptor.Fields[i]
+		if !field.Array && field.ReportID == report[0] && field.Usage == NewHIDUsage(caps.UsagePage, usage) {
+			return field
+		}
+	}
+	return nil
+}
+
+func (writer descriptorWriter) SetButtons(caps *HIDCaps, usages []uint16, report []byte) error {
+	for _, usage := range usages {
+		if field := writer.variable(caps, usage, report); field != nil {
+			writeBits(report[1:], field.BitOffset, field.BitSize, 1)
+			continue
+		}
+
+		set := false
+		target := NewHIDUsage(caps.UsagePage, usage)
+		for _, field := range writer.descriptor.Fields {
+			if !field.Array || field.ReportID != report[0] || target < field.UsageMin || target > field.UsageMax {
+				continue
+			}
+			value, ok := field.Value(report[1:])
+			if ok && value >= field.LogicalMin && value <= field.LogicalMax {
+				continue
+			}
+			writeBits(report[1:], field.BitOffset, field.BitSize, uint32(int32(target-field.UsageMin)+field.LogicalMin))
+			set = true
+			break
+		}
+		if !set {
+			return errors.New("usage not found")
+		}
+	}
+	return nil
+}
+
+func (writer descriptorWriter) SetValue(caps *HIDCaps, usage uint16, value uint32, report []byte) error {
+	field := writer.variable(caps, usage, report)
+	if field == nil {
+		return errors.New("usage not found")
+	}
+	writeBits(report[1:], field.BitOffset, field.BitSize, value)
+	return nil
+}
+
+func valueCaps(reportID byte, usage uint16, size int, min, max int32) HIDCaps {
+	return HIDCaps{ReportID: reportID, UsagePage: HIDUsagePageGenericDesktop, UsageMin: usage, UsageMax: usage, ReportCount: 1, BitSize: size, LogicalMin: min, LogicalMax: max}
+}
+
+func buttonCaps(reportID byte, min, max uint16) HIDCaps {
+	return HIDCaps{ReportID: reportID, UsagePage: HIDUsagePageButton, UsageMin: min, UsageMax: max, Button: true, ReportCount: int(max - min + 1)}
+}
+
+// The capabilities Windows lists for the test descriptors decode reports
+// like the descriptors themselves, once the report ID Windows always sends
+// is put in front.
+func TestDescriptorFromCaps(t *testing.T) {
+	array := buttonCaps(3, 9, 16)
+	array.Array, array.ReportCount = true, 2
+
+	tests := []struct {
+		name       string
+		descriptor []byte
+		caps       []HIDCaps
+		length     int
+		reports    [][]byte
+	}{
+		{
+			name:       "DualShock 4",
+			descriptor: ds4Descriptor,
+			caps: []HIDCaps{
+				valueCaps(1, HIDUsageX, 8, 0, 255),
+				valueCaps(1, HIDUsageY, 8, 0, 255),
+				valueCaps(1, HIDUsageZ, 8, 0, 255),
+				valueCaps(1, HIDUsageRz, 8, 0, 255),
+				valueCaps(1, HIDUsageHatSwitch, 4, 0, 7),
+				buttonCaps(1, 1, 14),
+				valueCaps(1, HIDUsageRx, 8, 0, 255),
+				valueCaps(1, HIDUsageRy, 8, 0, 255),
+			},
+			length: 64,
+			reports: [][]byte{
+				{0x01, 0x80, 0x7F, 0x10, 0xF0, 0x28, 0x3F, 0x00, 0x40, 0xC0},
+				{0x01, 0x00, 0xFF, 0x80, 0x80, 0x93, 0xC2, 0xFF, 0xFF, 0x00},
+			},
+		},
+		{
+			name:       "DragonRise",
+			descriptor: dragonRiseDescriptor,
+			caps: []HIDCaps{
+				valueCaps(0, HIDUsageX, 8, 0, 255),
+				valueCaps(0, HIDUsageY, 8, 0, 255),
+				valueCaps(0, HIDUsageZ, 8, 0, 255),
+				valueCaps(0, HIDUsageRz, 8, 0, 255),
+				valueCaps(0, HIDUsageHatSwitch, 4, 0, 7),
+				buttonCaps(0, 1, 12),
+			},
+			length: 9,
+			reports: [][]byte{
+				{0x00, 0x80, 0xFF, 0x10, 0x7F, 0x53, 0x0A, 0xFF},
+				{0x7F, 0x7F, 0x7F, 0x7F, 0x7F, 0x0F, 0x00, 0x00},
+			},
+		},
+		{
+			name:       "report IDs",
+			descriptor: reportIDDescriptor,
+			caps: []HIDCaps{
+				buttonCaps(1, 1, 8),
+				valueCaps(1, HIDUsageX, 8, 0, 255),
+				valueCaps(1, HIDUsageY, 8, 0, 255),
+				valueCaps(2, HIDUsageRx, 16, -32768, 32767),
+				valueCaps(2, HIDUsageRy, 16, -32768, 32767),
+				array,
+			},
+			length: 5,
+			reports: [][]byte{
+				{0x01, 0xA5, 0x10, 0xF0},
+				{0x02, 0x00, 0x80, 0xFF, 0x7F},
+				{0x03, 0x31},
+				{0x03, 0x08},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		parsed, err := ParseHIDReportDescriptor(test.descriptor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := NewGenericHIDLayout(parsed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := NewGenericHIDLayout(DescriptorFromCaps(test.caps, test.length, descriptorWriter{parsed}))
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if len(got.Buttons) != len(want.Buttons) || len(got.ButtonArrays) != len(want.ButtonArrays) || len(got.Axes) != len(want.Axes) || (got.Hat == nil) != (want.Hat == nil) {
+			t.Errorf("%s: layout %+v, want %+v", test.name, got, want)
+			continue
+		}
+
+		for _, report := range test.reports {
+			windowsReport := report
+			if !parsed.UsesReportIDs {
+				windowsReport = append([]byte{0}, report...)
+			}
+			wantState, wantOK := want.Decode(report)
+			gotState, gotOK := got.Decode(windowsReport)
+			if gotOK != wantOK || !reflect.DeepEqual(gotState, wantState) {
+				t.Errorf("%s: report % x decoded to %+v, want %+v", test.name, report, gotState, wantState)
+			}
+		}
+	}
+}
+
+func TestDescriptorFromCapsArraySlots(t *testing.T) {
+	parsed, err := ParseHIDReportDescriptor(reportIDDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	array := buttonCaps(3, 9, 16)
+	array.Array, array.ReportCount = true, 2
+
+	descriptor := DescriptorFromCaps([]HIDCaps{array}, 5, descriptorWriter{parsed})
+	if len(descriptor.Fields) != 2 {
+		t.Fatalf("%d fields, want a field per slot", len(descriptor.Fields))
+	}
+	for n, field := range descriptor.Fields {
+		if field.BitOffset != n*4 || field.BitSize != 4 || field.LogicalMin != 1 || field.LogicalMax != 8 || field.UsageMin != button(9) || field.UsageMax != button(16) {
+			t.Errorf("slot %d: %+v, want 4 bits at %d with indexes 1 to 8", n, field, n*4)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package controller
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boombuler/hid"
+)
+
+var ErrBadCapture = errors.New("not a HID capture")
+
+// CaptureHID makes OpenDevice log the traffic of every device to a capture
+// file in the captures directory of the data directory. It is set by the
+// GAMEPADSERVER_HID_CAPTURE environment variable.
+var CaptureHID = os.Getenv("GAMEPADSERVER_HID_CAPTURE") != ""
+
+var (
+	simulatedMutex   sync.Mutex
+	simulatedDevices = make(map[string]simulatedDevice)
+)
+
+type simulatedDevice struct {
+	info *hid.DeviceInfo
+	open func() (hid.Device, error)
+}
+
+// AddSimulatedDevice makes OpenDevice call open for the path of info, and
+// WithSimulatedDevices list it, so a simulated controller runs through the
+// same handlers as a real one.
+func AddSimulatedDevice(info *hid.DeviceInfo, open func() (hid.Device, error)) {
+	simulatedMutex.Lock()
+	defer simulatedMutex.Unlock()
+
+	simulatedDevices[info.Path] = simulatedDevice{info, open}
+}
+
+func RemoveSimulatedDevice(path string) {
+	simulatedMutex.Lock()
+	defer simulatedMutex.Unlock()
+
+	delete(simulatedDevices, path)
+}
+
+// WithSimulatedDevices adds the simulated devices to the devices of an
+// enumerator.
+func WithSimulatedDevices(enumerator DeviceEnumerator) DeviceEnumerator {
+	return DeviceEnumeratorFunc(func() []*hid.DeviceInfo {
+		devices := enumerator.Devices()
+
+		simulatedMutex.Lock()
+		defer simulatedMutex.Unlock()
+		for _, device := range simulatedDevices {
+			devices = append(devices, device.info)
+		}
+		return devices
+	})
+}
+
+// OpenDevice opens a HID device, or the simulated device registered for
+// its path, and wraps it in a CaptureDevice when CaptureHID is set.
+func OpenDevice(info *hid.DeviceInfo) (hid.Device, error) {
+	simulatedMutex.Lock()
+	simulated, ok := simulatedDevices[info.Path]
+	simulatedMutex.Unlock()
+
+	var device hid.Device
+	var err error
+	if ok {
+		device, err = simulated.open()
+	} else {
+		device, err = info.Open()
+		if err == nil {
+			device = &platformDevice{Device: device, info: info}
+		}
+	}
+	if err != nil || !CaptureHID {
+		return device, err
+	}
+
+	name := SafeFileName(info.Product) + "-" + time.Now().Format("20060102-150405") + ".hidcap"
+	path, err := DataPath("captures", name)
+	if err == nil {
+		var capture *CaptureDevice
+		capture, err = NewCaptureFile(device, path, info)
+		if err == nil {
+			return capture, nil
+		}
+	}
+	NotifyError(info.Product, "unable to capture HID traffic: "+err.Error())
+	return device, nil
+}
+
+// CaptureDevice is a hid.Device that logs every read and write of the
+// device it wraps. The capture is text, one report per line:
+//
+//	# header lines
+//	<µs since open> r|w <hex bytes>
+//
+// Times come from the monotonic clock, reads are stamped when they return.
+type CaptureDevice struct {
+	hid.Device
+
+	mutex  sync.Mutex
+	writer *bufio.Writer
+	closer io.Closer
+	start  time.Time
+}
+
+// NewCapture starts a capture of device on w. Closing the device closes w
+// when it is an io.Closer.
+func NewCapture(device hid.Device, w io.Writer, info *hid.DeviceInfo) *CaptureDevice {
+	capture := &CaptureDevice{Device: device, writer: bufio.NewWriter(w), start: time.Now()}
+	if closer, ok := w.(io.Closer); ok {
+		capture.closer = closer
+	}
+
+	fmt.Fprintf(capture.writer, "# GamepadServer HID capture %s\n", capture.start.Format(time.RFC3339))
+	if info != nil {
+		fmt.Fprintf(capture.writer, "# %04x:%04x %s %s %s\n", info.VendorId, info.ProductId, info.Manufacturer, info.Product, info.Path)
+	}
+	capture.writer.Flush()
+	return capture
+}
+
+func NewCaptureFile(device hid.Device, path string, info *hid.DeviceInfo) (*CaptureDevice, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewCapture(device, file, info), nil
+}
+
+func (capture *CaptureDevice) log(direction byte, data []byte) {
+	capture.mutex.Lock()
+	defer capture.mutex.Unlock()
+
+	at := time.Since(capture.start) / time.Microsecond
+	fmt.Fprintf(capture.writer, "%d %c %s\n", at, direction, hex.EncodeToString(data))
+	// Captures are for debugging, so nothing is kept back when the
+	// server dies.
+	capture.writer.Flush()
+}
+
+func (capture *CaptureDevice) Write(data []byte) error {
+	capture.log('w', data)
+	return capture.Device.Write(data)
+}
+
+func (capture *CaptureDevice) Read() ([]byte, error) {
+	data, err := capture.Device.Read()
+	if err == nil {
+		capture.log('r', data)
+	}
+	return data, err
+}
+
+// GetFeatureReport reads through the captured device, feature reports are
+// not part of captures.
+func (capture *CaptureDevice) GetFeatureReport(reportID byte) ([]byte, error) {
+	device, ok := capture.Device.(FeatureReportDevice)
+	if !ok {
+		return nil, ErrFeatureReportsUnsupported
+	}
+	return device.GetFeatureReport(reportID)
+}
+
+func (capture *CaptureDevice) ReportDescriptor() (*HIDReportDescriptor, error) {
+	device, ok := capture.Device.(ReportDescriptorDevice)
+	if !ok {
+		return nil, ErrNoReportDescriptor
+	}
+	return device.ReportDescriptor()
+}
+
+func (capture *CaptureDevice) Close() {
+	capture.Device.Close()
+
+	capture.mutex.Lock()
+	defer capture.mutex.Unlock()
+	capture.writer.Flush()
+	if capture.closer != nil {
+		capture.closer.Close()
+		capture.closer = nil
+	}
+}
+
+// CapturedReport is one line of a capture.
+type CapturedReport struct {
+	At    time.Duration
+	Write bool
+	Data  []byte
+}
+
+// ReadHIDCapture reads the reports of a capture.
+func ReadHIDCapture(r io.Reader) ([]CapturedReport, error) {
+	var reports []CapturedReport
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 64*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		// Empty reads have no data field.
+		fields := append(strings.Fields(text), "")
+		if len(fields) < 3 || len(fields) > 4 || fields[1] != "r" && fields[1] != "w" {
+			return nil, fmt.Errorf("capture line %d: %w", line, ErrBadCapture)
+		}
+		at, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("capture line %d: %w", line, ErrBadCapture)
+		}
+		data, err := hex.DecodeString(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("capture line %d: %w", line, ErrBadCapture)
+		}
+		reports = append(reports, CapturedReport{
+			At:    time.Duration(at) * time.Microsecond,
+			Write: fields[1] == "w",
+			Data:  data,
+		})
+	}
+	return reports, scanner.Err()
+}
+
+func LoadHIDCapture(path string) ([]CapturedReport, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ReadHIDCapture(file)
+}
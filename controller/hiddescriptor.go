@@ -0,0 +1,281 @@
+package controller
+
+import (
+	"errors"
+)
+
+// Usage pages and usages of the Generic Desktop page used by gamepads.
+const (
+	HIDUsagePageGenericDesktop = 0x01
+	HIDUsagePageButton         = 0x09
+
+	HIDUsageJoystick  = 0x04
+	HIDUsageGamepad   = 0x05
+	HIDUsageX         = 0x30
+	HIDUsageY         = 0x31
+	HIDUsageZ         = 0x32
+	HIDUsageRx        = 0x33
+	HIDUsageRy        = 0x34
+	HIDUsageRz        = 0x35
+	HIDUsageSlider    = 0x36
+	HIDUsageDial      = 0x37
+	HIDUsageWheel     = 0x38
+	HIDUsageHatSwitch = 0x39
+)
+
+// Item types and tags of the short items of a report descriptor.
+const (
+	hidItemMain   = 0
+	hidItemGlobal = 1
+	hidItemLocal  = 2
+
+	hidMainInput         = 0x8
+	hidMainOutput        = 0x9
+	hidMainCollection    = 0xA
+	hidMainFeature       = 0xB
+	hidMainEndCollection = 0xC
+
+	hidGlobalUsagePage   = 0x0
+	hidGlobalLogicalMin  = 0x1
+	hidGlobalLogicalMax  = 0x2
+	hidGlobalReportSize  = 0x7
+	hidGlobalReportID    = 0x8
+	hidGlobalReportCount = 0x9
+	hidGlobalPush        = 0xA
+	hidGlobalPop         = 0xB
+
+	hidLocalUsage    = 0x0
+	hidLocalUsageMin = 0x1
+	hidLocalUsageMax = 0x2
+
+	hidLongItemPrefix = 0xFE
+)
+
+var (
+	ErrDescriptorTruncated  = errors.New("report descriptor truncated")
+	ErrDescriptorCollection = errors.New("report descriptor has unbalanced collections")
+	ErrDescriptorStack      = errors.New("report descriptor pops an empty global stack")
+)
+
+// HIDUsage combines a usage page (high 16 bits) and a usage ID.
+type HIDUsage uint32
+
+func NewHIDUsage(page, id uint16) HIDUsage {
+	return HIDUsage(uint32(page)<<16 | uint32(id))
+}
+
+func (usage HIDUsage) Page() uint16 {
+	return uint16(usage >> 16)
+}
+
+func (usage HIDUsage) ID() uint16 {
+	return uint16(usage)
+}
+
+// HIDReportField is one value of an input report. Array fields hold the
+// index of the active usage between UsageMin and UsageMax instead.
+type HIDReportField struct {
+	ReportID   byte
+	BitOffset  int
+	BitSize    int
+	Usage      HIDUsage
+	UsageMin   HIDUsage
+	UsageMax   HIDUsage
+	LogicalMin int32
+	LogicalMax int32
+	Array      bool
+}
+
+type HIDReportDescriptor struct {
+	Fields        []HIDReportField
+	UsesReportIDs bool
+}
+
+type hidGlobalState struct {
+	usagePage  uint16
+	logicalMin int32
+	logicalMax int32
+	// logicalMax read as unsigned, for descriptors that write a maximum
+	// like 0xFF in a single byte.
+	logicalMaxUnsigned uint32
+	reportSize         int
+	reportID           byte
+	reportCount        int
+}
+
+// ParseHIDReportDescriptor walks the items of a report descriptor and
+// collects the input fields. Constant (padding) fields are skipped but
+// still move the bit offset.
+func ParseHIDReportDescriptor(data []byte) (*HIDReportDescriptor, error) {
+	descriptor := &HIDReportDescriptor{}
+	offsets := make(map[byte]int)
+
+	var global hidGlobalState
+	var stack []hidGlobalState
+	var usages []HIDUsage
+	var usageMin, usageMax HIDUsage
+	var haveUsageMin, haveUsageMax bool
+	depth := 0
+
+	for i := 0; i < len(data); {
+		prefix := data[i]
+		if prefix == hidLongItemPrefix {
+			if i+1 >= len(data) || i+3+int(data[i+1]) > len(data) {
+				return nil, ErrDescriptorTruncated
+			}
+			i += 3 + int(data[i+1])
+			continue
+		}
+
+		size := int(prefix & 0x3)
+		if size == 3 {
+			size = 4
+		}
+		itemType := (prefix >> 2) & 0x3
+		tag := prefix >> 4
+		if i+1+size > len(data) {
+			return nil, ErrDescriptorTruncated
+		}
+
+		var value uint32
+		for b := 0; b < size; b++ {
+			value |= uint32(data[i+1+b]) << (8 * b)
+		}
+		signed := int32(value)
+		if size > 0 && size < 4 && value&(1<<(8*size-1)) != 0 {
+			signed = int32(value) - int32(1)<<(8*size)
+		}
+		i += 1 + size
+
+		// Usages with 4 bytes of data carry their own usage page.
+		usage := func() HIDUsage {
+			if size == 4 {
+				return HIDUsage(value)
+			}
+			return NewHIDUsage(global.usagePage, uint16(value))
+		}
+
+		switch itemType {
+		case hidItemMain:
+			switch tag {
+			case hidMainInput:
+				descriptor.addInput(&global, offsets, value, usages, usageMin, usageMax, haveUsageMin && haveUsageMax)
+			case hidMainCollection:
+				depth++
+			case hidMainEndCollection:
+				depth--
+				if depth < 0 {
+					return nil, ErrDescriptorCollection
+				}
+			}
+			usages = nil
+			haveUsageMin, haveUsageMax = false, false
+		case hidItemGlobal:
+			switch tag {
+			case hidGlobalUsagePage:
+				global.usagePage = uint16(value)
+			case hidGlobalLogicalMin:
+				global.logicalMin = signed
+			case hidGlobalLogicalMax:
+				global.logicalMax = signed
+				global.logicalMaxUnsigned = value
+			case hidGlobalReportSize:
+				global.reportSize = int(value)
+			case hidGlobalReportID:
+				global.reportID = byte(value)
+				descriptor.UsesReportIDs = true
+			case hidGlobalReportCount:
+				global.reportCount = int(value)
+			case hidGlobalPush:
+				stack = append(stack, global)
+			case hidGlobalPop:
+				if len(stack) == 0 {
+					return nil, ErrDescriptorStack
+				}
+				global = stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+			}
+		case hidItemLocal:
+			switch tag {
+			case hidLocalUsage:
+				usages = append(usages, usage())
+			case hidLocalUsageMin:
+				usageMin, haveUsageMin = usage(), true
+			case hidLocalUsageMax:
+				usageMax, haveUsageMax = usage(), true
+			}
+		}
+	}
+
+	if depth != 0 {
+		return nil, ErrDescriptorCollection
+	}
+
+	return descriptor, nil
+}
+
+func (descriptor *HIDReportDescriptor) addInput(global *hidGlobalState, offsets map[byte]int, flags uint32, usages []HIDUsage, usageMin, usageMax HIDUsage, haveRange bool) {
+	constant := flags&0x1 != 0
+	variable := flags&0x2 != 0
+
+	logicalMax := global.logicalMax
+	if global.logicalMin >= 0 && logicalMax < 0 {
+		logicalMax = int32(global.logicalMaxUnsigned)
+	}
+
+	offset := offsets[global.reportID]
+	offsets[global.reportID] = offset + global.reportSize*global.reportCount
+	if constant {
+		return
+	}
+
+	for n := 0; n < global.reportCount; n++ {
+		field := HIDReportField{
+			ReportID:   global.reportID,
+			BitOffset:  offset + n*global.reportSize,
+			BitSize:    global.reportSize,
+			LogicalMin: global.logicalMin,
+			LogicalMax: logicalMax,
+			Array:      !variable,
+		}
+
+		switch {
+		case !variable:
+			field.UsageMin, field.UsageMax = usageMin, usageMax
+			if !haveRange && len(usages) > 0 {
+				field.UsageMin, field.UsageMax = usages[0], usages[len(usages)-1]
+			}
+		case n < len(usages):
+			field.Usage = usages[n]
+		case haveRange && uint32(usageMin)+uint32(n) <= uint32(usageMax):
+			field.Usage = usageMin + HIDUsage(n)
+		case len(usages) > 0:
+			field.Usage = usages[len(usages)-1]
+		default:
+			continue
+		}
+
+		descriptor.Fields = append(descriptor.Fields, field)
+	}
+}
+
+// Value extracts the field from an input report without its report ID.
+func (field *HIDReportField) Value(report []byte) (int32, bool) {
+	if field.BitSize == 0 || field.BitSize > 32 || field.BitOffset+field.BitSize > len(report)*8 {
+		return 0, false
+	}
+
+	var value uint32
+	for b := 0; b < field.BitSize; b++ {
+		bit := field.BitOffset + b
+		if report[bit/8]&(1<<uint(bit%8)) != 0 {
+			value |= 1 << uint(b)
+		}
+	}
+
+	if field.LogicalMin < 0 && field.BitSize < 32 && value&(1<<uint(field.BitSize-1)) != 0 {
+		return int32(value) - int32(1)<<uint(field.BitSize), true
+	}
+
+	return int32(value), true
+}
@@ -0,0 +1,312 @@
+package controller
+
+import (
+	"errors"
+	"testing"
+)
+
+// Report descriptor of the DualShock 4 (054c:05c4) over USB, input report
+// and the first output and feature reports.
+var ds4Descriptor = []byte{
+	0x05, 0x01, 0x09, 0x05, 0xA1, 0x01,
+	0x85, 0x01,
+	0x09, 0x30, 0x09, 0x31, 0x09, 0x32, 0x09, 0x35, 0x15, 0x00, 0x26, 0xFF, 0x00, 0x75, 0x08, 0x95, 0x04, 0x81, 0x02,
+	0x09, 0x39, 0x15, 0x00, 0x25, 0x07, 0x35, 0x00, 0x46, 0x3B, 0x01, 0x65, 0x14, 0x75, 0x04, 0x95, 0x01, 0x81, 0x42,
+	0x65, 0x00,
+	0x05, 0x09, 0x19, 0x01, 0x29, 0x0E, 0x15, 0x00, 0x25, 0x01, 0x75, 0x01, 0x95, 0x0E, 0x81, 0x02,
+	0x06, 0x00, 0xFF, 0x09, 0x20, 0x75, 0x06, 0x95, 0x01, 0x15, 0x00, 0x25, 0x7F, 0x81, 0x02,
+	0x05, 0x01, 0x09, 0x33, 0x09, 0x34, 0x15, 0x00, 0x26, 0xFF, 0x00, 0x75, 0x08, 0x95, 0x02, 0x81, 0x02,
+	0x06, 0x00, 0xFF, 0x09, 0x21, 0x95, 0x36, 0x81, 0x02,
+	0x85, 0x05, 0x09, 0x22, 0x95, 0x1F, 0x91, 0x02,
+	0x85, 0x04, 0x09, 0x23, 0x95, 0x24, 0xB1, 0x02,
+	0x85, 0x02, 0x09, 0x24, 0x95, 0x24, 0xB1, 0x02,
+	0xC0,
+}
+
+// Report descriptor of the DragonRise generic USB gamepad (0079:0006), which
+// has no report IDs, lists Z twice and pads the report with vendor bits.
+var dragonRiseDescriptor = []byte{
+	0x05, 0x01, 0x09, 0x04, 0xA1, 0x01,
+	0xA1, 0x02,
+	0x75, 0x08, 0x95, 0x05, 0x15, 0x00, 0x26, 0xFF, 0x00, 0x35, 0x00, 0x46, 0xFF, 0x00,
+	0x09, 0x30, 0x09, 0x31, 0x09, 0x32, 0x09, 0x32, 0x09, 0x35, 0x81, 0x02,
+	0x75, 0x04, 0x95, 0x01, 0x25, 0x07, 0x46, 0x3B, 0x01, 0x65, 0x14, 0x09, 0x39, 0x81, 0x42,
+	0x65, 0x00,
+	0x75, 0x01, 0x95, 0x0C, 0x25, 0x01, 0x45, 0x01, 0x05, 0x09, 0x19, 0x01, 0x29, 0x0C, 0x81, 0x02,
+	0x06, 0x00, 0xFF, 0x75, 0x01, 0x95, 0x08, 0x25, 0x01, 0x45, 0x01, 0x09, 0x01, 0x81, 0x02,
+	0xC0,
+	0xA1, 0x02, 0x75, 0x08, 0x95, 0x07, 0x46, 0xFF, 0x00, 0x26, 0xFF, 0x00, 0x09, 0x02, 0x91, 0x02, 0xC0,
+	0xC0,
+}
+
+// A pad splitting its controls over report IDs: buttons and the left stick
+// in report 1, a signed 16-bit right stick in report 2 and a button array
+// in report 3.
+var reportIDDescriptor = []byte{
+	0x05, 0x01, 0x09, 0x05, 0xA1, 0x01,
+	0x85, 0x01,
+	0x05, 0x09, 0x19, 0x01, 0x29, 0x08, 0x15, 0x00, 0x25, 0x01, 0x75, 0x01, 0x95, 0x08, 0x81, 0x02,
+	0x05, 0x01, 0x09, 0x30, 0x09, 0x31, 0x26, 0xFF, 0x00, 0x75, 0x08, 0x95, 0x02, 0x81, 0x02,
+	0x85, 0x02,
+	0x09, 0x33, 0x09, 0x34, 0x16, 0x00, 0x80, 0x26, 0xFF, 0x7F, 0x75, 0x10, 0x95, 0x02, 0x81, 0x02,
+	0x85, 0x03,
+	0x05, 0x09, 0x19, 0x09, 0x29, 0x10, 0x15, 0x01, 0x25, 0x08, 0x75, 0x04, 0x95, 0x02, 0x81, 0x00,
+	0xC0,
+}
+
+// A pad saving its globals around a 16-bit axis with push and pop, naming
+// the hat with a 4-byte usage and carrying a long item.
+var pushPopDescriptor = []byte{
+	0x05, 0x01, 0x09, 0x05, 0xA1, 0x01,
+	0x15, 0x00, 0x26, 0xFF, 0x00, 0x75, 0x08, 0x95, 0x02, 0x09, 0x30, 0x09, 0x31, 0x81, 0x02,
+	0xA4,
+	0x16, 0x00, 0x80, 0x26, 0xFF, 0x7F, 0x75, 0x10, 0x95, 0x01, 0x09, 0x35, 0x81, 0x02,
+	0xB4,
+	0xFE, 0x02, 0xF0, 0xAA, 0xBB,
+	0x95, 0x01, 0x09, 0x32, 0x81, 0x02,
+	0x0B, 0x39, 0x00, 0x01, 0x00, 0x25, 0x07, 0x75, 0x04, 0x81, 0x42,
+	0x75, 0x04, 0x81, 0x03,
+	0xC0,
+}
+
+type wantField struct {
+	usage      HIDUsage
+	reportID   byte
+	offset     int
+	size       int
+	logicalMin int32
+	logicalMax int32
+}
+
+func desktop(id uint16) HIDUsage {
+	return NewHIDUsage(HIDUsagePageGenericDesktop, id)
+}
+
+func button(id uint16) HIDUsage {
+	return NewHIDUsage(HIDUsagePageButton, id)
+}
+
+func checkFields(t *testing.T, descriptor *HIDReportDescriptor, want []wantField) {
+	t.Helper()
+	for _, w := range want {
+		var field *HIDReportField
+		for i := range descriptor.Fields {
+			if descriptor.Fields[i].Usage == w.usage && descriptor.Fields[i].ReportID == w.reportID {
+				field = &descriptor.Fields[i]
+				break
+			}
+		}
+		if field == nil {
+			t.Errorf("no field for usage %08x in report %d", uint32(w.usage), w.reportID)
+			continue
+		}
+		if field.BitOffset != w.offset || field.BitSize != w.size {
+			t.Errorf("usage %08x: bits %d+%d, want %d+%d", uint32(w.usage), field.BitOffset, field.BitSize, w.offset, w.size)
+		}
+		if field.LogicalMin != w.logicalMin || field.LogicalMax != w.logicalMax {
+			t.Errorf("usage %08x: logical %d..%d, want %d..%d", uint32(w.usage), field.LogicalMin, field.LogicalMax, w.logicalMin, w.logicalMax)
+		}
+	}
+}
+
+func TestParseDS4Descriptor(t *testing.T) {
+	descriptor, err := ParseHIDReportDescriptor(ds4Descriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !descriptor.UsesReportIDs {
+		t.Error("report IDs not detected")
+	}
+
+	checkFields(t, descriptor, []wantField{
+		{desktop(HIDUsageX), 1, 0, 8, 0, 255},
+		{desktop(HIDUsageY), 1, 8, 8, 0, 255},
+		{desktop(HIDUsageZ), 1, 16, 8, 0, 255},
+		{desktop(HIDUsageRz), 1, 24, 8, 0, 255},
+		{desktop(HIDUsageHatSwitch), 1, 32, 4, 0, 7},
+		{button(1), 1, 36, 1, 0, 1},
+		{button(14), 1, 49, 1, 0, 1},
+		{NewHIDUsage(0xFF00, 0x20), 1, 50, 6, 0, 127},
+		{desktop(HIDUsageRx), 1, 56, 8, 0, 255},
+		{desktop(HIDUsageRy), 1, 64, 8, 0, 255},
+	})
+
+	// Output and feature reports are not input fields.
+	for _, field := range descriptor.Fields {
+		if field.ReportID != 1 {
+			t.Errorf("field %08x of report %d", uint32(field.Usage), field.ReportID)
+		}
+	}
+
+	layout, err := NewGenericHIDLayout(descriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(layout.Buttons) != 14 {
+		t.Errorf("%d buttons, want 14", len(layout.Buttons))
+	}
+
+	// Cross pressed, hat released, left stick pushed right.
+	report := make([]byte, ds4USBInputReportLength)
+	report[0] = 0x01
+	report[1], report[2], report[3], report[4] = 0xFF, 0x80, 0x80, 0x80
+	report[5] = 0x28
+	state, ok := layout.Decode(report)
+	if !ok {
+		t.Fatal("report not decoded")
+	}
+	if state.Buttons != 1<<1 {
+		t.Errorf("buttons %b, want cross", state.Buttons)
+	}
+	if state.Hat != -1 {
+		t.Errorf("hat %d, want released", state.Hat)
+	}
+	if state.Axes["x"] != 1 {
+		t.Errorf("x %v, want 1", state.Axes["x"])
+	}
+
+	// Feature report IDs are not input reports.
+	if _, ok := layout.Decode([]byte{0x02, 0, 0, 0, 0, 0}); ok {
+		t.Error("report 2 decoded")
+	}
+}
+
+func TestParseDragonRiseDescriptor(t *testing.T) {
+	descriptor, err := ParseHIDReportDescriptor(dragonRiseDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if descriptor.UsesReportIDs {
+		t.Error("report IDs detected")
+	}
+
+	checkFields(t, descriptor, []wantField{
+		{desktop(HIDUsageX), 0, 0, 8, 0, 255},
+		{desktop(HIDUsageY), 0, 8, 8, 0, 255},
+		{desktop(HIDUsageZ), 0, 16, 8, 0, 255},
+		{desktop(HIDUsageRz), 0, 32, 8, 0, 255},
+		{desktop(HIDUsageHatSwitch), 0, 40, 4, 0, 7},
+		{button(1), 0, 44, 1, 0, 1},
+		{button(12), 0, 55, 1, 0, 1},
+		{NewHIDUsage(0xFF00, 0x01), 0, 56, 1, 0, 1},
+	})
+
+	layout, err := NewGenericHIDLayout(descriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first of the two Z fields is used.
+	if layout.Axes["z"].BitOffset != 16 {
+		t.Errorf("z at bit %d, want 16", layout.Axes["z"].BitOffset)
+	}
+
+	// Hat right, buttons 1 and 12.
+	state, ok := layout.Decode([]byte{0x7F, 0x7F, 0x7F, 0x7F, 0x7F, 0x12, 0x80, 0x00})
+	if !ok {
+		t.Fatal("report not decoded")
+	}
+	if state.Hat != 2 {
+		t.Errorf("hat %d, want 2", state.Hat)
+	}
+	if state.Buttons != 1|1<<11 {
+		t.Errorf("buttons %b, want 1 and 12", state.Buttons)
+	}
+}
+
+func TestParseReportIDDescriptor(t *testing.T) {
+	descriptor, err := ParseHIDReportDescriptor(reportIDDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Offsets start over in every report.
+	checkFields(t, descriptor, []wantField{
+		{button(1), 1, 0, 1, 0, 1},
+		{button(8), 1, 7, 1, 0, 1},
+		{desktop(HIDUsageX), 1, 8, 8, 0, 255},
+		{desktop(HIDUsageY), 1, 16, 8, 0, 255},
+		{desktop(HIDUsageRx), 2, 0, 16, -32768, 32767},
+		{desktop(HIDUsageRy), 2, 16, 16, -32768, 32767},
+	})
+
+	var arrays []HIDReportField
+	for _, field := range descriptor.Fields {
+		if field.Array {
+			arrays = append(arrays, field)
+		}
+	}
+	if len(arrays) != 2 || arrays[0].ReportID != 3 || arrays[1].BitOffset != 4 || arrays[0].UsageMin != button(9) || arrays[0].UsageMax != button(16) {
+		t.Errorf("button arrays %+v", arrays)
+	}
+
+	layout, err := NewGenericHIDLayout(descriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state, ok := layout.Decode([]byte{0x02, 0x00, 0x80, 0xFF, 0x7F})
+	if !ok {
+		t.Fatal("report 2 not decoded")
+	}
+	if state.Axes["rx"] != -1 || state.Axes["ry"] != 1 {
+		t.Errorf("right stick %v, %v, want -1, 1", state.Axes["rx"], state.Axes["ry"])
+	}
+	if _, ok := state.Axes["x"]; ok {
+		t.Error("left stick decoded from report 2")
+	}
+
+	// Buttons 9 and 11 from the two array fields.
+	state, ok = layout.Decode([]byte{0x03, 0x31})
+	if !ok {
+		t.Fatal("report 3 not decoded")
+	}
+	if state.Buttons != 1<<8|1<<10 {
+		t.Errorf("buttons %b, want 9 and 11", state.Buttons)
+	}
+
+	if _, ok := layout.Decode([]byte{0x04, 0x00}); ok {
+		t.Error("unknown report decoded")
+	}
+}
+
+func TestParsePushPopDescriptor(t *testing.T) {
+	descriptor, err := ParseHIDReportDescriptor(pushPopDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Z comes after the pop, with the 8-bit globals back.
+	checkFields(t, descriptor, []wantField{
+		{desktop(HIDUsageX), 0, 0, 8, 0, 255},
+		{desktop(HIDUsageY), 0, 8, 8, 0, 255},
+		{desktop(HIDUsageRz), 0, 16, 16, -32768, 32767},
+		{desktop(HIDUsageZ), 0, 32, 8, 0, 255},
+		{desktop(HIDUsageHatSwitch), 0, 40, 4, 0, 7},
+	})
+	// The constant padding is not a field.
+	if len(descriptor.Fields) != 5 {
+		t.Errorf("%d fields, want 5", len(descriptor.Fields))
+	}
+}
+
+func TestParseBadDescriptors(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"pop without push", []byte{0x05, 0x01, 0xB4}, ErrDescriptorStack},
+		{"unclosed collection", []byte{0xA1, 0x01, 0x09, 0x30}, ErrDescriptorCollection},
+		{"extra end collection", []byte{0xA1, 0x01, 0xC0, 0xC0}, ErrDescriptorCollection},
+		{"truncated item", []byte{0x26, 0xFF}, ErrDescriptorTruncated},
+		{"truncated long item", []byte{0xA1, 0x01, 0xFE}, ErrDescriptorTruncated},
+		{"truncated long item data", []byte{0xFE, 0x05, 0xF0, 0x01}, ErrDescriptorTruncated},
+	}
+
+	for _, test := range tests {
+		_, err := ParseHIDReportDescriptor(test.data)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: %v, want %v", test.name, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package controller
+
+import (
+	"errors"
+
+	"github.com/boombuler/hid"
+)
+
+var (
+	ErrFeatureReportsUnsupported = errors.New("device does not support reading feature reports")
+	ErrNoBusType                 = errors.New("bus type of the device is unknown")
+)
+
+// Bus types of linux/input.h, as in the HID_ID of a device.
+const (
+	busUSB       = 0x03
+	busBluetooth = 0x05
+)
+
+// Length of the feature report buffer when the device does not tell.
+const defaultFeatureReportLength = 64
+
+// platformDevice adds what the hid package leaves out, reading feature
+// reports and the report descriptor, by going to the operating system with
+// the device path.
+type platformDevice struct {
+	hid.Device
+	info *hid.DeviceInfo
+}
+
+func (device *platformDevice) GetFeatureReport(reportID byte) ([]byte, error) {
+	length := int(device.info.FeatureReportLength)
+	if length == 0 {
+		length = defaultFeatureReportLength
+	}
+	return getFeatureReport(device.info, reportID, length)
+}
+
+func (device *platformDevice) ReportDescriptor() (*HIDReportDescriptor, error) {
+	return readReportDescriptor(device.info)
+}
@@ -0,0 +1,174 @@
+package controller
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/boombuler/hid"
+)
+
+const sysHIDRaw = "/sys/class/hidraw"
+
+// hidrawNode is a /dev/hidrawN node with the sysfs directory of its HID
+// device.
+type hidrawNode struct {
+	dev   string
+	sysfs string
+}
+
+// findHIDRaw finds the hidraw node of a device. A path naming a hidraw
+// node is taken as is, a usbfs path is matched on its bus and device
+// numbers, and anything else on the vendor and product IDs when a single
+// node has them.
+func findHIDRaw(info *hid.DeviceInfo) (*hidrawNode, error) {
+	entries, err := os.ReadDir(sysHIDRaw)
+	if err != nil {
+		return nil, fmt.Errorf("no hidraw devices: %w", err)
+	}
+
+	var bus, dev int
+	usbfs := false
+	if _, err := fmt.Sscanf(info.Path, "/dev/bus/usb/%d/%d", &bus, &dev); err == nil {
+		usbfs = true
+	}
+
+	var matches []*hidrawNode
+	for _, entry := range entries {
+		node := &hidrawNode{
+			dev:   filepath.Join("/dev", entry.Name()),
+			sysfs: filepath.Join(sysHIDRaw, entry.Name(), "device"),
+		}
+		if node.dev == info.Path {
+			return node, nil
+		}
+
+		_, vendor, product, err := node.id()
+		if err != nil || vendor != info.VendorId || product != info.ProductId {
+			continue
+		}
+		if usbfs && !node.onUSBDevice(bus, dev) {
+			continue
+		}
+		matches = append(matches, node)
+	}
+
+	switch {
+	case len(matches) == 0:
+		return nil, fmt.Errorf("no hidraw node for %s", info.Path)
+	case len(matches) > 1 && !usbfs:
+		return nil, fmt.Errorf("several hidraw nodes for %04x:%04x", info.VendorId, info.ProductId)
+	}
+	return matches[0], nil
+}
+
+// id reads the bus type, vendor and product of the HID device from its
+// uevent, as in HID_ID=0005:0000054C:000009CC.
+func (node *hidrawNode) id() (bus, vendor, product uint16, err error) {
+	file, err := os.Open(filepath.Join(node.sysfs, "uevent"))
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		value, ok := strings.CutPrefix(scanner.Text(), "HID_ID=")
+		if !ok {
+			continue
+		}
+		var ids [3]uint64
+		fields := strings.Split(value, ":")
+		if len(fields) != 3 {
+			break
+		}
+		for i, field := range fields {
+			ids[i], err = strconv.ParseUint(field, 16, 32)
+			if err != nil {
+				return 0, 0, 0, err
+			}
+		}
+		return uint16(ids[0]), uint16(ids[1]), uint16(ids[2]), nil
+	}
+	return 0, 0, 0, fmt.Errorf("%s has no HID_ID", node.sysfs)
+}
+
+// onUSBDevice reports whether the node belongs to the USB device with the
+// given bus and device numbers, found in a parent directory in sysfs.
+func (node *hidrawNode) onUSBDevice(bus, dev int) bool {
+	dir, err := filepath.EvalSymlinks(node.sysfs)
+	if err != nil {
+		return false
+	}
+	for ; dir != "/" && dir != "."; dir = filepath.Dir(dir) {
+		busnum, err := readSysfsInt(filepath.Join(dir, "busnum"))
+		if err != nil {
+			continue
+		}
+		devnum, err := readSysfsInt(filepath.Join(dir, "devnum"))
+		return err == nil && busnum == bus && devnum == dev
+	}
+	return false
+}
+
+func readSysfsInt(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+func hidBusType(info *hid.DeviceInfo) (uint16, error) {
+	node, err := findHIDRaw(info)
+	if err != nil {
+		return 0, err
+	}
+	bus, _, _, err := node.id()
+	return bus, err
+}
+
+// hidiocgfeature is HIDIOCGFEATURE(length) of linux/hidraw.h.
+func hidiocgfeature(length int) uintptr {
+	const iocReadWrite = 3
+	return uintptr(iocReadWrite<<30 | length<<16 | 'H'<<8 | 0x07)
+}
+
+func getFeatureReport(info *hid.DeviceInfo, reportID byte, length int) ([]byte, error) {
+	node, err := findHIDRaw(info)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(node.dev, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	buf := make([]byte, length)
+	buf[0] = reportID
+	n, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), hidiocgfeature(length), uintptr(unsafe.Pointer(&buf[0])))
+	if errno != 0 {
+		return nil, fmt.Errorf("feature report 0x%02X: %w", reportID, errno)
+	}
+	return buf[:n], nil
+}
+
+// readReportDescriptor parses the descriptor sysfs exposes, which unlike
+// the hidraw ioctl does not need the device opened for writing.
+func readReportDescriptor(info *hid.DeviceInfo) (*HIDReportDescriptor, error) {
+	node, err := findHIDRaw(info)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(node.sysfs, "report_descriptor"))
+	if err != nil {
+		return nil, err
+	}
+	return ParseHIDReportDescriptor(data)
+}
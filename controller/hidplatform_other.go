@@ -0,0 +1,19 @@
+//go:build !linux && !windows
+
+package controller
+
+import (
+	"github.com/boombuler/hid"
+)
+
+func getFeatureReport(info *hid.DeviceInfo, reportID byte, length int) ([]byte, error) {
+	return nil, ErrFeatureReportsUnsupported
+}
+
+func hidBusType(info *hid.DeviceInfo) (uint16, error) {
+	return 0, ErrNoBusType
+}
+
+func readReportDescriptor(info *hid.DeviceInfo) (*HIDReportDescriptor, error) {
+	return nil, ErrNoReportDescriptor
+}
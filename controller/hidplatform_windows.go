@@ -0,0 +1,252 @@
+package controller
+
+import (
+	"fmt"
+	"unsafe"
+
+	"github.com/boombuler/hid"
+	"golang.org/x/sys/windows"
+)
+
+var (
+	hidDLL = windows.NewLazySystemDLL("hid.dll")
+
+	procHidDGetFeature        = hidDLL.NewProc("HidD_GetFeature")
+	procHidDGetPreparsedData  = hidDLL.NewProc("HidD_GetPreparsedData")
+	procHidDFreePreparsedData = hidDLL.NewProc("HidD_FreePreparsedData")
+	procHidPGetCaps           = hidDLL.NewProc("HidP_GetCaps")
+	procHidPGetButtonCaps     = hidDLL.NewProc("HidP_GetButtonCaps")
+	procHidPGetValueCaps      = hidDLL.NewProc("HidP_GetValueCaps")
+	procHidPSetUsages         = hidDLL.NewProc("HidP_SetUsages")
+	procHidPSetUsageValue     = hidDLL.NewProc("HidP_SetUsageValue")
+)
+
+const (
+	hidpInput         = 0
+	hidpStatusSuccess = 0x00110000
+)
+
+// HIDP_CAPS
+type hidpCaps struct {
+	Usage                     uint16
+	UsagePage                 uint16
+	InputReportByteLength     uint16
+	OutputReportByteLength    uint16
+	FeatureReportByteLength   uint16
+	Reserved                  [17]uint16
+	NumberLinkCollectionNodes uint16
+	NumberInputButtonCaps     uint16
+	NumberInputValueCaps      uint16
+	NumberInputDataIndices    uint16
+	NumberOutputButtonCaps    uint16
+	NumberOutputValueCaps     uint16
+	NumberOutputDataIndices   uint16
+	NumberFeatureButtonCaps   uint16
+	NumberFeatureValueCaps    uint16
+	NumberFeatureDataIndices  uint16
+}
+
+// HIDP_BUTTON_CAPS, with the Range member of its union. Usage is in
+// UsageMin when IsRange is not set.
+type hidpButtonCaps struct {
+	UsagePage         uint16
+	ReportID          byte
+	IsAlias           byte
+	BitField          uint16
+	LinkCollection    uint16
+	LinkUsage         uint16
+	LinkUsagePage     uint16
+	IsRange           byte
+	IsStringRange     byte
+	IsDesignatorRange byte
+	IsAbsolute        byte
+	ReportCount       uint16
+	Reserved2         uint16
+	Reserved          [9]uint32
+	UsageMin          uint16
+	UsageMax          uint16
+	StringMin         uint16
+	StringMax         uint16
+	DesignatorMin     uint16
+	DesignatorMax     uint16
+	DataIndexMin      uint16
+	DataIndexMax      uint16
+}
+
+// HIDP_VALUE_CAPS, with the Range member of its union.
+type hidpValueCaps struct {
+	UsagePage         uint16
+	ReportID          byte
+	IsAlias           byte
+	BitField          uint16
+	LinkCollection    uint16
+	LinkUsage         uint16
+	LinkUsagePage     uint16
+	IsRange           byte
+	IsStringRange     byte
+	IsDesignatorRange byte
+	IsAbsolute        byte
+	HasNull           byte
+	Reserved          byte
+	BitSize           uint16
+	ReportCount       uint16
+	Reserved2         [5]uint16
+	UnitsExp          uint32
+	Units             uint32
+	LogicalMin        int32
+	LogicalMax        int32
+	PhysicalMin       int32
+	PhysicalMax       int32
+	UsageMin          uint16
+	UsageMax          uint16
+	StringMin         uint16
+	StringMax         uint16
+	DesignatorMin     uint16
+	DesignatorMax     uint16
+	DataIndexMin      uint16
+	DataIndexMax      uint16
+}
+
+// The structures must match the sizes of the Windows ones.
+var (
+	_ [64]byte = [unsafe.Sizeof(hidpCaps{})]byte{}
+	_ [72]byte = [unsafe.Sizeof(hidpButtonCaps{})]byte{}
+	_ [72]byte = [unsafe.Sizeof(hidpValueCaps{})]byte{}
+)
+
+func hidpError(call string, status uintptr) error {
+	if uint32(status) == hidpStatusSuccess {
+		return nil
+	}
+	return fmt.Errorf("%s: status 0x%08X", call, uint32(status))
+}
+
+// openHIDHandle opens a second handle on the device, shared with the one
+// of the hid package.
+func openHIDHandle(path string) (windows.Handle, error) {
+	name, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return windows.InvalidHandle, err
+	}
+	return windows.CreateFile(name, windows.GENERIC_READ|windows.GENERIC_WRITE,
+		windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE, nil, windows.OPEN_EXISTING, 0, 0)
+}
+
+func getFeatureReport(info *hid.DeviceInfo, reportID byte, length int) ([]byte, error) {
+	handle, err := openHIDHandle(info.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer windows.CloseHandle(handle)
+
+	buf := make([]byte, length)
+	buf[0] = reportID
+	ok, _, err := procHidDGetFeature.Call(uintptr(handle), uintptr(unsafe.Pointer(&buf[0])), uintptr(length))
+	if ok == 0 {
+		return nil, fmt.Errorf("feature report 0x%02X: %w", reportID, err)
+	}
+	return buf, nil
+}
+
+// hidBusType always fails on Windows, where the Bluetooth HID service in
+// the device path tells the bus instead.
+func hidBusType(info *hid.DeviceInfo) (uint16, error) {
+	return 0, ErrNoBusType
+}
+
+// readReportDescriptor rebuilds the input fields from the capabilities of
+// the device, as Windows does not hand out the report descriptor itself.
+func readReportDescriptor(info *hid.DeviceInfo) (*HIDReportDescriptor, error) {
+	handle, err := openHIDHandle(info.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer windows.CloseHandle(handle)
+
+	var preparsed uintptr
+	ok, _, err := procHidDGetPreparsedData.Call(uintptr(handle), uintptr(unsafe.Pointer(&preparsed)))
+	if ok == 0 {
+		return nil, fmt.Errorf("HidD_GetPreparsedData: %w", err)
+	}
+	defer procHidDFreePreparsedData.Call(preparsed)
+
+	var caps hidpCaps
+	status, _, _ := procHidPGetCaps.Call(preparsed, uintptr(unsafe.Pointer(&caps)))
+	if err := hidpError("HidP_GetCaps", status); err != nil {
+		return nil, err
+	}
+
+	var all []HIDCaps
+	if caps.NumberInputButtonCaps > 0 {
+		buttons := make([]hidpButtonCaps, caps.NumberInputButtonCaps)
+		length := caps.NumberInputButtonCaps
+		status, _, _ = procHidPGetButtonCaps.Call(hidpInput, uintptr(unsafe.Pointer(&buttons[0])), uintptr(unsafe.Pointer(&length)), preparsed)
+		if err := hidpError("HidP_GetButtonCaps", status); err != nil {
+			return nil, err
+		}
+		for _, button := range buttons[:length] {
+			c := HIDCaps{
+				ReportID:       button.ReportID,
+				UsagePage:      button.UsagePage,
+				UsageMin:       button.UsageMin,
+				UsageMax:       button.UsageMin,
+				LinkCollection: button.LinkCollection,
+				Button:         true,
+				// Bit 1 of the main item is set on variables.
+				Array:       button.BitField&0x02 == 0,
+				ReportCount: int(button.ReportCount),
+			}
+			if button.IsRange != 0 {
+				c.UsageMax = button.UsageMax
+			}
+			all = append(all, c)
+		}
+	}
+	if caps.NumberInputValueCaps > 0 {
+		values := make([]hidpValueCaps, caps.NumberInputValueCaps)
+		length := caps.NumberInputValueCaps
+		status, _, _ = procHidPGetValueCaps.Call(hidpInput, uintptr(unsafe.Pointer(&values[0])), uintptr(unsafe.Pointer(&length)), preparsed)
+		if err := hidpError("HidP_GetValueCaps", status); err != nil {
+			return nil, err
+		}
+		for _, value := range values[:length] {
+			c := HIDCaps{
+				ReportID:       value.ReportID,
+				UsagePage:      value.UsagePage,
+				UsageMin:       value.UsageMin,
+				UsageMax:       value.UsageMin,
+				LinkCollection: value.LinkCollection,
+				ReportCount:    int(value.ReportCount),
+				BitSize:        int(value.BitSize),
+				LogicalMin:     value.LogicalMin,
+				LogicalMax:     value.LogicalMax,
+			}
+			if value.IsRange != 0 {
+				c.UsageMax = value.UsageMax
+			}
+			all = append(all, c)
+		}
+	}
+
+	return DescriptorFromCaps(all, int(caps.InputReportByteLength), hidpWriter{preparsed}), nil
+}
+
+// hidpWriter writes usages in reports with the preparsed data of a device.
+type hidpWriter struct {
+	preparsed uintptr
+}
+
+func (writer hidpWriter) SetButtons(caps *HIDCaps, usages []uint16, report []byte) error {
+	length := uint32(len(usages))
+	status, _, _ := procHidPSetUsages.Call(hidpInput, uintptr(caps.UsagePage), uintptr(caps.LinkCollection),
+		uintptr(unsafe.Pointer(&usages[0])), uintptr(unsafe.Pointer(&length)), writer.preparsed,
+		uintptr(unsafe.Pointer(&report[0])), uintptr(len(report)))
+	return hidpError("HidP_SetUsages", status)
+}
+
+func (writer hidpWriter) SetValue(caps *HIDCaps, usage uint16, value uint32, report []byte) error {
+	status, _, _ := procHidPSetUsageValue.Call(hidpInput, uintptr(caps.UsagePage), uintptr(caps.LinkCollection),
+		uintptr(usage), uintptr(value), writer.preparsed,
+		uintptr(unsafe.Pointer(&report[0])), uintptr(len(report)))
+	return hidpError("HidP_SetUsageValue", status)
+}
@@ -0,0 +1,150 @@
+package controller
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	serialNumberAddress = 0x6000
+	colorsAddress       = 0x6050
+)
+
+// Device types in the reply to subcommand 0x02.
+const (
+	SwitchDeviceJoyConLeft  = 1
+	SwitchDeviceJoyConRight = 2
+	SwitchDeviceProCon      = 3
+)
+
+// SwitchColors are the body, button and grip colors stored in the SPI flash.
+// The grip colors are only set on controllers that have grips.
+type SwitchColors struct {
+	Body      [3]byte
+	Buttons   [3]byte
+	LeftGrip  [3]byte
+	RightGrip [3]byte
+}
+
+// DeviceColors is the JSON view of the colors, as "#rrggbb" strings.
+type DeviceColors struct {
+	Body      string `json:"body"`
+	Buttons   string `json:"buttons"`
+	LeftGrip  string `json:"leftGrip,omitempty"`
+	RightGrip string `json:"rightGrip,omitempty"`
+}
+
+// DeviceIdentity tells controllers of the same model apart.
+type DeviceIdentity struct {
+	Serial   string        `json:"serial,omitempty"`
+	MAC      string        `json:"mac,omitempty"`
+	Firmware string        `json:"firmware,omitempty"`
+	Colors   *DeviceColors `json:"colors,omitempty"`
+}
+
+func colorString(color [3]byte) string {
+	return fmt.Sprintf("#%02x%02x%02x", color[0], color[1], color[2])
+}
+
+// readSerial reads the serial number of the controller. Controllers without
+// one have 0xFF in the first byte.
+func (Controller *SwitchProController) readSerial() error {
+	response, err := Controller.ReadSPI(serialNumberAddress, 16)
+	if err != nil {
+		return err
+	}
+
+	Controller.Serial = ""
+	if response[0] < 0x80 {
+		Controller.Serial = strings.TrimSpace(strings.Trim(string(response), "\x00"))
+	}
+
+	return nil
+}
+
+func (Controller *SwitchProController) readColors() error {
+	response, err := Controller.ReadSPI(colorsAddress, 12)
+	if err != nil {
+		return err
+	}
+
+	copy(Controller.Colors.Body[:], response[0:3])
+	copy(Controller.Colors.Buttons[:], response[3:6])
+	copy(Controller.Colors.LeftGrip[:], response[6:9])
+	copy(Controller.Colors.RightGrip[:], response[9:12])
+	return nil
+}
+
+// readDeviceInfo asks the controller for its firmware version, type and
+// Bluetooth address.
+func (Controller *SwitchProController) readDeviceInfo() error {
+	reply, err := Controller.Subcommand(0x02, nil)
+	if err != nil {
+		return err
+	}
+	if len(reply.Data) < 10 {
+		return fmt.Errorf("device info: %w", ErrShortReply)
+	}
+
+	Controller.Firmware = [2]byte{reply.Data[0], reply.Data[1]}
+	Controller.DeviceType = reply.Data[2]
+	Controller.MAC = fmt.Sprintf("%02X:%02X:%02X:%02X:%02X:%02X", reply.Data[4], reply.Data[5], reply.Data[6], reply.Data[7], reply.Data[8], reply.Data[9])
+	return nil
+}
+
+// Kind names the controller model from its device type.
+func (Controller *SwitchProController) Kind() string {
+	switch Controller.DeviceType {
+	case SwitchDeviceJoyConLeft:
+		return "Joy-Con (L)"
+	case SwitchDeviceJoyConRight:
+		return "Joy-Con (R)"
+	case SwitchDeviceProCon:
+		return "Pro Controller"
+	}
+	return "Switch Controller"
+}
+
+// Inputs lists the inputs of a Pro Controller for remapping.
+func (Controller *SwitchProController) Inputs() *OutputTarget {
+	return SwitchProInputs
+}
+
+// DeviceKey identifies the controller in the data directory, by serial
+// number or by Bluetooth address for controllers without a serial.
+func (Controller *SwitchProController) DeviceKey() string {
+	if Controller.Serial != "" {
+		return Controller.Serial
+	}
+	return Controller.MAC
+}
+
+// DisplayName is the name set in the profile of the controller, or its
+// model followed by the end of its address so identical controllers can
+// be told apart.
+func (Controller *SwitchProController) DisplayName() string {
+	if Controller.Profile != nil && Controller.Profile.Name != "" {
+		return Controller.Profile.Name
+	}
+	if len(Controller.MAC) < 17 {
+		return Controller.Kind()
+	}
+	return Controller.Kind() + " " + strings.Replace(Controller.MAC[12:], ":", "", -1)
+}
+
+func (Controller *SwitchProController) Identity() DeviceIdentity {
+	identity := DeviceIdentity{
+		Serial:   Controller.Serial,
+		MAC:      Controller.MAC,
+		Firmware: fmt.Sprintf("%d.%d", Controller.Firmware[0], Controller.Firmware[1]),
+		Colors: &DeviceColors{
+			Body:    colorString(Controller.Colors.Body),
+			Buttons: colorString(Controller.Colors.Buttons),
+		},
+	}
+	if Controller.DeviceType == SwitchDeviceProCon {
+		identity.Colors.LeftGrip = colorString(Controller.Colors.LeftGrip)
+		identity.Colors.RightGrip = colorString(Controller.Colors.RightGrip)
+	}
+	return identity
+}
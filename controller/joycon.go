@@ -0,0 +1,372 @@
+package controller
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"./switchreport"
+	"github.com/boombuler/hid"
+)
+
+// Buttons on the Joy-Con rail. They use the same bits in the right (byte 3)
+// and left (byte 5) button bytes of the 0x30 report.
+const (
+	JoyConButtonSR = 4
+	JoyConButtonSL = 5
+)
+
+// Inputs of a Joy-Con pair for remapping. Capture and the rail buttons are
+// extra, a sideways Joy-Con uses them as Xbox 360 buttons.
+var JoyConInputs = sourceInputs("Joy-Con", "Capture", "LeftSL", "LeftSR", "RightSL", "RightSR")
+
+// Player LED patterns, the high nibble flashes and the low nibble is solid.
+const (
+	joyConLEDWaiting = 0xF0
+	joyConLEDActive  = 0x01
+)
+
+type JoyCon struct {
+	SwitchProController
+	Left bool
+	Path string
+
+	// Latest input of the Joy-Con, guarded by joyConMutex.
+	Buttons  byte
+	ButtonsM byte
+	StickX   float32
+	StickY   float32
+
+	session *joyConSession
+}
+
+// joyConSession is one virtual pad fed by a single sideways Joy-Con or by
+// a left and right Joy-Con paired together.
+type joyConSession struct {
+	Name     string
+	left     *JoyCon
+	right    *JoyCon
+	emulator *Emulator
+	ctr      *Xbox360Controller
+	session  *Session
+	pipeline *Pipeline
+}
+
+var (
+	joyConMutex   sync.Mutex
+	joyConWaiting = make(map[*JoyCon]bool)
+)
+
+func NewJoyCon(ctx context.Context, DeviceInfo *hid.DeviceInfo) {
+	device, err := OpenDevice(DeviceInfo)
+	if err != nil {
+		NotifyError("unable to open Joy-Con", err.Error())
+		return
+	}
+	defer closeOnCancel(ctx, device)()
+
+	jc := &JoyCon{Left: DeviceInfo.ProductId == JoyConLeftProductID, Path: DeviceInfo.Path}
+	jc.Name = DeviceInfo.Manufacturer + " " + DeviceInfo.Product
+	jc.Device = device
+	jc.Transport = TransportOf(DeviceInfo)
+	err = jc.Init()
+	if err != nil {
+		NotifyError("unable to init controller", err.Error())
+		return
+	}
+	jc.Name = jc.DisplayName()
+	// Deferred before joyConRemove, so it runs once the session is gone.
+	defer jc.Restore()
+
+	joyConMutex.Lock()
+	joyConWaiting[jc] = true
+	joyConMutex.Unlock()
+	defer joyConRemove(jc)
+
+	NotifyInfo(jc.Name, "Press SL+SR to use it alone or L+R to pair it")
+
+	// Init leaves the first player LED on.
+	var led byte = joyConLEDActive
+	for ctx.Err() == nil {
+		raw_buf, err := jc.ReadInput()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Error("read failed", "source", "Joy-Con", "device", jc.Path, "err", err)
+			NotifyError(jc.Name, err.Error())
+			return
+		}
+
+		input, err := switchreport.ParseStandard(raw_buf)
+		if err != nil {
+			slog.Debug("bad input report", "source", "Joy-Con", "device", jc.Path, "err", err)
+			countDecodeError("Joy-Con")
+			continue
+		}
+
+		wantLED := joyConUpdate(jc, input)
+		if wantLED != led {
+			if _, err := jc.Subcommand(0x30, []byte{wantLED}); err != nil {
+				NotifyError(jc.Name, err.Error())
+				return
+			}
+			led = wantLED
+		}
+	}
+}
+
+func (jc *JoyCon) pressed(button int) bool {
+	return jc.Buttons&(1<<button) != 0
+}
+
+// joyConUpdate stores the input of a report, forwards it to the
+// session of the Joy-Con or looks for a pairing gesture, and returns the
+// player LED pattern the Joy-Con should show.
+func joyConUpdate(jc *JoyCon, input *switchreport.StandardReport) byte {
+	joyConMutex.Lock()
+	defer joyConMutex.Unlock()
+
+	if jc.Left {
+		jc.Buttons = input.Buttons.Left
+		jc.StickX, jc.StickY = jc.StickCalLeft.StickCalibrate(input.LeftStick.X, input.LeftStick.Y)
+	} else {
+		jc.Buttons = input.Buttons.Right
+		jc.StickX, jc.StickY = jc.StickCalRight.StickCalibrate(input.RightStick.X, input.RightStick.Y)
+	}
+	jc.ButtonsM = input.Buttons.Shared
+
+	if jc.session == nil {
+		joyConMatch(jc)
+	}
+	if jc.session == nil {
+		return joyConLEDWaiting
+	}
+
+	jc.session.Send()
+	jc.session.session.Telemetry.HIDToSend(jc.InputTime(), time.Now())
+	return joyConLEDActive
+}
+
+// joyConMatch starts a session for a waiting Joy-Con when SL+SR is held on
+// it, or when L and R are held on a waiting left and right Joy-Con.
+func joyConMatch(jc *JoyCon) {
+	if jc.pressed(JoyConButtonSL) && jc.pressed(JoyConButtonSR) {
+		if jc.Left {
+			joyConStart(jc, nil)
+		} else {
+			joyConStart(nil, jc)
+		}
+		return
+	}
+
+	// L and R use the same bit as the shoulder buttons of the Pro Controller.
+	if !jc.pressed(SwitchProControllerButtonLeftShoulder) {
+		return
+	}
+	for other := range joyConWaiting {
+		if other.Left == jc.Left || !other.pressed(SwitchProControllerButtonLeftShoulder) {
+			continue
+		}
+		if jc.Left {
+			joyConStart(jc, other)
+		} else {
+			joyConStart(other, jc)
+		}
+		return
+	}
+}
+
+func joyConStart(left, right *JoyCon) {
+	session, err := newJoyConSession(left, right)
+	if err != nil {
+		NotifyError("unable to start Joy-Con session", err.Error())
+		return
+	}
+
+	for _, jc := range []*JoyCon{left, right} {
+		if jc != nil {
+			delete(joyConWaiting, jc)
+			jc.session = session
+		}
+	}
+
+	notifyConnected(session.Name, "Connected")
+}
+
+// joyConRemove closes the session of a disconnected Joy-Con. Its partner,
+// if any, goes back to waiting for a gesture.
+func joyConRemove(jc *JoyCon) {
+	joyConMutex.Lock()
+	defer joyConMutex.Unlock()
+
+	delete(joyConWaiting, jc)
+
+	session := jc.session
+	if session == nil {
+		return
+	}
+	session.Close()
+
+	for _, other := range []*JoyCon{session.left, session.right} {
+		if other != nil && other != jc {
+			other.session = nil
+			joyConWaiting[other] = true
+		}
+	}
+
+	notifyDisconnected(session.Name)
+}
+
+func newJoyConSession(left, right *JoyCon) (*joyConSession, error) {
+	emulator, err := NewEmulator(func(vibration Vibration) {})
+	if err != nil {
+		return nil, err
+	}
+
+	ctr, err := emulator.CreateXbox360Controller()
+	if err != nil {
+		emulator.Close()
+		return nil, err
+	}
+
+	err = ctr.Connect()
+	if err != nil {
+		ctr.Close()
+		emulator.Close()
+		return nil, err
+	}
+
+	session := &joyConSession{left: left, right: right, emulator: emulator, ctr: ctr}
+	switch {
+	case left != nil && right != nil:
+		session.Name = left.Name + " + " + right.Name
+		session.session = NewSession(session.Name, "Joy-Con pair", left.Transport, left.Path+" + "+right.Path)
+	case left != nil:
+		session.Name = left.Name
+		session.session = NewSession(session.Name, "Joy-Con", left.Transport, left.Path)
+		session.session.SetIdentity(left.Identity())
+	default:
+		session.Name = right.Name
+		session.session = NewSession(session.Name, "Joy-Con", right.Transport, right.Path)
+		session.session.SetIdentity(right.Identity())
+	}
+	session.session.SetDevice(session)
+
+	// The layout, remapping and trigger emulation come from the profile of
+	// the left Joy-Con of a pair.
+	profile := left
+	if profile == nil {
+		profile = right
+	}
+	session.pipeline = profile.Profile.NewPipeline(session.Name, ctr, session)
+	session.pipeline.Layout.NintendoLabels = session.session.Info().NintendoLabels()
+	session.pipeline.OnLayout = session.layoutChanged
+	session.session.SetPipeline(session.pipeline)
+
+	return session, nil
+}
+
+func (session *joyConSession) Close() {
+	session.session.Close()
+	session.pipeline.Close()
+	session.ctr.Disconnect()
+	session.ctr.Close()
+	session.emulator.Close()
+}
+
+func (session *joyConSession) Send() error {
+	report := Xbox360ControllerReport{}
+
+	switch {
+	case session.left != nil && session.right != nil:
+		left, right := session.left, session.right
+		report.SetButtonsFromSwitch(right.Buttons, left.ButtonsM|right.ButtonsM, left.Buttons)
+		report.SetLeftThumb(StickToInt16(left.StickX), StickToInt16(left.StickY))
+		report.SetRightThumb(StickToInt16(right.StickX), StickToInt16(right.StickY))
+	default:
+		jc := session.left
+		if jc == nil {
+			jc = session.right
+		}
+		report.SetButtonsFromSidewaysJoyCon(jc)
+	}
+
+	var extra uint32
+	if session.left != nil && session.right != nil {
+		extra = joyConPairExtra(session.left, session.right)
+	}
+	return session.pipeline.SendInput(&report, extra)
+}
+
+// joyConPairExtra returns the extra inputs of a pair, in the order of
+// JoyConInputs.
+func joyConPairExtra(left, right *JoyCon) uint32 {
+	var extra uint32
+	for i, pressed := range []bool{
+		left.ButtonsM&(1<<SwitchProControllerButtonCapture) != 0,
+		left.pressed(JoyConButtonSL),
+		left.pressed(JoyConButtonSR),
+		right.pressed(JoyConButtonSL),
+		right.pressed(JoyConButtonSR),
+	} {
+		if pressed {
+			extra |= 1 << uint(i)
+		}
+	}
+	return extra
+}
+
+func (session *joyConSession) Inputs() *OutputTarget {
+	return JoyConInputs
+}
+
+// layoutChanged saves a layout switched at runtime in the profiles of both
+// Joy-Cons.
+func (session *joyConSession) layoutChanged(policy LayoutPolicy) {
+	for _, jc := range []*JoyCon{session.left, session.right} {
+		if jc == nil {
+			continue
+		}
+		err := jc.Profile.SaveLayout(policy)
+		if err != nil {
+			NotifyError(jc.Name, "unable to save profile: "+err.Error())
+		}
+	}
+	NotifyInfo(session.Name, "Button layout: "+policy.Layout.String())
+	go layoutCue(session, policy.Layout)
+}
+
+// SetButtonsFromSidewaysJoyCon maps a single Joy-Con held horizontally with
+// the rail on top. The face buttons and the stick are rotated so that the
+// button closest to the player becomes A.
+func (report *Xbox360ControllerReport) SetButtonsFromSidewaysJoyCon(jc *JoyCon) {
+	if jc.Left {
+		report.MaybeSetButton(Xbox360ControllerButtonA, jc.pressed(SwitchProControllerButtonLeft))
+		report.MaybeSetButton(Xbox360ControllerButtonB, jc.pressed(SwitchProControllerButtonDown))
+		report.MaybeSetButton(Xbox360ControllerButtonX, jc.pressed(SwitchProControllerButtonUp))
+		report.MaybeSetButton(Xbox360ControllerButtonY, jc.pressed(SwitchProControllerButtonRight))
+		report.MaybeSetButton(Xbox360ControllerButtonStart, jc.ButtonsM&(1<<SwitchProControllerButtonMinus) != 0)
+		report.MaybeSetButton(Xbox360ControllerButtonLeftThumb, jc.ButtonsM&(1<<SwitchProControllerButtonLeftThumb) != 0)
+		report.MaybeSetButton(Xbox360ControllerButtonGuide, jc.ButtonsM&(1<<SwitchProControllerButtonCapture) != 0)
+		report.SetLeftThumb(StickToInt16(-jc.StickY), StickToInt16(jc.StickX))
+	} else {
+		report.MaybeSetButton(Xbox360ControllerButtonA, jc.pressed(SwitchProControllerButtonA))
+		report.MaybeSetButton(Xbox360ControllerButtonB, jc.pressed(SwitchProControllerButtonX))
+		report.MaybeSetButton(Xbox360ControllerButtonX, jc.pressed(SwitchProControllerButtonB))
+		report.MaybeSetButton(Xbox360ControllerButtonY, jc.pressed(SwitchProControllerButtonY))
+		report.MaybeSetButton(Xbox360ControllerButtonStart, jc.ButtonsM&(1<<SwitchProControllerButtonPlus) != 0)
+		report.MaybeSetButton(Xbox360ControllerButtonLeftThumb, jc.ButtonsM&(1<<SwitchProControllerButtonRightThumb) != 0)
+		report.MaybeSetButton(Xbox360ControllerButtonGuide, jc.ButtonsM&(1<<SwitchProControllerButtonHome) != 0)
+		report.SetLeftThumb(StickToInt16(jc.StickY), StickToInt16(-jc.StickX))
+	}
+
+	// L/R and ZL/ZR share bits 6 and 7 on both sides.
+	report.MaybeSetButton(Xbox360ControllerButtonLeftShoulder, jc.pressed(JoyConButtonSL))
+	report.MaybeSetButton(Xbox360ControllerButtonRightShoulder, jc.pressed(JoyConButtonSR))
+	report.MaybeSetButton(Xbox360ControllerButtonBack, jc.pressed(SwitchProControllerButtonLeftShoulder))
+	if jc.pressed(SwitchProControllerButtonLeftTrigger) {
+		report.SetRightTrigger(255)
+	}
+}
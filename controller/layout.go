@@ -0,0 +1,153 @@
+package controller
+
+import (
+	"strings"
+	"time"
+)
+
+// FaceLayout decides how face buttons of controllers with Nintendo labels
+// map to the Xbox face buttons.
+type FaceLayout string
+
+const (
+	// LayoutPositional keeps the position, the bottom button is A.
+	LayoutPositional FaceLayout = ""
+	// LayoutLabel follows the labels, the button labeled A is A.
+	LayoutLabel FaceLayout = "label"
+	// LayoutCustom uses the Custom map of the policy.
+	LayoutCustom FaceLayout = "custom"
+)
+
+const (
+	layoutChordHold = 2 * time.Second
+	layoutCueTime   = time.Second
+)
+
+var faceButtons = map[string]int{
+	"A": Xbox360ControllerButtonA,
+	"B": Xbox360ControllerButtonB,
+	"X": Xbox360ControllerButtonX,
+	"Y": Xbox360ControllerButtonY,
+}
+
+// LayoutPolicy is the layout part of a profile. Custom maps the Xbox
+// button at a position to the Xbox button it sends, e.g. {"A": "B"}.
+type LayoutPolicy struct {
+	Layout FaceLayout        `json:"layout,omitempty"`
+	Custom map[string]string `json:"custom,omitempty"`
+}
+
+// Next is the layout after the current one when cycling with the chord.
+// Custom is skipped when the policy has no custom map.
+func (policy LayoutPolicy) Next() FaceLayout {
+	switch policy.Layout {
+	case LayoutPositional:
+		return LayoutLabel
+	case LayoutLabel:
+		if len(policy.Custom) > 0 {
+			return LayoutCustom
+		}
+	}
+	return LayoutPositional
+}
+
+func (layout FaceLayout) String() string {
+	if layout == LayoutPositional {
+		return "positional"
+	}
+	return string(layout)
+}
+
+// ApplyLayout remaps the face buttons of a report built by position. With
+// the label layout only sources with Nintendo labels change, the labels of
+// other controllers already match their position.
+func (report *Xbox360ControllerReport) ApplyLayout(policy LayoutPolicy, nintendoLabels bool) {
+	mapping := map[string]string{}
+	switch policy.Layout {
+	case LayoutLabel:
+		if !nintendoLabels {
+			return
+		}
+		mapping = map[string]string{"A": "B", "B": "A", "X": "Y", "Y": "X"}
+	case LayoutCustom:
+		mapping = policy.Custom
+	default:
+		return
+	}
+
+	buttons := report.GetButtons()
+	remapped := buttons
+	for from := range mapping {
+		fromBit, ok := faceButtons[from]
+		if !ok {
+			continue
+		}
+		remapped &^= 1 << uint(fromBit)
+	}
+	for from, to := range mapping {
+		fromBit, okFrom := faceButtons[from]
+		toBit, okTo := faceButtons[to]
+		if okFrom && okTo && buttons&(1<<uint(fromBit)) != 0 {
+			remapped |= 1 << uint(toBit)
+		}
+	}
+	report.SetButtons(remapped)
+}
+
+// LayoutSwitcher applies the layout of a source and cycles it when Back and
+// Start are held together.
+type LayoutSwitcher struct {
+	Policy         LayoutPolicy
+	NintendoLabels bool
+
+	chordSince time.Time
+	fired      bool
+}
+
+// Update applies the layout to the report and reports whether the chord
+// just switched to the next layout.
+func (switcher *LayoutSwitcher) Update(report *Xbox360ControllerReport, now time.Time) bool {
+	switched := false
+	chord := uint16(1<<Xbox360ControllerButtonBack | 1<<Xbox360ControllerButtonStart)
+	if report.GetButtons()&chord != chord {
+		switcher.chordSince = time.Time{}
+		switcher.fired = false
+	} else if switcher.chordSince.IsZero() {
+		switcher.chordSince = now
+	} else if !switcher.fired && now.Sub(switcher.chordSince) >= layoutChordHold {
+		switcher.Policy.Layout = switcher.Policy.Next()
+		switcher.fired = true
+		switched = true
+	}
+
+	report.ApplyLayout(switcher.Policy, switcher.NintendoLabels)
+	return switched
+}
+
+// layoutCue flashes one player LED per step of the new layout, then goes
+// back to the first LED.
+func layoutCue(pad PlayerLEDControl, layout FaceLayout) {
+	var flash byte = 0x1
+	switch layout {
+	case LayoutLabel:
+		flash = 0x3
+	case LayoutCustom:
+		flash = 0x7
+	}
+
+	pad.SetPlayerLEDs(0, flash)
+	time.Sleep(layoutCueTime)
+	pad.SetPlayerLEDs(0x1, 0)
+}
+
+// webLabelOrdered reports whether a browser numbers the face buttons of a
+// gamepad by label instead of position, as Safari does for the Pro
+// Controller.
+func webLabelOrdered(id string) bool {
+	return strings.Contains(id, "Pro Controller") && strings.HasSuffix(id, "Extended Gamepad")
+}
+
+// webNintendoLabels reports whether a browser gamepad has Nintendo labels.
+func webNintendoLabels(id string) bool {
+	return strings.Contains(id, "Pro Controller") || strings.Contains(id, "Vendor: 057e")
+}
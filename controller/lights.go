@@ -0,0 +1,140 @@
+package controller
+
+import (
+	"errors"
+)
+
+var (
+	ErrUnsupportedLight = errors.New("controller has no such light")
+	ErrBadLightPattern  = errors.New("light pattern out of range")
+)
+
+// Optional light controls of a session device, found by type assertion.
+type PlayerLEDControl interface {
+	// SetPlayerLEDs turns on the LEDs in solid and flashes those in flash,
+	// bit 0 being the first LED.
+	SetPlayerLEDs(solid, flash byte) error
+}
+
+type HomeLightControl interface {
+	SetHomeLight(pattern *HomeLightPattern) error
+}
+
+type LightbarControl interface {
+	SetLightbar(r, g, b byte) error
+}
+
+// HomeLightCycle is one step of a home light pattern. All values are 4-bit,
+// fade and duration are multiples of the base duration of the pattern.
+type HomeLightCycle struct {
+	Intensity byte `json:"intensity"`
+	Fade      byte `json:"fade"`
+	Duration  byte `json:"duration"`
+}
+
+// HomeLightPattern programs the home button LED of Switch controllers with
+// up to 15 mini cycles. The base duration is in 8ms steps and Repeat is the
+// number of full cycles, 0 repeating forever.
+type HomeLightPattern struct {
+	BaseDuration   byte             `json:"baseDuration"`
+	StartIntensity byte             `json:"startIntensity"`
+	Repeat         byte             `json:"repeat"`
+	Cycles         []HomeLightCycle `json:"cycles"`
+}
+
+// Encode builds the argument of subcommand 0x38. Mini cycles are packed in
+// pairs sharing their intensity byte.
+func (pattern *HomeLightPattern) Encode() ([]byte, error) {
+	if len(pattern.Cycles) > 15 || pattern.BaseDuration > 0xF || pattern.StartIntensity > 0xF || pattern.Repeat > 0xF {
+		return nil, ErrBadLightPattern
+	}
+	for _, cycle := range pattern.Cycles {
+		if cycle.Intensity > 0xF || cycle.Fade > 0xF || cycle.Duration > 0xF {
+			return nil, ErrBadLightPattern
+		}
+	}
+
+	data := []byte{
+		byte(len(pattern.Cycles))<<4 | pattern.BaseDuration,
+		pattern.StartIntensity<<4 | pattern.Repeat,
+	}
+	for i := 0; i < len(pattern.Cycles); i += 2 {
+		first, second := pattern.Cycles[i], HomeLightCycle{}
+		if i+1 < len(pattern.Cycles) {
+			second = pattern.Cycles[i+1]
+		}
+		data = append(data,
+			first.Intensity<<4|second.Intensity,
+			first.Fade<<4|first.Duration,
+			second.Fade<<4|second.Duration,
+		)
+	}
+
+	return data, nil
+}
+
+func (Controller *SwitchProController) SetPlayerLEDs(solid, flash byte) error {
+	if solid > 0xF || flash > 0xF {
+		return ErrBadLightPattern
+	}
+
+	_, err := Controller.Subcommand(0x30, []byte{flash<<4 | solid})
+	return err
+}
+
+func (Controller *SwitchProController) SetHomeLight(pattern *HomeLightPattern) error {
+	if Controller.DeviceType == SwitchDeviceJoyConLeft {
+		return ErrUnsupportedLight
+	}
+
+	data, err := pattern.Encode()
+	if err != nil {
+		return err
+	}
+	_, err = Controller.Subcommand(0x38, data)
+	return err
+}
+
+func (session *joyConSession) SetPlayerLEDs(solid, flash byte) error {
+	for _, jc := range []*JoyCon{session.left, session.right} {
+		if jc == nil {
+			continue
+		}
+		err := jc.SetPlayerLEDs(solid, flash)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetHomeLight programs the home button of the right Joy-Con, the left one
+// has none.
+func (session *joyConSession) SetHomeLight(pattern *HomeLightPattern) error {
+	if session.right == nil {
+		return ErrUnsupportedLight
+	}
+	return session.right.SetHomeLight(pattern)
+}
+
+func (ds4 *DualShock4) SetLightbar(r, g, b byte) error {
+	return SetLightbar(ds4, r, g, b)
+}
+
+func (ds *DualSense) SetLightbar(r, g, b byte) error {
+	return SetLightbar(ds, r, g, b)
+}
+
+// SetPlayerLEDs sets the five player LEDs of the DualSense, which cannot
+// flash.
+func (ds *DualSense) SetPlayerLEDs(solid, flash byte) error {
+	if solid > 0x1F || flash != 0 {
+		return ErrBadLightPattern
+	}
+
+	ds.outputMutex.Lock()
+	ds.PlayerLEDs = solid
+	ds.outputMutex.Unlock()
+
+	return ds.WriteOutput()
+}
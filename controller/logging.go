@@ -0,0 +1,175 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// LevelTrace is below debug and logs every decoded frame.
+const LevelTrace = slog.LevelDebug - 4
+
+const (
+	DefaultLogSize    = 10 << 20
+	DefaultLogBackups = 3
+)
+
+// LogLevel is the level of the log, set by SetupLogging.
+var LogLevel = new(slog.LevelVar)
+
+func ParseLogLevel(name string) (slog.Level, error) {
+	if strings.EqualFold(name, "trace") {
+		return LevelTrace, nil
+	}
+	if name == "" {
+		return slog.LevelInfo, nil
+	}
+
+	var level slog.Level
+	err := level.UnmarshalText([]byte(name))
+	return level, err
+}
+
+// RotatingFile is a log file that is renamed to path.1 when it grows past
+// MaxSize, keeping Backups old files.
+type RotatingFile struct {
+	Path    string
+	MaxSize int64
+	Backups int
+
+	mutex sync.Mutex
+	file  *os.File
+	size  int64
+}
+
+func OpenRotatingFile(path string, maxSize int64, backups int) (*RotatingFile, error) {
+	rotating := &RotatingFile{Path: path, MaxSize: maxSize, Backups: backups}
+	return rotating, rotating.open()
+}
+
+func (rotating *RotatingFile) open() error {
+	file, err := os.OpenFile(rotating.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	rotating.file = file
+	rotating.size = stat.Size()
+	return nil
+}
+
+func (rotating *RotatingFile) rotate() error {
+	rotating.file.Close()
+	rotating.file = nil
+
+	for i := rotating.Backups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", rotating.Path, i), fmt.Sprintf("%s.%d", rotating.Path, i+1))
+	}
+	if rotating.Backups > 0 {
+		os.Rename(rotating.Path, rotating.Path+".1")
+	} else {
+		os.Remove(rotating.Path)
+	}
+	return rotating.open()
+}
+
+func (rotating *RotatingFile) Write(data []byte) (int, error) {
+	rotating.mutex.Lock()
+	defer rotating.mutex.Unlock()
+
+	if rotating.file != nil && rotating.size > 0 && rotating.size+int64(len(data)) > rotating.MaxSize {
+		rotating.rotate()
+	}
+	if rotating.file == nil {
+		// Reopening failed at the last rotation, try again.
+		if err := rotating.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := rotating.file.Write(data)
+	rotating.size += int64(n)
+	return n, err
+}
+
+func (rotating *RotatingFile) Close() error {
+	rotating.mutex.Lock()
+	defer rotating.mutex.Unlock()
+
+	if rotating.file == nil {
+		return nil
+	}
+	err := rotating.file.Close()
+	rotating.file = nil
+	return err
+}
+
+// teeWriter writes to every writer, also when one of them fails, since
+// stderr is invalid in a program without a console.
+type teeWriter []io.Writer
+
+func (writers teeWriter) Write(data []byte) (int, error) {
+	for _, w := range writers {
+		w.Write(data)
+	}
+	return len(data), nil
+}
+
+func replaceLevel(groups []string, attr slog.Attr) slog.Attr {
+	if attr.Key == slog.LevelKey && len(groups) == 0 {
+		if level, ok := attr.Value.Any().(slog.Level); ok && level <= LevelTrace {
+			attr.Value = slog.StringValue("TRACE")
+		}
+	}
+	return attr
+}
+
+// SetupLogging makes the default slog logger write to stderr and to
+// gamepadserver.log in the logs directory of the data directory, at the
+// level of the GAMEPADSERVER_LOG_LEVEL environment variable. The returned
+// function closes the log file.
+func SetupLogging() (func(), error) {
+	level, levelErr := ParseLogLevel(os.Getenv("GAMEPADSERVER_LOG_LEVEL"))
+	LogLevel.Set(level)
+
+	writer := teeWriter{os.Stderr}
+	closeLog := func() {}
+	path, err := DataPath("logs", "gamepadserver.log")
+	if err == nil {
+		var file *RotatingFile
+		file, err = OpenRotatingFile(path, DefaultLogSize, DefaultLogBackups)
+		if err == nil {
+			writer = append(writer, file)
+			closeLog = func() { file.Close() }
+		}
+	}
+
+	handler := slog.NewTextHandler(writer, &slog.HandlerOptions{Level: LogLevel, ReplaceAttr: replaceLevel})
+	slog.SetDefault(slog.New(handler))
+
+	if levelErr != nil {
+		slog.Warn("bad GAMEPADSERVER_LOG_LEVEL", "err", levelErr)
+	}
+	return closeLog, err
+}
+
+// traceReport logs a decoded report at the trace level.
+func traceReport(log *slog.Logger, msg string, report *Xbox360ControllerReport) {
+	if !log.Enabled(context.Background(), LevelTrace) {
+		return
+	}
+	lx, ly := report.GetLeftThumb()
+	rx, ry := report.GetRightThumb()
+	log.Log(context.Background(), LevelTrace, msg,
+		"buttons", fmt.Sprintf("%04x", report.GetButtons()),
+		"lt", report.GetLeftTrigger(), "rt", report.GetRightTrigger(),
+		"lx", lx, "ly", ly, "rx", rx, "ry", ry)
+}
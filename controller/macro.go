@@ -0,0 +1,281 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrNoMacro = errors.New("no such macro")
+
+// Macro policies decide how playback meets live input.
+type MacroPolicy string
+
+const (
+	// MacroMix presses the buttons of both and keeps the larger deflection
+	// of each axis.
+	MacroMix MacroPolicy = ""
+	// MacroOverride ignores live input until the macro ends.
+	MacroOverride MacroPolicy = "override"
+)
+
+// Macro is a timed sequence of inputs, stored as <name>.json in the macros
+// directory of the data directory:
+//
+//	{
+//	  "name": "hadouken",
+//	  "policy": "override",
+//	  "length": 250,
+//	  "frames": [
+//	    {"at": 0, "buttons": ["Down"]},
+//	    {"at": 50, "buttons": ["Down", "Right"]},
+//	    {"at": 100, "buttons": ["Right"]},
+//	    {"at": 150, "buttons": ["X"], "axes": {"RightTrigger": 1}}
+//	  ]
+//	}
+//
+// Times are milliseconds from the start. Each frame holds from its time
+// until the next one, and the last one until length. Button and axis
+// names are those of the Xbox 360 target, axes missing from a frame are
+// at rest.
+type Macro struct {
+	Name   string       `json:"name"`
+	Policy MacroPolicy  `json:"policy,omitempty"`
+	Length int          `json:"length"`
+	Frames []MacroFrame `json:"frames"`
+}
+
+type MacroFrame struct {
+	At      int                `json:"at"`
+	Buttons []string           `json:"buttons,omitempty"`
+	Axes    map[string]float32 `json:"axes,omitempty"`
+}
+
+// Validate checks the names of a macro against the target and sorts its
+// frames.
+func (macro *Macro) Validate(target *OutputTarget) error {
+	if macro.Name == "" || SafeFileName(macro.Name) != macro.Name {
+		return errors.New("macro name must only use letters, digits, - and _")
+	}
+	if macro.Policy != MacroMix && macro.Policy != MacroOverride {
+		return errors.New("unknown macro policy " + string(macro.Policy))
+	}
+
+	for _, frame := range macro.Frames {
+		for _, name := range frame.Buttons {
+			control, err := target.control(name)
+			if err != nil {
+				return err
+			}
+			if control.Axis {
+				return errors.New("macro button " + name + " is an axis")
+			}
+		}
+		for name := range frame.Axes {
+			control, err := target.control(name)
+			if err != nil {
+				return err
+			}
+			if !control.Axis {
+				return errors.New("macro axis " + name + " is a button")
+			}
+		}
+	}
+
+	sort.SliceStable(macro.Frames, func(i, j int) bool { return macro.Frames[i].At < macro.Frames[j].At })
+	return nil
+}
+
+func (macro *Macro) duration() time.Duration {
+	length := macro.Length
+	if n := len(macro.Frames); n > 0 && macro.Frames[n-1].At > length {
+		length = macro.Frames[n-1].At
+	}
+	return time.Duration(length) * time.Millisecond
+}
+
+// StateAt returns the state of the macro after elapsed, and false once the
+// macro is over.
+func (macro *Macro) StateAt(elapsed time.Duration, target *OutputTarget) (ControlState, bool) {
+	state := ControlState{}
+	if elapsed >= macro.duration() {
+		return state, false
+	}
+
+	ms := int(elapsed / time.Millisecond)
+	i := sort.Search(len(macro.Frames), func(i int) bool { return macro.Frames[i].At > ms }) - 1
+	if i < 0 {
+		return state, true
+	}
+
+	frame := macro.Frames[i]
+	for _, name := range frame.Buttons {
+		state.Press(target.Controls[name].Index)
+	}
+	for name, value := range frame.Axes {
+		state.Axes[target.Controls[name].Index] = value
+	}
+	return state, true
+}
+
+// FrameFromState names the pressed buttons and moved axes of a state.
+func FrameFromState(state ControlState, at time.Duration, target *OutputTarget) MacroFrame {
+	frame := MacroFrame{At: int(at / time.Millisecond)}
+	for name, control := range target.Controls {
+		if control.Axis {
+			if value := state.Axes[control.Index]; value != 0 {
+				if frame.Axes == nil {
+					frame.Axes = map[string]float32{}
+				}
+				frame.Axes[name] = value
+			}
+		} else if state.Pressed(control.Index) {
+			frame.Buttons = append(frame.Buttons, name)
+		}
+	}
+	sort.Strings(frame.Buttons)
+	return frame
+}
+
+// MixStates combines a macro state into live input by the policy.
+func MixStates(live, macro ControlState, policy MacroPolicy) ControlState {
+	if policy == MacroOverride {
+		return macro
+	}
+
+	live.Buttons |= macro.Buttons
+	for axis, value := range macro.Axes {
+		mergeAxis(&live, axis, value)
+	}
+	return live
+}
+
+// Macros are cached after their first use, the admin API keeps the cache
+// up to date. macroMutex only guards the cache, the files are written
+// under macroFileMutex, so playing a cached macro never waits for the
+// disk.
+var (
+	macroMutex     sync.Mutex
+	macroCache     = make(map[string]*Macro)
+	macroFileMutex sync.Mutex
+)
+
+func macroPath(name string) (string, error) {
+	return DataPath("macros", SafeFileName(name)+".json")
+}
+
+// CachedMacro returns a macro loaded or saved before, or nil.
+func CachedMacro(name string) *Macro {
+	macroMutex.Lock()
+	defer macroMutex.Unlock()
+
+	return macroCache[name]
+}
+
+func LoadMacro(name string) (*Macro, error) {
+	if macro := CachedMacro(name); macro != nil {
+		return macro, nil
+	}
+
+	macroFileMutex.Lock()
+	defer macroFileMutex.Unlock()
+
+	path, err := macroPath(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNoMacro
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	macro := &Macro{}
+	err = json.Unmarshal(data, macro)
+	if err != nil {
+		return nil, err
+	}
+	err = macro.Validate(Xbox360Target)
+	if err != nil {
+		return nil, err
+	}
+
+	macroMutex.Lock()
+	defer macroMutex.Unlock()
+	macroCache[name] = macro
+	return macro, nil
+}
+
+func SaveMacro(macro *Macro) error {
+	err := macro.Validate(Xbox360Target)
+	if err != nil {
+		return err
+	}
+
+	path, err := macroPath(macro.Name)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(macro, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	macroFileMutex.Lock()
+	defer macroFileMutex.Unlock()
+
+	err = os.WriteFile(path, data, 0644)
+	if err != nil {
+		return err
+	}
+	macroMutex.Lock()
+	defer macroMutex.Unlock()
+	macroCache[macro.Name] = macro
+	return nil
+}
+
+func DeleteMacro(name string) error {
+	path, err := macroPath(name)
+	if err != nil {
+		return err
+	}
+
+	macroFileMutex.Lock()
+	defer macroFileMutex.Unlock()
+
+	macroMutex.Lock()
+	delete(macroCache, name)
+	macroMutex.Unlock()
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return ErrNoMacro
+	}
+	return err
+}
+
+// MacroNames lists the stored macros.
+func MacroNames() ([]string, error) {
+	path, err := macroPath("x")
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".json") {
+			names = append(names, strings.TrimSuffix(entry.Name(), ".json"))
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,222 @@
+package controller
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Metrics are kept in atomic values found through sync.Map, so recording
+// one from the input path never waits on a lock, and written in the
+// Prometheus text format by /metrics.
+
+type metricValue struct {
+	// First for the alignment of 64-bit atomics on 32-bit platforms.
+	value  uint64
+	labels []string
+}
+
+type histogramValue struct {
+	count   uint64
+	sumBits uint64
+	buckets []uint64
+	labels  []string
+}
+
+type metric struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+	bounds []float64
+	values sync.Map
+}
+
+var metricsRegistry []*metric
+
+func newMetric(kind, name, help string, bounds []float64, labels ...string) *metric {
+	m := &metric{name: name, help: help, kind: kind, labels: labels, bounds: bounds}
+	metricsRegistry = append(metricsRegistry, m)
+	return m
+}
+
+var (
+	metricFramesReceived = newMetric("counter", "gamepadserver_frames_received_total",
+		"Input frames handed to session pipelines.", nil, "source")
+	metricFramesSent = newMetric("counter", "gamepadserver_frames_sent_total",
+		"Reports sent to virtual pads.", nil, "source", "backend")
+	metricDecodeErrors = newMetric("counter", "gamepadserver_decode_errors_total",
+		"Input frames that could not be decoded.", nil, "source")
+	metricVigemErrors = newMetric("counter", "gamepadserver_vigem_errors_total",
+		"Errors returned by the ViGEm client.", nil, "code", "error")
+	metricHIDReconnects = newMetric("counter", "gamepadserver_hid_reconnects_total",
+		"HID devices started again after their handler stopped.", nil)
+
+	metricWebLatency = newMetric("histogram", "gamepadserver_web_latency_seconds",
+		"One way latency of web input frames.", secondBuckets(), "source")
+	metricWebRoundTrip = newMetric("histogram", "gamepadserver_web_round_trip_seconds",
+		"Round trip time of web client pings.", secondBuckets(), "source")
+	metricHIDToSend = newMetric("histogram", "gamepadserver_hid_to_send_seconds",
+		"Time from reading a HID report to handing it to the pipeline.", secondBuckets(), "source")
+)
+
+func secondBuckets() []float64 {
+	bounds := make([]float64, len(LatencyBuckets))
+	for i, ms := range LatencyBuckets {
+		bounds[i] = ms / 1000
+	}
+	return bounds
+}
+
+func (m *metric) value(labels []string) interface{} {
+	key := strings.Join(labels, "\xff")
+	if v, ok := m.values.Load(key); ok {
+		return v
+	}
+
+	var v interface{}
+	if m.kind == "histogram" {
+		v = &histogramValue{buckets: make([]uint64, len(m.bounds)), labels: labels}
+	} else {
+		v = &metricValue{labels: labels}
+	}
+	v, _ = m.values.LoadOrStore(key, v)
+	return v
+}
+
+func (m *metric) Inc(labels ...string) {
+	atomic.AddUint64(m.Counter(labels...), 1)
+}
+
+// Counter returns the value of a counter for the labels, to be increased
+// with atomic.AddUint64 without looking it up every time.
+func (m *metric) Counter(labels ...string) *uint64 {
+	return &m.value(labels).(*metricValue).value
+}
+
+func (m *metric) Observe(value float64, labels ...string) {
+	h := m.value(labels).(*histogramValue)
+	for i, bound := range m.bounds {
+		if value <= bound {
+			atomic.AddUint64(&h.buckets[i], 1)
+			break
+		}
+	}
+	for {
+		old := atomic.LoadUint64(&h.sumBits)
+		sum := math.Float64bits(math.Float64frombits(old) + value)
+		if atomic.CompareAndSwapUint64(&h.sumBits, old, sum) {
+			break
+		}
+	}
+	atomic.AddUint64(&h.count, 1)
+}
+
+// countDecodeError counts an input frame of a source that failed to decode.
+func countDecodeError(source string) {
+	metricDecodeErrors.Inc(source)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string, extra ...string) string {
+	var pairs []string
+	for i, name := range names {
+		pairs = append(pairs, name+`="`+labelEscaper.Replace(values[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+labelEscaper.Replace(extra[i+1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func (m *metric) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+
+	// Each label set is one block, sorted by labels. The buckets of a
+	// histogram keep their order inside their block.
+	var blocks [][]string
+	m.values.Range(func(_, v interface{}) bool {
+		var lines []string
+		switch v := v.(type) {
+		case *metricValue:
+			lines = append(lines, fmt.Sprintf("%s%s %d", m.name, formatLabels(m.labels, v.labels), atomic.LoadUint64(&v.value)))
+		case *histogramValue:
+			var cumulative uint64
+			for i, bound := range m.bounds {
+				cumulative += atomic.LoadUint64(&v.buckets[i])
+				lines = append(lines, fmt.Sprintf("%s_bucket%s %d", m.name, formatLabels(m.labels, v.labels, "le", formatFloat(bound)), cumulative))
+			}
+			count := atomic.LoadUint64(&v.count)
+			lines = append(lines,
+				fmt.Sprintf("%s_bucket%s %d", m.name, formatLabels(m.labels, v.labels, "le", "+Inf"), count),
+				fmt.Sprintf("%s_sum%s %s", m.name, formatLabels(m.labels, v.labels), formatFloat(math.Float64frombits(atomic.LoadUint64(&v.sumBits)))),
+				fmt.Sprintf("%s_count%s %d", m.name, formatLabels(m.labels, v.labels), count))
+		}
+		blocks = append(blocks, lines)
+		return true
+	})
+	if len(blocks) == 0 && len(m.labels) == 0 && m.kind == "counter" {
+		blocks = append(blocks, []string{m.name + " 0"})
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i][0] < blocks[j][0] })
+	for _, lines := range blocks {
+		for _, line := range lines {
+			fmt.Fprintln(w, line)
+		}
+	}
+}
+
+// writeSessionGauge writes the number of sessions by source and transport.
+// It only reads the fields sessions never change.
+func writeSessionGauge(w io.Writer) {
+	counts := make(map[[2]string]int)
+	sessionsMutex.Lock()
+	for _, session := range sessions {
+		counts[[2]string{session.Kind, string(session.Transport)}]++
+	}
+	sessionsMutex.Unlock()
+
+	name := "gamepadserver_sessions"
+	fmt.Fprintf(w, "# HELP %s Active sessions.\n# TYPE %s gauge\n", name, name)
+	var lines []string
+	for key, count := range counts {
+		labels := formatLabels([]string{"source", "transport", "backend"}, []string{key[0], key[1], outputBackend})
+		lines = append(lines, fmt.Sprintf("%s%s %d", name, labels, count))
+	}
+	sort.Strings(lines)
+	for _, line := range lines {
+		fmt.Fprintln(w, line)
+	}
+}
+
+// WriteMetrics writes every metric in the Prometheus text format.
+func WriteMetrics(w io.Writer) {
+	writeSessionGauge(w)
+	for _, m := range metricsRegistry {
+		m.write(w)
+	}
+}
+
+func metricsEndpoint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	WriteMetrics(w)
+}
@@ -0,0 +1,63 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// LogNotifier writes notifications to the log, which goes to stderr and
+// the log file.
+type LogNotifier struct{}
+
+func (LogNotifier) Notify(event Event) error {
+	level := slog.LevelInfo
+	switch event.Severity {
+	case SeverityWarning:
+		level = slog.LevelWarn
+	case SeverityError:
+		level = slog.LevelError
+	}
+
+	attrs := []interface{}{"title", event.Title}
+	if event.Count > 1 {
+		attrs = append(attrs, "count", event.Count)
+	}
+	slog.Log(context.Background(), level, event.Message, attrs...)
+	return nil
+}
+
+// WebhookNotifier posts notifications as JSON events to a URL, for a local
+// service to forward them.
+type WebhookNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+func NewWebhookNotifier(url string) *WebhookNotifier {
+	return &WebhookNotifier{URL: url, Client: &http.Client{Timeout: 5 * time.Second}}
+}
+
+func (notifier *WebhookNotifier) Notify(event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	response, err := notifier.Client.Post(notifier.URL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, response.Body)
+
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", response.Status)
+	}
+	return nil
+}
@@ -0,0 +1,377 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Severity orders notifications, so the ones below a minimum can be muted.
+type Severity int
+
+const (
+	SeverityInfo Severity = iota
+	SeverityWarning
+	SeverityError
+)
+
+func (severity Severity) String() string {
+	switch severity {
+	case SeverityInfo:
+		return "info"
+	case SeverityWarning:
+		return "warning"
+	case SeverityError:
+		return "error"
+	}
+	return fmt.Sprintf("severity(%d)", int(severity))
+}
+
+func ParseSeverity(name string) (Severity, error) {
+	switch strings.ToLower(name) {
+	case "info", "":
+		return SeverityInfo, nil
+	case "warning", "warn":
+		return SeverityWarning, nil
+	case "error":
+		return SeverityError, nil
+	}
+	return SeverityInfo, fmt.Errorf("unknown severity %q", name)
+}
+
+func (severity Severity) MarshalJSON() ([]byte, error) {
+	return json.Marshal(severity.String())
+}
+
+// Event is one notification.
+type Event struct {
+	Severity Severity  `json:"severity"`
+	Title    string    `json:"title"`
+	Message  string    `json:"message"`
+	Time     time.Time `json:"time"`
+	// Key groups the events throttled together, the title and message
+	// when empty.
+	Key string `json:"key,omitempty"`
+	// Summary formats the count of events aggregated under the key, as in
+	// "%d controllers disconnected".
+	Summary string `json:"-"`
+	// Count is the number of events an aggregated event stands for.
+	Count int `json:"count,omitempty"`
+}
+
+// Notifier shows or forwards notifications.
+type Notifier interface {
+	Notify(event Event) error
+}
+
+const (
+	DefaultNotificationInterval = 10 * time.Second
+	notificationQueue           = 64
+)
+
+// Notifications throttles events per key in front of its notifiers. The
+// first event of a key goes through, the ones that follow within Interval
+// are held and sent as one event when it ends. Events are sent from their
+// own goroutine, so notifying never waits on a notifier.
+type Notifications struct {
+	Notifiers   []Notifier
+	MinSeverity Severity
+	Interval    time.Duration
+
+	mutex   sync.Mutex
+	keys    map[string]*throttledKey
+	queue   chan Event
+	pending sync.WaitGroup
+}
+
+type throttledKey struct {
+	until time.Time
+	held  []Event
+	timer *time.Timer
+}
+
+func NewNotifications(notifiers []Notifier, minSeverity Severity, interval time.Duration) *Notifications {
+	notifications := &Notifications{
+		Notifiers:   notifiers,
+		MinSeverity: minSeverity,
+		Interval:    interval,
+		keys:        make(map[string]*throttledKey),
+		queue:       make(chan Event, notificationQueue),
+	}
+	go notifications.run()
+	return notifications
+}
+
+func (notifications *Notifications) run() {
+	for event := range notifications.queue {
+		for _, notifier := range notifications.Notifiers {
+			err := notifier.Notify(event)
+			if err != nil {
+				// Not through Notify, a broken notifier would feed itself.
+				slog.Warn("notification not sent", "title", event.Title, "notifier", fmt.Sprintf("%T", notifier), "err", err)
+			}
+		}
+		notifications.pending.Done()
+	}
+}
+
+func (notifications *Notifications) send(event Event) {
+	notifications.pending.Add(1)
+	select {
+	case notifications.queue <- event:
+	default:
+		notifications.pending.Done()
+		slog.Warn("notification dropped, too many pending", "title", event.Title)
+	}
+}
+
+// Flush sends the held events now and waits up to timeout for the
+// notifiers, so the last events are not lost when the server exits.
+func (notifications *Notifications) Flush(timeout time.Duration) {
+	notifications.mutex.Lock()
+	for name, key := range notifications.keys {
+		if key.timer != nil {
+			key.timer.Stop()
+			key.timer = nil
+		}
+		if len(key.held) > 0 {
+			notifications.send(aggregate(key.held))
+			key.held = nil
+		}
+		delete(notifications.keys, name)
+	}
+	notifications.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		notifications.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+	}
+}
+
+func (notifications *Notifications) Notify(event Event) error {
+	if event.Severity < notifications.MinSeverity {
+		return nil
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if event.Key == "" {
+		event.Key = event.Title + "\x00" + event.Message
+	}
+	if notifications.Interval <= 0 {
+		notifications.send(event)
+		return nil
+	}
+
+	notifications.mutex.Lock()
+	defer notifications.mutex.Unlock()
+
+	key := notifications.keys[event.Key]
+	if key == nil || !event.Time.Before(key.until) && key.timer == nil {
+		notifications.prune(event.Time)
+		notifications.keys[event.Key] = &throttledKey{until: event.Time.Add(notifications.Interval)}
+		notifications.send(event)
+		return nil
+	}
+
+	key.held = append(key.held, event)
+	if key.timer == nil {
+		name := event.Key
+		key.timer = time.AfterFunc(key.until.Sub(event.Time), func() { notifications.flush(name) })
+	}
+	return nil
+}
+
+// flush sends the events held under a key as one and throttles the key for
+// another interval.
+func (notifications *Notifications) flush(name string) {
+	notifications.mutex.Lock()
+	defer notifications.mutex.Unlock()
+
+	key := notifications.keys[name]
+	if key == nil {
+		return
+	}
+	key.timer = nil
+	if len(key.held) == 0 {
+		return
+	}
+
+	notifications.send(aggregate(key.held))
+	key.held = nil
+	key.until = time.Now().Add(notifications.Interval)
+}
+
+// prune forgets the keys whose interval is over, since keys made of error
+// messages would otherwise pile up.
+func (notifications *Notifications) prune(now time.Time) {
+	for name, key := range notifications.keys {
+		if key.timer == nil && !now.Before(key.until) {
+			delete(notifications.keys, name)
+		}
+	}
+}
+
+func aggregate(events []Event) Event {
+	last := events[len(events)-1]
+	if len(events) == 1 {
+		return last
+	}
+
+	event := last
+	event.Count = len(events)
+	for _, held := range events {
+		if held.Severity > event.Severity {
+			event.Severity = held.Severity
+		}
+		if held.Title != last.Title {
+			event.Title = "GamepadServer"
+		}
+	}
+	if last.Summary != "" {
+		event.Title = "GamepadServer"
+		event.Message = fmt.Sprintf(last.Summary, len(events))
+	} else {
+		event.Message = fmt.Sprintf("%s (%d times)", last.Message, len(events))
+	}
+	return event
+}
+
+// NotificationConfig is the notifications.json file of the data directory.
+// Notifiers lists "log", "webhook" and the notifiers of the platform,
+// "toast" on Windows and "dbus" elsewhere. It is "log" and the notifier of
+// the desktop when empty.
+type NotificationConfig struct {
+	Notifiers   []string `json:"notifiers,omitempty"`
+	MinSeverity string   `json:"minSeverity,omitempty"`
+	// IntervalMs is the throttling interval, DefaultNotificationInterval
+	// when unset and none when negative.
+	IntervalMs int    `json:"intervalMs,omitempty"`
+	WebhookURL string `json:"webhookUrl,omitempty"`
+}
+
+func LoadNotificationConfig() (*NotificationConfig, error) {
+	config := &NotificationConfig{}
+	path, err := DataPath("notifications.json")
+	if err != nil {
+		return config, err
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return config, err
+	}
+
+	err = json.Unmarshal(data, config)
+	return config, err
+}
+
+// NewNotifications builds the notifiers of the configuration.
+func (config *NotificationConfig) NewNotifications() (*Notifications, error) {
+	minSeverity, err := ParseSeverity(config.MinSeverity)
+	if err != nil {
+		return nil, err
+	}
+	interval := DefaultNotificationInterval
+	if config.IntervalMs != 0 {
+		interval = time.Duration(config.IntervalMs) * time.Millisecond
+	}
+
+	if len(config.Notifiers) == 0 {
+		notifiers := []Notifier{LogNotifier{}}
+		if desktop := desktopNotifier(); desktop != nil {
+			notifiers = append(notifiers, desktop)
+		}
+		return NewNotifications(notifiers, minSeverity, interval), nil
+	}
+
+	var notifiers []Notifier
+	for _, name := range config.Notifiers {
+		switch name {
+		case "log":
+			notifiers = append(notifiers, LogNotifier{})
+		case "webhook":
+			if config.WebhookURL == "" {
+				return nil, fmt.Errorf("webhook notifier without webhookUrl")
+			}
+			notifiers = append(notifiers, NewWebhookNotifier(config.WebhookURL))
+		default:
+			notifier := platformNotifier(name)
+			if notifier == nil {
+				return nil, fmt.Errorf("notifier %q is not available on this platform", name)
+			}
+			notifiers = append(notifiers, notifier)
+		}
+	}
+	return NewNotifications(notifiers, minSeverity, interval), nil
+}
+
+var (
+	notificationsOnce sync.Once
+	notifications     *Notifications
+)
+
+// SetNotifications replaces the notifications Notify goes through.
+func SetNotifications(n *Notifications) {
+	notificationsOnce.Do(func() {})
+	notifications = n
+}
+
+func defaultNotifications() *Notifications {
+	notificationsOnce.Do(func() {
+		config, err := LoadNotificationConfig()
+		if err == nil {
+			notifications, err = config.NewNotifications()
+		}
+		if err != nil {
+			slog.Warn("bad notifications.json", "err", err)
+			config = &NotificationConfig{}
+			notifications, _ = config.NewNotifications()
+		}
+	})
+	return notifications
+}
+
+// Notify sends an event through the notifications of notifications.json.
+func Notify(event Event) {
+	defaultNotifications().Notify(event)
+}
+
+func FlushNotifications(timeout time.Duration) {
+	defaultNotifications().Flush(timeout)
+}
+
+func NotifyInfo(title, message string) {
+	Notify(Event{Severity: SeverityInfo, Title: title, Message: message})
+}
+
+func NotifyWarning(title, message string) {
+	Notify(Event{Severity: SeverityWarning, Title: title, Message: message})
+}
+
+func NotifyError(title, message string) {
+	Notify(Event{Severity: SeverityError, Title: title, Message: message})
+}
+
+// notifyConnected and notifyDisconnected share their keys between
+// controllers, so a flapping controller or a hub losing power ends up as
+// one notification.
+func notifyConnected(name, message string) {
+	Notify(Event{Severity: SeverityInfo, Key: "connected", Summary: "%d controllers connected", Title: name, Message: message})
+}
+
+func notifyDisconnected(name string) {
+	Notify(Event{Severity: SeverityInfo, Key: "disconnected", Summary: "%d controllers disconnected", Title: name, Message: "Disconnected"})
+}
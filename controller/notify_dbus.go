@@ -0,0 +1,64 @@
+//go:build !windows
+
+package controller
+
+import (
+	"os"
+	"sync"
+
+	"github.com/godbus/dbus/v5"
+)
+
+func platformNotifier(name string) Notifier {
+	if name == "dbus" {
+		return &DBusNotifier{}
+	}
+	return nil
+}
+
+// desktopNotifier returns nil without a session bus, as on servers.
+func desktopNotifier() Notifier {
+	if os.Getenv("DBUS_SESSION_BUS_ADDRESS") == "" {
+		return nil
+	}
+	return &DBusNotifier{}
+}
+
+// DBusNotifier shows notifications through the freedesktop notification
+// service of the session bus. A new event replaces the notification still
+// shown for its key.
+type DBusNotifier struct {
+	mutex sync.Mutex
+	ids   map[string]uint32
+}
+
+func (notifier *DBusNotifier) Notify(event Event) error {
+	conn, err := dbus.SessionBus()
+	if err != nil {
+		return err
+	}
+
+	notifier.mutex.Lock()
+	defer notifier.mutex.Unlock()
+	if notifier.ids == nil {
+		notifier.ids = make(map[string]uint32)
+	}
+
+	// Urgency is low, normal or critical.
+	urgency := byte(event.Severity)
+	hints := map[string]dbus.Variant{"urgency": dbus.MakeVariant(urgency)}
+	object := conn.Object("org.freedesktop.Notifications", "/org/freedesktop/Notifications")
+	call := object.Call("org.freedesktop.Notifications.Notify", 0,
+		"GamepadServer", notifier.ids[event.Key], "input-gaming",
+		event.Title, event.Message, []string{}, hints, int32(-1))
+	if call.Err != nil {
+		return call.Err
+	}
+
+	var id uint32
+	err = call.Store(&id)
+	if err == nil {
+		notifier.ids[event.Key] = id
+	}
+	return err
+}
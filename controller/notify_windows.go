@@ -0,0 +1,28 @@
+package controller
+
+import (
+	"github.com/go-toast/toast"
+)
+
+func platformNotifier(name string) Notifier {
+	if name == "toast" {
+		return ToastNotifier{}
+	}
+	return nil
+}
+
+func desktopNotifier() Notifier {
+	return ToastNotifier{}
+}
+
+// ToastNotifier shows Windows toast notifications.
+type ToastNotifier struct{}
+
+func (ToastNotifier) Notify(event Event) error {
+	notification := toast.Notification{
+		AppID:   "GamepadServer",
+		Title:   event.Title,
+		Message: event.Message,
+	}
+	return notification.Push()
+}
@@ -0,0 +1,602 @@
+package controller
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ReportSink takes the finished reports of a session, usually the emulated
+// Xbox 360 controller.
+type ReportSink interface {
+	Send(report *Xbox360ControllerReport) error
+}
+
+// Button modes, set per output button in the profile.
+type ButtonMode string
+
+const (
+	ButtonNormal ButtonMode = ""
+	// ButtonTurbo repeats the button while it is held, Rate times a second
+	// and pressed for Duty of each period. Rate is at most half the output
+	// rate.
+	ButtonTurbo ButtonMode = "turbo"
+	// ButtonToggle latches the button on one press and releases it on the
+	// next.
+	ButtonToggle ButtonMode = "toggle"
+)
+
+const (
+	defaultTurboRate = 10
+	defaultTurboDuty = 0.5
+
+	// Output rates of the pipeline in reports a second.
+	DefaultOutputRate = 250
+	MaxOutputRate     = 1000
+)
+
+type ButtonModeSettings struct {
+	Mode ButtonMode `json:"mode"`
+	Rate float32    `json:"rate,omitempty"`
+	Duty float32    `json:"duty,omitempty"`
+}
+
+type buttonModeState struct {
+	ButtonModeSettings
+	control Control
+
+	pressedSince time.Time
+	wasPressed   bool
+	latched      bool
+}
+
+// ButtonModes applies turbo and toggle modes to reports. Buttons and the
+// triggers can have a mode, a trigger counts as pressed past half way.
+type ButtonModes struct {
+	buttons []*buttonModeState
+}
+
+// NewButtonModes builds the modes of a pipeline sending rate reports a
+// second, which turbo rates cannot go past half of.
+func NewButtonModes(settings map[string]ButtonModeSettings, target *OutputTarget, rate int) (*ButtonModes, error) {
+	rate = outputRate(rate)
+	modes := &ButtonModes{}
+	for name, setting := range settings {
+		control, err := target.control(name)
+		if err != nil {
+			return nil, err
+		}
+		if control.Axis && control.Index != AxisLeftTrigger && control.Index != AxisRightTrigger {
+			return nil, fmt.Errorf("%w: %s cannot have a button mode", ErrBadRemapRule, name)
+		}
+		switch setting.Mode {
+		case ButtonNormal:
+			continue
+		case ButtonTurbo:
+			if setting.Rate < 0 || setting.Rate > float32(rate)/2 || setting.Duty < 0 || setting.Duty > 1 {
+				return nil, fmt.Errorf("%w: turbo of %s out of range", ErrBadRemapRule, name)
+			}
+			if setting.Rate == 0 {
+				setting.Rate = defaultTurboRate
+			}
+			if setting.Duty == 0 {
+				setting.Duty = defaultTurboDuty
+			}
+		case ButtonToggle:
+		default:
+			return nil, fmt.Errorf("%w: unknown mode %q for %s", ErrBadRemapRule, setting.Mode, name)
+		}
+		modes.buttons = append(modes.buttons, &buttonModeState{ButtonModeSettings: setting, control: control})
+	}
+	return modes, nil
+}
+
+func getModeInput(report *Xbox360ControllerReport, control Control) bool {
+	switch {
+	case !control.Axis:
+		return report.GetButtons()&(1<<uint(control.Index)) != 0
+	case control.Index == AxisLeftTrigger:
+		return report.GetLeftTrigger() >= 128
+	default:
+		return report.GetRightTrigger() >= 128
+	}
+}
+
+func setModeOutput(report *Xbox360ControllerReport, control Control, on bool) {
+	var value byte
+	if on {
+		value = 255
+	}
+	switch {
+	case !control.Axis:
+		buttons := report.GetButtons() &^ (1 << uint(control.Index))
+		if on {
+			buttons |= 1 << uint(control.Index)
+		}
+		report.SetButtons(buttons)
+	case control.Index == AxisLeftTrigger:
+		report.SetLeftTrigger(value)
+	default:
+		report.SetRightTrigger(value)
+	}
+}
+
+// Apply rewrites the buttons with a mode in the report. It can be called
+// again with the same input as time passes.
+func (modes *ButtonModes) Apply(report *Xbox360ControllerReport, now time.Time) {
+	for _, button := range modes.buttons {
+		pressed := getModeInput(report, button.control)
+		if pressed && !button.wasPressed {
+			button.pressedSince = now
+			button.latched = !button.latched
+		}
+		button.wasPressed = pressed
+
+		switch button.Mode {
+		case ButtonTurbo:
+			on := false
+			if pressed {
+				period := time.Duration(float32(time.Second) / button.Rate)
+				on = period > 0 && now.Sub(button.pressedSince)%period < time.Duration(float32(period)*button.Duty)
+			}
+			setModeOutput(report, button.control, on)
+		case ButtonToggle:
+			setModeOutput(report, button.control, button.latched)
+		}
+	}
+}
+
+// Active reports whether a turbo button is held, so the output changes
+// without new input.
+func (modes *ButtonModes) Active() bool {
+	for _, button := range modes.buttons {
+		if button.Mode == ButtonTurbo && button.wasPressed {
+			return true
+		}
+	}
+	return false
+}
+
+// Pipeline is the output stage of a session. It records input, applies the
+// face button layout and the remapping, runs the script, emulates the
+// triggers, plays macros and applies the button modes to the reports built
+// from the source, then sends them to the sink. Input only updates the
+// state of the pipeline, its pump sends the latest state at a fixed rate
+// so the output does not follow the timing of the source, and skips the
+// send when the report did not change.
+type Pipeline struct {
+	Sink   ReportSink
+	Modes  *ButtonModes
+	Script *Script
+	// Layout and Remapper rewrite the input before the other stages, the
+	// layout first. OnLayout is called, outside the lock, when the chord
+	// of the layout switched it.
+	Layout   *LayoutSwitcher
+	Remapper *Remapper
+	OnLayout func(policy LayoutPolicy)
+	// LeftTrigger and RightTrigger emulate the depth of digital triggers,
+	// nil for digital ones. They read the triggers and sticks of the input
+	// before the layout and remapping, and replace the trigger axes of the
+	// output on every tick.
+	LeftTrigger  *TriggerEmulator
+	RightTrigger *TriggerEmulator
+	// Bindings maps buttons to the macro they play. Bound buttons are not
+	// sent. The macros are loaded when the pipeline is built, pressing a
+	// button only looks in the macro cache.
+	Bindings map[int]string
+
+	rate     int
+	mutex    sync.Mutex
+	last     Xbox360ControllerReport
+	scripted Xbox360ControllerReport
+	pending  bool
+	sent     Xbox360ControllerReport
+	hasSent  bool
+	sendErr  error
+	done     chan struct{}
+	closed   bool
+
+	triggerInput TriggerInput
+	rightPressed bool
+
+	stats       PumpStats
+	lastTick    time.Time
+	intervalSum time.Duration
+
+	// Metrics of the session source, nil without a session.
+	received *uint64
+	sentTo   *uint64
+	log      *slog.Logger
+
+	boundPressed uint16
+	playing      *Macro
+	playStart    time.Time
+	recording    *Macro
+	recordStart  time.Time
+	recordLast   ControlState
+	recorder     *InputRecorder
+}
+
+// PumpStats counts the ticks of the pump of a pipeline. Every tick either
+// sends or skips, Coalesced counts the input frames replaced by a newer one
+// before a tick, and LateTicks the ticks that came more than half a period
+// late.
+type PumpStats struct {
+	Rate           int     `json:"rate"`
+	Ticks          uint64  `json:"ticks"`
+	Sent           uint64  `json:"sent"`
+	Skipped        uint64  `json:"skipped"`
+	Coalesced      uint64  `json:"coalesced"`
+	Errors         uint64  `json:"errors"`
+	LateTicks      uint64  `json:"lateTicks"`
+	MeanIntervalMs float64 `json:"meanIntervalMs"`
+	MaxIntervalMs  float64 `json:"maxIntervalMs"`
+}
+
+// NewPipeline starts a pipeline sending rate reports a second, or
+// DefaultOutputRate when rate is 0.
+func NewPipeline(sink ReportSink, modes *ButtonModes, rate int) *Pipeline {
+	rate = outputRate(rate)
+
+	pipeline := &Pipeline{Sink: sink, Modes: modes, rate: rate, done: make(chan struct{}), log: slog.Default()}
+	pipeline.stats.Rate = rate
+	go pipeline.pump()
+	return pipeline
+}
+
+func outputRate(rate int) int {
+	if rate <= 0 {
+		return DefaultOutputRate
+	}
+	if rate > MaxOutputRate {
+		return MaxOutputRate
+	}
+	return rate
+}
+
+// Send takes a new input report. It returns the error of the last report
+// the pump sent to the sink.
+func (pipeline *Pipeline) Send(report *Xbox360ControllerReport) error {
+	return pipeline.SendInput(report, 0)
+}
+
+// SendInput is Send for sources with extra buttons, given by their index in
+// the inputs of the source. Only the remapping reads them. A source sends
+// from one goroutine.
+func (pipeline *Pipeline) SendInput(report *Xbox360ControllerReport, extra uint32) error {
+	now := time.Now()
+	in, script, switched := pipeline.input(*report, extra, now)
+	if switched != nil && pipeline.OnLayout != nil {
+		pipeline.OnLayout(*switched)
+	}
+
+	// The script runs outside the lock, a slow frame does not hold up the
+	// pump.
+	if script != nil {
+		in = script.Frame(in, now)
+	}
+	return pipeline.update(in)
+}
+
+// input runs the stages before the script on a new input report. It
+// returns the report for the script, the script, and the new layout
+// policy when the report switched it.
+func (pipeline *Pipeline) input(report Xbox360ControllerReport, extra uint32, now time.Time) (Xbox360ControllerReport, *Script, *LayoutPolicy) {
+	pipeline.mutex.Lock()
+	defer pipeline.mutex.Unlock()
+
+	traceReport(pipeline.log, "frame", &report)
+	if pipeline.recorder != nil {
+		pipeline.recorder.Record(&report, extra, now)
+	}
+	pipeline.readTriggers(&report)
+	var switched *LayoutPolicy
+	if pipeline.Layout != nil && pipeline.Layout.Update(&report, now) {
+		policy := pipeline.Layout.Policy
+		switched = &policy
+	}
+	if pipeline.Remapper != nil {
+		pipeline.Remapper.Apply(&report, extra)
+	}
+	pipeline.last = report
+	pipeline.record(now)
+	pipeline.checkBindings(now)
+	return report, pipeline.Script, switched
+}
+
+// update takes the report made by the script as the latest input.
+func (pipeline *Pipeline) update(report Xbox360ControllerReport) error {
+	pipeline.mutex.Lock()
+	defer pipeline.mutex.Unlock()
+
+	pipeline.scripted = report
+	if pipeline.received != nil {
+		atomic.AddUint64(pipeline.received, 1)
+	}
+	if pipeline.pending {
+		pipeline.stats.Coalesced++
+	}
+	pipeline.pending = true
+	return pipeline.sendErr
+}
+
+// AddPitch adds the degrees the source turned around its pitch axis since
+// the last call, for triggers emulated from the gyro.
+func (pipeline *Pipeline) AddPitch(degrees float32) {
+	pipeline.mutex.Lock()
+	defer pipeline.mutex.Unlock()
+
+	pipeline.triggerInput.PitchDelta += degrees
+}
+
+// readTriggers keeps what the trigger emulation reads of an input report.
+func (pipeline *Pipeline) readTriggers(report *Xbox360ControllerReport) {
+	if pipeline.LeftTrigger == nil && pipeline.RightTrigger == nil {
+		return
+	}
+	input := &pipeline.triggerInput
+	lx, ly := report.GetLeftThumb()
+	rx, ry := report.GetRightThumb()
+	input.LeftX, input.LeftY = float32(lx)/32767, float32(ly)/32767
+	input.RightX, input.RightY = float32(rx)/32767, float32(ry)/32767
+	input.Pressed = report.GetLeftTrigger() >= 128
+	pipeline.rightPressed = report.GetRightTrigger() >= 128
+}
+
+// emulateTriggers sets the emulated triggers of a report at now. The pitch
+// added since the last tick is used up.
+func (pipeline *Pipeline) emulateTriggers(report *Xbox360ControllerReport, now time.Time) {
+	input := pipeline.triggerInput
+	if pipeline.LeftTrigger != nil {
+		report.SetLeftTrigger(pipeline.LeftTrigger.Value(input, now))
+	}
+	if pipeline.RightTrigger != nil {
+		input.Pressed = pipeline.rightPressed
+		report.SetRightTrigger(pipeline.RightTrigger.Value(input, now))
+	}
+	pipeline.triggerInput.PitchDelta = 0
+}
+
+// output builds the report to send at now from the latest input.
+func (pipeline *Pipeline) output(now time.Time) Xbox360ControllerReport {
+	out := pipeline.scripted
+	if pipeline.boundPressed != 0 {
+		out.SetButtons(out.GetButtons() &^ pipeline.boundPressed)
+	}
+	pipeline.emulateTriggers(&out, now)
+
+	if pipeline.playing != nil {
+		state, playing := pipeline.playing.StateAt(now.Sub(pipeline.playStart), Xbox360Target)
+		if playing {
+			mixed := MixStates(StateFromReport(&out), state, pipeline.playing.Policy)
+			out = mixed.Report()
+		} else {
+			pipeline.playing = nil
+		}
+	}
+
+	if pipeline.Script != nil {
+		pipeline.Script.Overlay(&out, now)
+	}
+
+	if pipeline.Modes != nil {
+		pipeline.Modes.Apply(&out, now)
+	}
+	return out
+}
+
+func (pipeline *Pipeline) pump() {
+	period := time.Second / time.Duration(pipeline.rate)
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			pipeline.mutex.Lock()
+			// A tick racing Close must not follow its neutral report.
+			if !pipeline.closed {
+				pipeline.tick(now, period)
+			}
+			pipeline.mutex.Unlock()
+		case <-pipeline.done:
+			return
+		}
+	}
+}
+
+func (pipeline *Pipeline) tick(now time.Time, period time.Duration) {
+	stats := &pipeline.stats
+	if !pipeline.lastTick.IsZero() {
+		interval := now.Sub(pipeline.lastTick)
+		pipeline.intervalSum += interval
+		stats.MeanIntervalMs = float64(pipeline.intervalSum) / float64(stats.Ticks) / float64(time.Millisecond)
+		if ms := float64(interval) / float64(time.Millisecond); ms > stats.MaxIntervalMs {
+			stats.MaxIntervalMs = ms
+		}
+		if interval > period*3/2 {
+			stats.LateTicks++
+		}
+	}
+	pipeline.lastTick = now
+	stats.Ticks++
+
+	// Without new input or a running effect the report cannot change.
+	if !pipeline.pending && !pipeline.active() {
+		stats.Skipped++
+		return
+	}
+	pipeline.send(now)
+}
+
+func (pipeline *Pipeline) send(now time.Time) {
+	stats := &pipeline.stats
+	pipeline.pending = false
+
+	out := pipeline.output(now)
+	if pipeline.hasSent && out == pipeline.sent {
+		stats.Skipped++
+		return
+	}
+
+	pipeline.sendErr = pipeline.Sink.Send(&out)
+	if pipeline.sendErr != nil {
+		stats.Errors++
+		// Sent again on the next tick.
+		pipeline.pending = true
+		return
+	}
+	pipeline.sent = out
+	pipeline.hasSent = true
+	stats.Sent++
+	if pipeline.sentTo != nil {
+		atomic.AddUint64(pipeline.sentTo, 1)
+	}
+}
+
+// setSource counts the frames of the pipeline under a session source and
+// traces them to the log of the session.
+func (pipeline *Pipeline) setSource(source string, log *slog.Logger) {
+	pipeline.mutex.Lock()
+	defer pipeline.mutex.Unlock()
+
+	pipeline.log = log
+	pipeline.received = metricFramesReceived.Counter(source)
+	pipeline.sentTo = metricFramesSent.Counter(source, outputBackend)
+}
+
+// Flush sends the latest input now instead of on the next tick.
+func (pipeline *Pipeline) Flush() error {
+	pipeline.mutex.Lock()
+	defer pipeline.mutex.Unlock()
+
+	if pipeline.pending {
+		pipeline.send(time.Now())
+	}
+	return pipeline.sendErr
+}
+
+func (pipeline *Pipeline) Stats() PumpStats {
+	pipeline.mutex.Lock()
+	defer pipeline.mutex.Unlock()
+
+	return pipeline.stats
+}
+
+func (pipeline *Pipeline) active() bool {
+	return pipeline.triggerInput.Pressed && pipeline.LeftTrigger != nil ||
+		pipeline.rightPressed && pipeline.RightTrigger != nil ||
+		pipeline.playing != nil ||
+		pipeline.Modes != nil && pipeline.Modes.Active() ||
+		pipeline.Script != nil && pipeline.Script.Active()
+}
+
+// checkBindings starts the macro of a bound button when it is pressed.
+func (pipeline *Pipeline) checkBindings(now time.Time) {
+	buttons := pipeline.last.GetButtons()
+	for button, name := range pipeline.Bindings {
+		bit := uint16(1) << uint(button)
+		if buttons&bit == 0 {
+			pipeline.boundPressed &^= bit
+			continue
+		}
+		if pipeline.boundPressed&bit != 0 {
+			continue
+		}
+		pipeline.boundPressed |= bit
+
+		macro := CachedMacro(name)
+		if macro == nil {
+			NotifyError("unable to play macro "+name, ErrNoMacro.Error())
+			continue
+		}
+		pipeline.playing = macro
+		pipeline.playStart = now
+	}
+}
+
+// Play starts a macro, replacing the one playing.
+func (pipeline *Pipeline) Play(macro *Macro) {
+	pipeline.mutex.Lock()
+	defer pipeline.mutex.Unlock()
+
+	pipeline.playing = macro
+	pipeline.playStart = time.Now()
+}
+
+// StartRecording records the input of the pipeline, before button modes
+// and macros, until StopRecording.
+func (pipeline *Pipeline) StartRecording() {
+	pipeline.mutex.Lock()
+	defer pipeline.mutex.Unlock()
+
+	pipeline.recording = &Macro{}
+	pipeline.recordStart = time.Now()
+	pipeline.recordLast = StateFromReport(&pipeline.last)
+	pipeline.recording.Frames = append(pipeline.recording.Frames, FrameFromState(pipeline.recordLast, 0, Xbox360Target))
+}
+
+// StopRecording returns the recorded macro, or nil if not recording.
+func (pipeline *Pipeline) StopRecording() *Macro {
+	pipeline.mutex.Lock()
+	defer pipeline.mutex.Unlock()
+
+	macro := pipeline.recording
+	if macro != nil {
+		macro.Length = int(time.Since(pipeline.recordStart) / time.Millisecond)
+	}
+	pipeline.recording = nil
+	return macro
+}
+
+func (pipeline *Pipeline) record(now time.Time) {
+	if pipeline.recording == nil {
+		return
+	}
+
+	state := StateFromReport(&pipeline.last)
+	if state == pipeline.recordLast {
+		return
+	}
+	pipeline.recordLast = state
+	pipeline.recording.Frames = append(pipeline.recording.Frames, FrameFromState(state, now.Sub(pipeline.recordStart), Xbox360Target))
+}
+
+// SetRecorder starts writing the input of the pipeline to an input
+// recording, or stops with nil. It returns the previous recorder, which the
+// caller closes.
+func (pipeline *Pipeline) SetRecorder(recorder *InputRecorder) *InputRecorder {
+	pipeline.mutex.Lock()
+	defer pipeline.mutex.Unlock()
+
+	previous := pipeline.recorder
+	pipeline.recorder = recorder
+	return previous
+}
+
+// Close stops the pump, the script and the input recording, and releases
+// every control of the sink with a neutral report. It does not close the
+// sink.
+func (pipeline *Pipeline) Close() {
+	close(pipeline.done)
+
+	pipeline.mutex.Lock()
+	pipeline.closed = true
+	neutral := NewXbox360ControllerReport()
+	if pipeline.hasSent && pipeline.sent != neutral {
+		pipeline.Sink.Send(&neutral)
+	}
+	recorder, script := pipeline.recorder, pipeline.Script
+	pipeline.recorder, pipeline.Script = nil, nil
+	pipeline.mutex.Unlock()
+
+	// Both can wait, for the disk or for a running frame.
+	if recorder != nil {
+		recorder.Close()
+	}
+	if script != nil {
+		script.Close()
+	}
+}
@@ -0,0 +1,315 @@
+package controller
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files of testdata")
+
+// fakeSink keeps the reports a pipeline sends.
+type fakeSink struct {
+	mutex   sync.Mutex
+	reports []Xbox360ControllerReport
+}
+
+func (sink *fakeSink) Send(report *Xbox360ControllerReport) error {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	sink.reports = append(sink.reports, *report)
+	return nil
+}
+
+func (sink *fakeSink) last(t *testing.T) *Xbox360ControllerReport {
+	t.Helper()
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	if len(sink.reports) == 0 {
+		t.Fatal("nothing sent")
+	}
+	report := sink.reports[len(sink.reports)-1]
+	return &report
+}
+
+func buttonsReport(buttons ...int) *Xbox360ControllerReport {
+	report := NewXbox360ControllerReport()
+	for _, button := range buttons {
+		report.MaybeSetButton(button, true)
+	}
+	return &report
+}
+
+func TestPipelineLayout(t *testing.T) {
+	quietNotifications(t)
+	sink := &fakeSink{}
+	profile := &Profile{
+		FaceButtons: LayoutPolicy{Layout: LayoutLabel},
+		Remap:       &RemapConfig{Base: []RemapRule{{From: "B", To: "X"}}},
+	}
+	pipeline := profile.NewPipeline("test", sink, nil)
+	defer pipeline.Close()
+
+	// Without Nintendo labels the label layout keeps A, with them A
+	// becomes B, which the remapping turns into X.
+	pipeline.Send(buttonsReport(Xbox360ControllerButtonA))
+	pipeline.Flush()
+	if got := sink.last(t).GetButtons(); got != 1<<Xbox360ControllerButtonA {
+		t.Errorf("buttons %04x without Nintendo labels", got)
+	}
+	pipeline.Layout.NintendoLabels = true
+	pipeline.Send(buttonsReport(Xbox360ControllerButtonA))
+	pipeline.Flush()
+	if got := sink.last(t).GetButtons(); got != 1<<Xbox360ControllerButtonX {
+		t.Errorf("buttons %04x with Nintendo labels", got)
+	}
+
+	// Holding Back and Start switches to the next layout.
+	chord := buttonsReport(Xbox360ControllerButtonBack, Xbox360ControllerButtonStart)
+	start := time.Now()
+	pipeline.input(*chord, 0, start)
+	if _, _, policy := pipeline.input(*chord, 0, start.Add(layoutChordHold)); policy == nil || policy.Layout != LayoutPositional {
+		t.Fatalf("switched to %+v", policy)
+	}
+	pipeline.Send(buttonsReport(Xbox360ControllerButtonA))
+	pipeline.Flush()
+	if got := sink.last(t).GetButtons(); got != 1<<Xbox360ControllerButtonA {
+		t.Errorf("buttons %04x after switching to positional", got)
+	}
+}
+
+func TestProfilePipelineInputs(t *testing.T) {
+	quietNotifications(t)
+	profile := &Profile{
+		Remap:      &RemapConfig{Base: []RemapRule{{From: "Touchpad", To: "Back"}}},
+		OutputRate: 500,
+	}
+
+	// The remapping reads the inputs of the device of the session.
+	sink := &fakeSink{}
+	pipeline := profile.NewPipeline("DualSense", sink, &DualSense{})
+	defer pipeline.Close()
+	if pipeline.Remapper == nil || pipeline.Stats().Rate != 500 {
+		t.Fatalf("remapper %v, rate %d", pipeline.Remapper, pipeline.Stats().Rate)
+	}
+	state := PlayStationState{Hat: playStationHatNeutral, Buttons: 1 << PlayStationButtonTouchpad}
+	report := Xbox360ControllerReport{}
+	report.SetFromPlayStation(&state)
+	pipeline.SendInput(&report, state.extra())
+	pipeline.Flush()
+	if got := sink.last(t).GetButtons(); got != 1<<Xbox360ControllerButtonBack {
+		t.Errorf("touchpad sent buttons %04x", got)
+	}
+
+	// A source without a touchpad cannot use the remapping.
+	other := profile.NewPipeline("Generic", &fakeSink{}, genericHIDSource{})
+	defer other.Close()
+	if other.Remapper != nil {
+		t.Error("touchpad remapped on a generic pad")
+	}
+}
+
+func TestPipelineBoundMacro(t *testing.T) {
+	quietNotifications(t)
+	macro := &Macro{Name: "test-jump", Length: 1000, Frames: []MacroFrame{{At: 0, Buttons: []string{"A"}}}}
+	if err := SaveMacro(macro); err != nil {
+		t.Fatal(err)
+	}
+	defer DeleteMacro(macro.Name)
+
+	// Built from the profile, the pipeline has the macro loaded and does
+	// not need the file when Y is pressed.
+	macroMutex.Lock()
+	delete(macroCache, macro.Name)
+	macroMutex.Unlock()
+	sink := &fakeSink{}
+	profile := &Profile{Macros: map[string]string{"Y": macro.Name}}
+	pipeline := profile.NewPipeline("test", sink, nil)
+	defer pipeline.Close()
+	path, _ := macroPath(macro.Name)
+	if err := os.Rename(path, path+".moved"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Rename(path+".moved", path)
+
+	pipeline.Send(buttonsReport(Xbox360ControllerButtonY))
+	pipeline.Flush()
+	if got := sink.last(t).GetButtons(); got != 1<<Xbox360ControllerButtonA {
+		t.Errorf("buttons %04x, want the A of the macro", got)
+	}
+}
+
+// Emulated triggers ramp on the ticks of the pump while the source holds
+// the digital trigger, without new input.
+func TestPipelineTriggerEmulation(t *testing.T) {
+	quietNotifications(t)
+	sink := &fakeSink{}
+	profile := &Profile{RightTrigger: TriggerSettings{Mode: TriggerRamp, RampMs: 100}}
+	pipeline := profile.NewPipeline("test", sink, nil)
+	defer pipeline.Close()
+
+	report := buttonsReport()
+	report.SetLeftTrigger(255)
+	report.SetRightTrigger(255)
+	pipeline.Send(report)
+	pipeline.Flush()
+	first := sink.last(t)
+	if first.GetLeftTrigger() != 255 || first.GetRightTrigger() == 255 {
+		t.Errorf("triggers %d,%d right after the press, want the left one digital and the right one ramping", first.GetLeftTrigger(), first.GetRightTrigger())
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if got := sink.last(t).GetRightTrigger(); got != 255 {
+		t.Errorf("right trigger %d after the ramp, want 255", got)
+	}
+	sink.mutex.Lock()
+	sent := len(sink.reports)
+	sink.mutex.Unlock()
+	if sent < 3 {
+		t.Errorf("%d reports sent during the ramp, want the pump to send it", sent)
+	}
+}
+
+func TestButtonModesTurboRate(t *testing.T) {
+	tests := []struct {
+		name   string
+		rate   float32
+		output int
+		ok     bool
+	}{
+		{"default", 0, 0, true},
+		{"half the output", 125, 0, true},
+		{"past half the output", 126, 0, false},
+		{"half the fastest output", 500, MaxOutputRate, true},
+		{"truncated period", 2e9, MaxOutputRate, false},
+		{"negative", -1, 0, false},
+	}
+	for _, test := range tests {
+		settings := map[string]ButtonModeSettings{"A": {Mode: ButtonTurbo, Rate: test.rate}}
+		_, err := NewButtonModes(settings, Xbox360Target, test.output)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: %v, want ok %v", test.name, err, test.ok)
+		}
+	}
+
+	// A rate with a period too short for a Duration turns the button off
+	// instead of dividing by zero.
+	modes := &ButtonModes{buttons: []*buttonModeState{{
+		ButtonModeSettings: ButtonModeSettings{Mode: ButtonTurbo, Rate: 2e9, Duty: 0.5},
+		control:            Xbox360Target.Controls["A"],
+	}}}
+	report := buttonsReport(Xbox360ControllerButtonA)
+	modes.Apply(report, time.Now())
+	if report.GetButtons() != 0 {
+		t.Errorf("buttons %04x, want A off", report.GetButtons())
+	}
+}
+
+// replayPipeline sends the frames of a recording through a pipeline one by
+// one and returns the reports it sent, at the time of the frame they
+// followed.
+func replayPipeline(t *testing.T, recording *Recording, profile *Profile) []RecordedFrame {
+	sink := &fakeSink{}
+	pipeline := profile.NewPipeline(recording.Header.Session.Name, sink, recording.Header.Session)
+	defer pipeline.Close()
+	pipeline.OnLayout = nil
+	pipeline.Layout.NintendoLabels = recording.Header.Session.NintendoLabels()
+
+	var sent []RecordedFrame
+	for _, frame := range recording.Frames {
+		report := frame.Report
+		if err := pipeline.SendInput(&report, frame.Extra); err != nil {
+			t.Fatal(err)
+		}
+		// The pump may have sent the report first, either way it is sent
+		// once.
+		pipeline.Flush()
+		sink.mutex.Lock()
+		if len(sink.reports) > len(sent) {
+			sent = append(sent, RecordedFrame{At: frame.At, Report: sink.reports[len(sink.reports)-1]})
+		}
+		sink.mutex.Unlock()
+	}
+	return sent
+}
+
+func writeRecording(t *testing.T, path string, info SessionInfo, frames []RecordedFrame) {
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder, err := NewInputRecorder(file, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, frame := range frames {
+		recorder.Record(&frame.Report, frame.Extra, recorder.start.Add(frame.At))
+		// Leaves the writer time, a full buffer drops frames.
+		time.Sleep(20 * time.Microsecond)
+	}
+	if err := recorder.Close(); err != nil || recorder.dropped > 0 {
+		t.Fatalf("writing %s: %v, %d frames dropped", path, err, recorder.dropped)
+	}
+}
+
+// TestPipelineReplay replays the input recordings of testdata through the
+// pipeline of the profile next to them and compares what it sends with the
+// golden output recording. Run with -update to rewrite them.
+//
+// The synthetic inputs are scripted presses, extra inputs and stick moves
+// written with InputRecorder, not recordings of a controller. Recordings
+// made with the admin API can be dropped in next to a profile.
+func TestPipelineReplay(t *testing.T) {
+	inputs, err := filepath.Glob(filepath.Join("testdata", "*.input.gprec"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inputs) == 0 {
+		t.Fatal("no input recordings in testdata")
+	}
+
+	for _, input := range inputs {
+		name := strings.TrimSuffix(input, ".input.gprec")
+		t.Run(filepath.Base(name), func(t *testing.T) {
+			quietNotifications(t)
+			recording, err := LoadRecording(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(name + ".profile.json")
+			if err != nil {
+				t.Fatal(err)
+			}
+			profile := &Profile{}
+			if err := json.Unmarshal(data, profile); err != nil {
+				t.Fatal(err)
+			}
+
+			got := replayPipeline(t, recording, profile)
+			golden := name + ".golden.gprec"
+			if *update {
+				writeRecording(t, golden, recording.Header.Session, got)
+				return
+			}
+			want, err := LoadRecording(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < len(got) || i < len(want.Frames); i++ {
+				switch {
+				case i >= len(got):
+					t.Fatalf("report %d missing, want %+v", i, want.Frames[i])
+				case i >= len(want.Frames):
+					t.Fatalf("extra report %d: %+v", i, got[i])
+				case got[i] != want.Frames[i]:
+					t.Fatalf("report %d is %+v, want %+v", i, got[i], want.Frames[i])
+				}
+			}
+		})
+	}
+}
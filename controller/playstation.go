@@ -0,0 +1,438 @@
+package controller
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/boombuler/hid"
+)
+
+// Bits of PlayStationState.Buttons. The layout follows the DS4 report:
+// the face buttons, then the shoulder and menu buttons, then PS, touchpad
+// click and (DualSense only) mute.
+const (
+	PlayStationButtonSquare   = 0
+	PlayStationButtonCross    = 1
+	PlayStationButtonCircle   = 2
+	PlayStationButtonTriangle = 3
+	PlayStationButtonL1       = 4
+	PlayStationButtonR1       = 5
+	PlayStationButtonL2       = 6
+	PlayStationButtonR2       = 7
+	PlayStationButtonShare    = 8
+	PlayStationButtonOptions  = 9
+	PlayStationButtonL3       = 10
+	PlayStationButtonR3       = 11
+	PlayStationButtonPS       = 12
+	PlayStationButtonTouchpad = 13
+	PlayStationButtonMute     = 14
+)
+
+const playStationHatNeutral = 8
+
+// Extra inputs of the PlayStation pads, which the Xbox 360 controller has
+// no button for.
+const (
+	playStationExtraTouchpad = 0
+	playStationExtraMute     = 1
+)
+
+var (
+	DualShock4Inputs = sourceInputs("DualShock 4", "Touchpad")
+	DualSenseInputs  = sourceInputs("DualSense", "Touchpad", "Mute")
+)
+
+var (
+	ErrUnknownReport = errors.New("unknown input report")
+	ErrBadChecksum   = errors.New("input report checksum mismatch")
+)
+
+type TouchPoint struct {
+	Active bool
+	ID     byte
+	X      uint16
+	Y      uint16
+}
+
+type PlayStationState struct {
+	LeftX    byte
+	LeftY    byte
+	RightX   byte
+	RightY   byte
+	L2       byte
+	R2       byte
+	Hat      byte
+	Buttons  uint16
+	Touch    [2]TouchPoint
+	Gyro     [3]float32 // pitch, yaw and roll in degrees per second
+	Accel    [3]float32 // x, y and z in g
+	Battery  byte       // percent
+	Charging bool
+}
+
+func (state *PlayStationState) Pressed(button int) bool {
+	return state.Buttons&(1<<button) != 0
+}
+
+// FeatureReportDevice is implemented by HID devices that can read feature
+// reports, as the devices OpenDevice returns.
+type FeatureReportDevice interface {
+	GetFeatureReport(reportID byte) ([]byte, error)
+}
+
+// IMUCalibration converts raw gyro and accelerometer samples using the
+// calibration feature report of the pad.
+type IMUCalibration struct {
+	GyroBias   [3]int16
+	GyroNumer  [3]int32
+	GyroDenom  [3]int32
+	AccelBias  [3]int16
+	AccelNumer [3]int32
+	AccelDenom [3]int32
+}
+
+func DefaultIMUCalibration() IMUCalibration {
+	var cal IMUCalibration
+	for i := 0; i < 3; i++ {
+		cal.GyroNumer[i], cal.GyroDenom[i] = 1, 16
+		cal.AccelNumer[i], cal.AccelDenom[i] = 1, 8192
+	}
+
+	return cal
+}
+
+// ParseIMUCalibration reads the calibration feature report, without its
+// report ID. The DS4 over Bluetooth lists all plus values before the minus
+// values, every other variant interleaves them.
+func ParseIMUCalibration(data []byte, plusFirst bool) IMUCalibration {
+	cal := DefaultIMUCalibration()
+	if len(data) < 34 {
+		return cal
+	}
+
+	value := func(i int) int32 {
+		return int32(int16(binary.LittleEndian.Uint16(data[i*2:])))
+	}
+
+	var plus, minus [3]int32
+	for i := 0; i < 3; i++ {
+		if plusFirst {
+			plus[i], minus[i] = value(3+i), value(6+i)
+		} else {
+			plus[i], minus[i] = value(3+i*2), value(4+i*2)
+		}
+	}
+	speed2x := value(9) + value(10)
+
+	for i := 0; i < 3; i++ {
+		bias := value(i)
+		denom := abs32(plus[i]-bias) + abs32(minus[i]-bias)
+		if denom != 0 {
+			cal.GyroBias[i] = int16(bias)
+			cal.GyroNumer[i] = speed2x
+			cal.GyroDenom[i] = denom
+		}
+
+		accelPlus, accelMinus := value(11+i*2), value(12+i*2)
+		range2g := accelPlus - accelMinus
+		if range2g != 0 {
+			cal.AccelBias[i] = int16(accelPlus - range2g/2)
+			cal.AccelNumer[i] = 2
+			cal.AccelDenom[i] = range2g
+		}
+	}
+
+	return cal
+}
+
+func (cal IMUCalibration) Apply(state *PlayStationState, data []byte) {
+	for i := 0; i < 3; i++ {
+		gyro := int32(int16(binary.LittleEndian.Uint16(data[i*2:])))
+		accel := int32(int16(binary.LittleEndian.Uint16(data[6+i*2:])))
+		state.Gyro[i] = float32(gyro-int32(cal.GyroBias[i])) * float32(cal.GyroNumer[i]) / float32(cal.GyroDenom[i])
+		state.Accel[i] = float32(accel-int32(cal.AccelBias[i])) * float32(cal.AccelNumer[i]) / float32(cal.AccelDenom[i])
+	}
+}
+
+func abs32(v int32) int32 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// playStationChecksum is the CRC32 of a Bluetooth report, seeded with the
+// HID transaction header (0xA1 for input, 0xA2 for output).
+func playStationChecksum(header byte, data []byte) uint32 {
+	crc := crc32.Update(0, crc32.IEEETable, []byte{header})
+	return crc32.Update(crc, crc32.IEEETable, data)
+}
+
+func checkPlayStationReport(raw []byte) bool {
+	n := len(raw) - 4
+	return playStationChecksum(0xA1, raw[:n]) == binary.LittleEndian.Uint32(raw[n:])
+}
+
+func signPlayStationReport(raw []byte) {
+	n := len(raw) - 4
+	binary.LittleEndian.PutUint32(raw[n:], playStationChecksum(0xA2, raw[:n]))
+}
+
+func parseTouchPoint(data []byte) TouchPoint {
+	return TouchPoint{
+		Active: data[0]&0x80 == 0,
+		ID:     data[0] & 0x7F,
+		X:      uint16(data[2]&0xF)<<8 | uint16(data[1]),
+		Y:      uint16(data[3])<<4 | uint16(data[2]>>4),
+	}
+}
+
+// parseSimplePlayStationReport decodes the 0x01 report both pads send over
+// Bluetooth until they are switched to full reports. data starts after
+// the report ID.
+func parseSimplePlayStationReport(data []byte) PlayStationState {
+	return PlayStationState{
+		LeftX:   data[0],
+		LeftY:   data[1],
+		RightX:  data[2],
+		RightY:  data[3],
+		Hat:     data[4] & 0xF,
+		Buttons: uint16(data[4]>>4) | uint16(data[5])<<4 | uint16(data[6]&0x3)<<12,
+		L2:      data[7],
+		R2:      data[8],
+	}
+}
+
+// PlayStationController holds what the DS4 and DualSense have in common.
+type PlayStationController struct {
+	Name        string
+	Device      hid.Device
+	Bluetooth   bool
+	Calibration IMUCalibration
+
+	// Output state, guarded by outputMutex since rumble arrives from ViGEm.
+	outputMutex sync.Mutex
+	Lightbar    [3]byte
+	Rumble      Vibration
+}
+
+func (controller *PlayStationController) Controller() *PlayStationController {
+	return controller
+}
+
+func (controller *PlayStationController) readFeature(reportID byte, length int) ([]byte, error) {
+	device, ok := controller.Device.(FeatureReportDevice)
+	if !ok {
+		return nil, ErrFeatureReportsUnsupported
+	}
+
+	data, err := device.GetFeatureReport(reportID)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < length {
+		return nil, fmt.Errorf("feature report 0x%02X: %w", reportID, ErrShortReply)
+	}
+
+	return data, nil
+}
+
+// loadCalibration reads the IMU calibration feature report. Without it
+// the IMU keeps the default scaling and a Bluetooth pad stays in its
+// reduced report mode, so the failure is reported rather than ignored.
+func (controller *PlayStationController) loadCalibration(reportID byte, plusFirst bool) {
+	data, err := controller.readFeature(reportID, 35)
+	if err != nil {
+		slog.Error("unable to read IMU calibration", "device", controller.Name, "err", err)
+		message := "unable to read IMU calibration: " + err.Error()
+		if controller.Bluetooth {
+			message += ", the pad stays in reduced report mode"
+		}
+		NotifyWarning(controller.Name, message)
+		return
+	}
+
+	controller.Calibration = ParseIMUCalibration(data[1:], plusFirst)
+}
+
+type playStationPad interface {
+	Controller() *PlayStationController
+	Init() error
+	ParseInput(raw []byte) (PlayStationState, error)
+	WriteOutput() error
+}
+
+// SetLightbar changes the lightbar color and sends it to the pad.
+func SetLightbar(pad playStationPad, r, g, b byte) error {
+	controller := pad.Controller()
+	controller.outputMutex.Lock()
+	controller.Lightbar = [3]byte{r, g, b}
+	controller.outputMutex.Unlock()
+
+	return pad.WriteOutput()
+}
+
+func runPlayStationController(ctx context.Context, DeviceInfo *hid.DeviceInfo, pad playStationPad) {
+	device, err := OpenDevice(DeviceInfo)
+	if err != nil {
+		NotifyError("unable to open controller", err.Error())
+		return
+	}
+	defer closeOnCancel(ctx, device)()
+
+	controller := pad.Controller()
+	controller.Name = DeviceInfo.Manufacturer + " " + DeviceInfo.Product
+	controller.Device = device
+	controller.Bluetooth = TransportOf(DeviceInfo) == TransportBluetooth
+	controller.Calibration = DefaultIMUCalibration()
+	controller.Lightbar = [3]byte{0x00, 0x00, 0x40}
+	err = pad.Init()
+	if err != nil {
+		NotifyError("unable to init controller", err.Error())
+		return
+	}
+	// Deferred before the virtual pad, so its rumble cannot come back.
+	defer restorePlayStation(pad)
+
+	notifyConnected(controller.Name, " Connected")
+
+	emulator, err := NewEmulator(func(vibration Vibration) {
+		controller.outputMutex.Lock()
+		controller.Rumble = vibration
+		controller.outputMutex.Unlock()
+		pad.WriteOutput()
+	})
+	if err != nil {
+		NotifyError("unable to start ViGEm client", err.Error())
+		return
+	}
+	defer emulator.Close()
+
+	ctr, err := emulator.CreateXbox360Controller()
+	if err != nil {
+		NotifyError("unable to create emulated Xbox 360 controller", err.Error())
+		return
+	}
+	defer ctr.Close()
+
+	err = ctr.Connect()
+	if err != nil {
+		NotifyError("unable to connect to emulated Xbox 360 controller", err.Error())
+		return
+	}
+	defer ctr.Disconnect()
+
+	kind := "DualShock 4"
+	if _, ok := pad.(*DualSense); ok {
+		kind = "DualSense"
+	}
+	session := NewSession(controller.Name, kind, TransportOf(DeviceInfo), DeviceInfo.Path)
+	session.SetDevice(pad)
+	defer session.Close()
+
+	profile, err := LoadProfile(HIDProfileKey(DeviceInfo))
+	if err != nil {
+		NotifyError(controller.Name, "unable to load profile: "+err.Error())
+	}
+	pipeline := profile.NewPipeline(controller.Name, ctr, pad)
+	session.SetPipeline(pipeline)
+	defer pipeline.Close()
+
+	for ctx.Err() == nil {
+		raw_buf, err := controller.Device.Read()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			session.Log.Error("read failed", "err", err)
+			NotifyError(controller.Name, err.Error())
+			return
+		}
+		readAt := time.Now()
+		if len(raw_buf) < 10 {
+			session.Log.Info("disconnected", "report", len(raw_buf))
+			notifyDisconnected(controller.Name)
+			return
+		}
+
+		state, err := pad.ParseInput(raw_buf)
+		if err != nil {
+			session.Log.Debug("bad input report", "err", err)
+			countDecodeError(session.Kind)
+			continue
+		}
+
+		session.SetBattery(BatteryStatus{
+			Percent:    int(state.Battery),
+			Charging:   state.Charging,
+			USBPowered: !controller.Bluetooth,
+		})
+
+		report := Xbox360ControllerReport{}
+		report.SetFromPlayStation(&state)
+		pipeline.SendInput(&report, state.extra())
+		session.Telemetry.HIDToSend(readAt, time.Now())
+	}
+}
+
+// restorePlayStation stops the rumble and turns the lights off before the
+// pad is let go.
+func restorePlayStation(pad playStationPad) error {
+	controller := pad.Controller()
+	controller.outputMutex.Lock()
+	controller.Rumble = Vibration{}
+	controller.Lightbar = [3]byte{}
+	if ds, ok := pad.(*DualSense); ok {
+		ds.PlayerLEDs = 0
+	}
+	controller.outputMutex.Unlock()
+
+	return pad.WriteOutput()
+}
+
+// extra returns the extra inputs of the state.
+func (state *PlayStationState) extra() uint32 {
+	var extra uint32
+	if state.Pressed(PlayStationButtonTouchpad) {
+		extra |= 1 << playStationExtraTouchpad
+	}
+	if state.Pressed(PlayStationButtonMute) {
+		extra |= 1 << playStationExtraMute
+	}
+	return extra
+}
+
+func (report *Xbox360ControllerReport) SetFromPlayStation(state *PlayStationState) {
+	report.MaybeSetButton(Xbox360ControllerButtonA, state.Pressed(PlayStationButtonCross))
+	report.MaybeSetButton(Xbox360ControllerButtonB, state.Pressed(PlayStationButtonCircle))
+	report.MaybeSetButton(Xbox360ControllerButtonX, state.Pressed(PlayStationButtonSquare))
+	report.MaybeSetButton(Xbox360ControllerButtonY, state.Pressed(PlayStationButtonTriangle))
+	report.MaybeSetButton(Xbox360ControllerButtonLeftShoulder, state.Pressed(PlayStationButtonL1))
+	report.MaybeSetButton(Xbox360ControllerButtonRightShoulder, state.Pressed(PlayStationButtonR1))
+	report.MaybeSetButton(Xbox360ControllerButtonBack, state.Pressed(PlayStationButtonShare))
+	report.MaybeSetButton(Xbox360ControllerButtonStart, state.Pressed(PlayStationButtonOptions))
+	report.MaybeSetButton(Xbox360ControllerButtonLeftThumb, state.Pressed(PlayStationButtonL3))
+	report.MaybeSetButton(Xbox360ControllerButtonRightThumb, state.Pressed(PlayStationButtonR3))
+	report.MaybeSetButton(Xbox360ControllerButtonGuide, state.Pressed(PlayStationButtonPS))
+
+	// The hat counts clockwise from up, 8 is released.
+	if state.Hat < playStationHatNeutral {
+		report.MaybeSetButton(Xbox360ControllerButtonUp, state.Hat == 7 || state.Hat <= 1)
+		report.MaybeSetButton(Xbox360ControllerButtonRight, state.Hat >= 1 && state.Hat <= 3)
+		report.MaybeSetButton(Xbox360ControllerButtonDown, state.Hat >= 3 && state.Hat <= 5)
+		report.MaybeSetButton(Xbox360ControllerButtonLeft, state.Hat >= 5 && state.Hat <= 7)
+	}
+
+	report.SetLeftTrigger(state.L2)
+	report.SetRightTrigger(state.R2)
+
+	// Stick Y axes grow downwards.
+	report.SetLeftThumb(StickToInt16((float32(state.LeftX)-128)/127), StickToInt16((128-float32(state.LeftY))/127))
+	report.SetRightThumb(StickToInt16((float32(state.RightX)-128)/127), StickToInt16((128-float32(state.RightY))/127))
+}
@@ -0,0 +1,195 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/boombuler/hid"
+)
+
+// Profile holds the settings of one controller, kept in the data directory
+// under its device key.
+type Profile struct {
+	Key  string `json:"-"`
+	Name string `json:"name,omitempty"`
+
+	LeftTrigger  TriggerSettings `json:"leftTrigger"`
+	RightTrigger TriggerSettings `json:"rightTrigger"`
+	FaceButtons  LayoutPolicy    `json:"faceButtons"`
+	Remap        *RemapConfig    `json:"remap,omitempty"`
+
+	ButtonModes map[string]ButtonModeSettings `json:"buttonModes,omitempty"`
+	// Macros maps buttons to the name of the macro they play.
+	Macros map[string]string `json:"macros,omitempty"`
+	// Script names a Lua script of the scripts directory.
+	Script string `json:"script,omitempty"`
+	// OutputRate is the number of reports sent to the virtual pad each
+	// second, DefaultOutputRate when unset.
+	OutputRate int `json:"outputRate,omitempty"`
+}
+
+// NewPipeline builds the output pipeline of a session using the profile.
+// The device of the session receives the feedback of the script and of
+// layout switches. Sources with Nintendo labels set NintendoLabels of the
+// layout.
+func (profile *Profile) NewPipeline(name string, sink ReportSink, device interface{}) *Pipeline {
+	pipeline := NewPipeline(sink, profile.Modes(name), profile.OutputRate)
+	pipeline.Layout = &LayoutSwitcher{Policy: profile.FaceButtons}
+	inputs := Xbox360Target
+	if source, ok := device.(RemapInputs); ok {
+		inputs = source.Inputs()
+	}
+	pipeline.Remapper = profile.Remapper(name, inputs)
+	if profile.LeftTrigger.Mode != TriggerDigital {
+		pipeline.LeftTrigger = NewTriggerEmulator(profile.LeftTrigger)
+	}
+	if profile.RightTrigger.Mode != TriggerDigital {
+		pipeline.RightTrigger = NewTriggerEmulator(profile.RightTrigger)
+	}
+	pipeline.OnLayout = func(policy LayoutPolicy) {
+		err := profile.SaveLayout(policy)
+		if err != nil {
+			NotifyError(name, "unable to save profile: "+err.Error())
+		}
+		NotifyInfo(name, "Button layout: "+policy.Layout.String())
+		if pad, ok := device.(PlayerLEDControl); ok {
+			go layoutCue(pad, policy.Layout)
+		}
+	}
+	if profile.Script != "" {
+		script, err := LoadScript(profile.Script, name, device)
+		if err != nil {
+			NotifyError(name, "unable to load script "+profile.Script+": "+err.Error())
+		} else {
+			pipeline.Script = script
+		}
+	}
+	for button, macro := range profile.Macros {
+		control, err := Xbox360Target.control(button)
+		if err != nil || control.Axis {
+			NotifyWarning(name, "macro "+macro+" is bound to "+button+", which is not a button")
+			continue
+		}
+		// Loaded now so pressing the button does not read the disk. A
+		// macro saved later through the admin API is cached then.
+		if _, err := LoadMacro(macro); err != nil {
+			NotifyWarning(name, "unable to load macro "+macro+": "+err.Error())
+		}
+		if pipeline.Bindings == nil {
+			pipeline.Bindings = make(map[int]string)
+		}
+		pipeline.Bindings[control.Index] = macro
+	}
+	return pipeline
+}
+
+// Modes builds the turbo and toggle modes of the profile, or returns nil
+// when it has none or invalid ones.
+func (profile *Profile) Modes(name string) *ButtonModes {
+	if len(profile.ButtonModes) == 0 {
+		return nil
+	}
+
+	modes, err := NewButtonModes(profile.ButtonModes, Xbox360Target, profile.OutputRate)
+	if err != nil {
+		NotifyWarning(name, "button modes disabled: "+err.Error())
+		return nil
+	}
+	return modes
+}
+
+// Remapper builds the remapper of the profile from the inputs of a source
+// to the Xbox 360 target, or returns nil when it has no remapping or an
+// invalid one.
+func (profile *Profile) Remapper(name string, inputs *OutputTarget) *Remapper {
+	if profile.Remap == nil {
+		return nil
+	}
+
+	remapper, err := NewRemapper(profile.Remap, inputs, Xbox360Target)
+	if err != nil {
+		NotifyWarning(name, "remapping disabled: "+err.Error())
+		return nil
+	}
+	return remapper
+}
+
+// SaveLayout stores a layout switched at runtime, when the profile belongs
+// to a known device.
+func (profile *Profile) SaveLayout(policy LayoutPolicy) error {
+	profile.FaceButtons = policy
+	if profile.Key == "" {
+		return nil
+	}
+	return profile.Save()
+}
+
+// HIDProfileKey is the profile key of a HID pad the server cannot read a
+// serial number from. Such pads share a profile per model.
+func HIDProfileKey(DeviceInfo *hid.DeviceInfo) string {
+	return fmt.Sprintf("hid %04x:%04x", DeviceInfo.VendorId, DeviceInfo.ProductId)
+}
+
+func profilePath(key string) (string, error) {
+	return DataPath("profiles", SafeFileName(key)+".json")
+}
+
+// LoadProfile returns the profile of a controller, or an empty profile if
+// it has none.
+func LoadProfile(key string) (*Profile, error) {
+	profile := &Profile{Key: key}
+	if key == "" {
+		return profile, nil
+	}
+
+	path, err := profilePath(key)
+	if err != nil {
+		return profile, err
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return profile, nil
+	}
+	if err != nil {
+		return profile, err
+	}
+
+	err = json.Unmarshal(data, profile)
+	if err != nil {
+		return profile, err
+	}
+	return profile, profile.validate()
+}
+
+// validate checks the settings that are used as they are, and puts back
+// the defaults of the invalid ones.
+func (profile *Profile) validate() error {
+	var errs []error
+	for _, trigger := range []struct {
+		name     string
+		settings *TriggerSettings
+	}{{"left trigger", &profile.LeftTrigger}, {"right trigger", &profile.RightTrigger}} {
+		err := trigger.settings.Validate()
+		if err != nil {
+			*trigger.settings = TriggerSettings{}
+			errs = append(errs, fmt.Errorf("%s: %w", trigger.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (profile *Profile) Save() error {
+	path, err := profilePath(profile.Key)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(profile, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
@@ -0,0 +1,375 @@
+package controller
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Input recordings keep the normalized input of a session, as sent into its
+// pipeline, so a problem can be replayed without the controller. The file
+// is
+//
+//	"GPREC" version                  magic and format version 2
+//	uint32 length, JSON header       RecordingHeader
+//	frames until the end             uvarint µs since the previous frame,
+//	                                 12 bytes of report, then uint32 extra
+//
+// A report is buttons uint16, left and right trigger bytes, then left X,
+// left Y, right X and right Y int16, all little endian. Extra is the bitmask
+// of the extra inputs of the source, by their index in its inputs. Version
+// 1 frames have no extra. Times come from the monotonic clock.
+const (
+	recordingMagic   = "GPREC"
+	recordingVersion = 2
+
+	recordedReportSize = 12
+	recordedFrameSize  = recordedReportSize + 4
+	maxRecordingHeader = 1 << 20
+
+	// Frames waiting for the writer of a recorder.
+	recorderBufferSize = 1024
+)
+
+var ErrBadRecording = errors.New("not an input recording")
+
+type RecordingHeader struct {
+	Session  SessionInfo `json:"session"`
+	Recorded time.Time   `json:"recorded"`
+}
+
+type RecordedFrame struct {
+	At     time.Duration
+	Report Xbox360ControllerReport
+	Extra  uint32
+}
+
+// Recording is an input recording read back into memory.
+type Recording struct {
+	Header RecordingHeader
+	Frames []RecordedFrame
+}
+
+func (recording *Recording) Duration() time.Duration {
+	if len(recording.Frames) == 0 {
+		return 0
+	}
+	return recording.Frames[len(recording.Frames)-1].At
+}
+
+func encodeRecordedReport(buf []byte, report *Xbox360ControllerReport) {
+	lx, ly := report.GetLeftThumb()
+	rx, ry := report.GetRightThumb()
+	binary.LittleEndian.PutUint16(buf[0:], report.GetButtons())
+	buf[2] = report.GetLeftTrigger()
+	buf[3] = report.GetRightTrigger()
+	binary.LittleEndian.PutUint16(buf[4:], uint16(lx))
+	binary.LittleEndian.PutUint16(buf[6:], uint16(ly))
+	binary.LittleEndian.PutUint16(buf[8:], uint16(rx))
+	binary.LittleEndian.PutUint16(buf[10:], uint16(ry))
+}
+
+func decodeRecordedReport(buf []byte) Xbox360ControllerReport {
+	report := NewXbox360ControllerReport()
+	report.SetButtons(binary.LittleEndian.Uint16(buf[0:]))
+	report.SetLeftTrigger(buf[2])
+	report.SetRightTrigger(buf[3])
+	report.SetLeftThumb(int16(binary.LittleEndian.Uint16(buf[4:])), int16(binary.LittleEndian.Uint16(buf[6:])))
+	report.SetRightThumb(int16(binary.LittleEndian.Uint16(buf[8:])), int16(binary.LittleEndian.Uint16(buf[10:])))
+	return report
+}
+
+// InputRecorder writes the frames of a session to an input recording. The
+// frames go through a buffer to a writer goroutine, so recording never
+// makes the pipeline wait for the disk. Frames that find the buffer full
+// are dropped.
+type InputRecorder struct {
+	Path string
+
+	frames  chan recorderFrame
+	done    chan struct{}
+	dropped int
+
+	// Owned by the writer goroutine until done is closed.
+	writer *bufio.Writer
+	closer io.Closer
+	start  time.Time
+	last   time.Duration
+	err    error
+}
+
+type recorderFrame struct {
+	report Xbox360ControllerReport
+	extra  uint32
+	at     time.Time
+}
+
+// NewInputRecorder starts a recording on w and writes its header. Close
+// closes w when it is an io.Closer.
+func NewInputRecorder(w io.Writer, info SessionInfo) (*InputRecorder, error) {
+	header, err := json.Marshal(RecordingHeader{Session: info, Recorded: time.Now()})
+	if err != nil {
+		return nil, err
+	}
+
+	recorder := &InputRecorder{
+		frames: make(chan recorderFrame, recorderBufferSize),
+		done:   make(chan struct{}),
+		writer: bufio.NewWriter(w),
+		start:  time.Now(),
+	}
+	if closer, ok := w.(io.Closer); ok {
+		recorder.closer = closer
+	}
+
+	recorder.writer.WriteString(recordingMagic)
+	recorder.writer.WriteByte(recordingVersion)
+	var size [4]byte
+	binary.LittleEndian.PutUint32(size[:], uint32(len(header)))
+	recorder.writer.Write(size[:])
+	_, err = recorder.writer.Write(header)
+	if err != nil {
+		return nil, err
+	}
+	go recorder.write()
+	return recorder, nil
+}
+
+// CreateInputRecording starts a recording of a session in the recordings
+// directory of the data directory.
+func CreateInputRecording(info SessionInfo) (*InputRecorder, error) {
+	name := SafeFileName(info.Name) + "-" + time.Now().Format("20060102-150405") + ".gprec"
+	path, err := DataPath("recordings", name)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	recorder, err := NewInputRecorder(file, info)
+	if err != nil {
+		file.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	recorder.Path = path
+	return recorder, nil
+}
+
+// Record queues a frame with the extra inputs of the source. It is called
+// from one goroutine and not after Close.
+func (recorder *InputRecorder) Record(report *Xbox360ControllerReport, extra uint32, now time.Time) {
+	select {
+	case recorder.frames <- recorderFrame{*report, extra, now}:
+	default:
+		recorder.dropped++
+	}
+}
+
+// write writes the queued frames until Close. The first write error is
+// kept and returned by Close, later frames are dropped.
+func (recorder *InputRecorder) write() {
+	defer close(recorder.done)
+
+	var buf [binary.MaxVarintLen64 + recordedFrameSize]byte
+	for frame := range recorder.frames {
+		if recorder.err != nil {
+			continue
+		}
+
+		at := frame.at.Sub(recorder.start)
+		if at < recorder.last {
+			at = recorder.last
+		}
+		n := binary.PutUvarint(buf[:], uint64((at-recorder.last)/time.Microsecond))
+		encodeRecordedReport(buf[n:], &frame.report)
+		binary.LittleEndian.PutUint32(buf[n+recordedReportSize:], frame.extra)
+		// Only whole microseconds are written, so the remainder carries over.
+		recorder.last += (at - recorder.last) / time.Microsecond * time.Microsecond
+
+		_, recorder.err = recorder.writer.Write(buf[:n+recordedFrameSize])
+	}
+}
+
+// Close writes the queued frames and closes the recording.
+func (recorder *InputRecorder) Close() error {
+	close(recorder.frames)
+	<-recorder.done
+	if recorder.dropped > 0 {
+		slog.Warn("input recording dropped frames", "path", recorder.Path, "frames", recorder.dropped)
+	}
+
+	err := recorder.err
+	if flushErr := recorder.writer.Flush(); err == nil {
+		err = flushErr
+	}
+	if recorder.closer != nil {
+		if closeErr := recorder.closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// ReadRecording reads a whole input recording.
+func ReadRecording(r io.Reader) (*Recording, error) {
+	reader := bufio.NewReader(r)
+
+	var prefix [len(recordingMagic) + 1 + 4]byte
+	_, err := io.ReadFull(reader, prefix[:])
+	if err != nil || string(prefix[:len(recordingMagic)]) != recordingMagic {
+		return nil, ErrBadRecording
+	}
+	frameSize := recordedFrameSize
+	switch prefix[len(recordingMagic)] {
+	case recordingVersion:
+	case 1:
+		frameSize = recordedReportSize
+	default:
+		return nil, errors.New("unsupported input recording version")
+	}
+	size := binary.LittleEndian.Uint32(prefix[len(recordingMagic)+1:])
+	if size > maxRecordingHeader {
+		return nil, ErrBadRecording
+	}
+
+	header := make([]byte, size)
+	_, err = io.ReadFull(reader, header)
+	if err != nil {
+		return nil, ErrBadRecording
+	}
+	recording := &Recording{}
+	err = json.Unmarshal(header, &recording.Header)
+	if err != nil {
+		return nil, err
+	}
+
+	var at time.Duration
+	var buf [recordedFrameSize]byte
+	for {
+		delta, err := binary.ReadUvarint(reader)
+		if err == io.EOF {
+			return recording, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.ReadFull(reader, buf[:frameSize])
+		if err != nil {
+			// A recording cut short by a crash keeps its whole frames.
+			return recording, nil
+		}
+		at += time.Duration(delta) * time.Microsecond
+		frame := RecordedFrame{At: at, Report: decodeRecordedReport(buf[:])}
+		if frameSize == recordedFrameSize {
+			frame.Extra = binary.LittleEndian.Uint32(buf[recordedReportSize:])
+		}
+		recording.Frames = append(recording.Frames, frame)
+	}
+}
+
+func LoadRecording(path string) (*Recording, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ReadRecording(file)
+}
+
+// ReplayOptions control Replay. Speed scales the recorded time, 2 plays
+// twice as fast and 0 or less sends the frames without waiting, which keeps
+// regression tests fast.
+type ReplayOptions struct {
+	Speed float64
+	Loop  bool
+}
+
+// InputSink is a ReportSink that also takes the extra inputs of a source,
+// like a Pipeline.
+type InputSink interface {
+	SendInput(report *Xbox360ControllerReport, extra uint32) error
+}
+
+// Replay sends the frames of a recording to a sink at their recorded times
+// until the recording ends, or until ctx is done when looping. Replaying
+// into a Pipeline runs the frames through its button modes, macros and
+// script like live input, its pump coalesces frames sent faster than its
+// rate. Only an InputSink gets the extra inputs.
+func (recording *Recording) Replay(ctx context.Context, sink ReportSink, options ReplayOptions) error {
+	if len(recording.Frames) == 0 {
+		return nil
+	}
+
+	for {
+		start := time.Now()
+		for _, frame := range recording.Frames {
+			if options.Speed > 0 {
+				wait := time.Duration(float64(frame.At)/options.Speed) - time.Since(start)
+				if wait > 0 {
+					select {
+					case <-time.After(wait):
+					case <-ctx.Done():
+						return ctx.Err()
+					}
+				}
+			} else if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			report := frame.Report
+			var err error
+			if input, ok := sink.(InputSink); ok {
+				err = input.SendInput(&report, frame.Extra)
+			} else {
+				err = sink.Send(&report)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if !options.Loop {
+			return nil
+		}
+	}
+}
+
+// MemorySink keeps the reports sent to it, as a stand-in for the emulated
+// controller.
+type MemorySink struct {
+	mutex   sync.Mutex
+	reports []Xbox360ControllerReport
+}
+
+func (sink *MemorySink) Send(report *Xbox360ControllerReport) error {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	sink.reports = append(sink.reports, *report)
+	return nil
+}
+
+// Reports returns a copy of the reports sent so far.
+func (sink *MemorySink) Reports() []Xbox360ControllerReport {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	return append([]Xbox360ControllerReport(nil), sink.reports...)
+}
+
+func (sink *MemorySink) Reset() {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	sink.reports = nil
+}
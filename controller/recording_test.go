@@ -0,0 +1,83 @@
+package controller
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestInputRecorderRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	info := SessionInfo{Name: "Pro Controller", Kind: "Pro Controller"}
+	recorder, err := NewInputRecorder(&buf, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := recorder.start
+	var want []RecordedFrame
+	for i := 0; i < 2*recorderBufferSize; i++ {
+		report := NewXbox360ControllerReport()
+		report.SetButtons(uint16(i))
+		report.SetLeftThumb(int16(i*7), -int16(i))
+		at := time.Duration(i) * 4 * time.Millisecond
+		recorder.Record(&report, uint32(i)<<16, start.Add(at))
+		want = append(want, RecordedFrame{At: at, Report: report, Extra: uint32(i) << 16})
+		if i%64 == 0 {
+			// Lets the writer keep up, frames finding the buffer full
+			// would be dropped.
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if recorder.dropped > 0 {
+		t.Skipf("%d frames dropped on a slow machine", recorder.dropped)
+	}
+
+	recording, err := ReadRecording(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recording.Header.Session.Name != info.Name {
+		t.Errorf("header %+v", recording.Header)
+	}
+	if len(recording.Frames) != len(want) {
+		t.Fatalf("%d frames, want %d", len(recording.Frames), len(want))
+	}
+	for i, frame := range recording.Frames {
+		if frame != want[i] {
+			t.Fatalf("frame %d is %+v, want %+v", i, frame, want[i])
+		}
+	}
+}
+
+// Version 1 recordings, from before the extra inputs, still read.
+func TestReadRecordingVersion1(t *testing.T) {
+	report := NewXbox360ControllerReport()
+	report.SetButtons(1 << Xbox360ControllerButtonA)
+	report.SetLeftThumb(-1234, 5678)
+	var frame [recordedReportSize]byte
+	encodeRecordedReport(frame[:], &report)
+
+	var buf bytes.Buffer
+	header := []byte(`{"session":{"name":"Pro Controller","kind":"Pro Controller"}}`)
+	buf.WriteString(recordingMagic)
+	buf.WriteByte(1)
+	buf.Write([]byte{byte(len(header)), 0, 0, 0})
+	buf.Write(header)
+	for i := 0; i < 2; i++ {
+		buf.WriteByte(100)
+		buf.Write(frame[:])
+	}
+
+	recording, err := ReadRecording(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := RecordedFrame{At: 200 * time.Microsecond, Report: report}
+	if len(recording.Frames) != 2 || recording.Frames[1] != want {
+		t.Errorf("frames %+v, want two ending with %+v", recording.Frames, want)
+	}
+}
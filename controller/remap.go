@@ -0,0 +1,451 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrUnknownControl = errors.New("unknown control")
+	ErrBadRemapRule   = errors.New("invalid remap rule")
+)
+
+// Axes of ControlState, sticks go from -1 to 1 with Y up and triggers from
+// 0 to 1.
+const (
+	AxisLeftX = iota
+	AxisLeftY
+	AxisRightX
+	AxisRightY
+	AxisLeftTrigger
+	AxisRightTrigger
+	axisCount
+)
+
+// ControlState is a report of the output target in a form the remapper can
+// work on. Extra holds the buttons of the source the report has no place
+// for, by their index in the inputs of the source.
+type ControlState struct {
+	Buttons uint16
+	Axes    [axisCount]float32
+	Extra   uint32
+}
+
+func (state *ControlState) Pressed(button int) bool {
+	return state.Buttons&(1<<uint(button)) != 0
+}
+
+func (state *ControlState) pressedControl(control Control) bool {
+	if control.Extra {
+		return state.Extra&(1<<uint(control.Index)) != 0
+	}
+	return state.Pressed(control.Index)
+}
+
+func (state *ControlState) Press(button int) {
+	state.Buttons |= 1 << uint(button)
+}
+
+func StateFromReport(report *Xbox360ControllerReport) ControlState {
+	state := ControlState{Buttons: report.GetButtons()}
+	lx, ly := report.GetLeftThumb()
+	rx, ry := report.GetRightThumb()
+	state.Axes[AxisLeftX] = float32(lx) / 32767
+	state.Axes[AxisLeftY] = float32(ly) / 32767
+	state.Axes[AxisRightX] = float32(rx) / 32767
+	state.Axes[AxisRightY] = float32(ry) / 32767
+	state.Axes[AxisLeftTrigger] = float32(report.GetLeftTrigger()) / 255
+	state.Axes[AxisRightTrigger] = float32(report.GetRightTrigger()) / 255
+	return state
+}
+
+func (state *ControlState) Report() Xbox360ControllerReport {
+	report := NewXbox360ControllerReport()
+	report.SetButtons(state.Buttons)
+	report.SetLeftThumb(StickToInt16(state.Axes[AxisLeftX]), StickToInt16(state.Axes[AxisLeftY]))
+	report.SetRightThumb(StickToInt16(state.Axes[AxisRightX]), StickToInt16(state.Axes[AxisRightY]))
+	report.SetLeftTrigger(triggerToByte(state.Axes[AxisLeftTrigger]))
+	report.SetRightTrigger(triggerToByte(state.Axes[AxisRightTrigger]))
+	return report
+}
+
+func triggerToByte(v float32) byte {
+	if v <= 0 {
+		return 0
+	}
+	if v >= 1 {
+		return 255
+	}
+	return byte(v * 255)
+}
+
+// Control is a button or an axis of an output target. Extra buttons only
+// exist on sources, see ControlState.
+type Control struct {
+	Axis  bool
+	Extra bool
+	Index int
+}
+
+func (control Control) isTrigger() bool {
+	return control.Axis && (control.Index == AxisLeftTrigger || control.Index == AxisRightTrigger)
+}
+
+// OutputTarget lists the controls of an emulated controller, or the inputs
+// of a source. Remap rules read the inputs of the source and write the
+// controls of the target.
+type OutputTarget struct {
+	Name     string
+	Controls map[string]Control
+}
+
+// maxExtraInputs is the number of extra buttons ControlState holds.
+const maxExtraInputs = 32
+
+// sourceInputs lists the inputs of a source, which has the controls of the
+// Xbox 360 target as the report is built, and the extra buttons numbered in
+// order.
+func sourceInputs(name string, extra ...string) *OutputTarget {
+	if len(extra) > maxExtraInputs {
+		panic("too many extra inputs for " + name)
+	}
+	inputs := &OutputTarget{Name: name, Controls: make(map[string]Control)}
+	for control, value := range Xbox360Target.Controls {
+		inputs.Controls[control] = value
+	}
+	for i, control := range extra {
+		inputs.Controls[control] = Control{Extra: true, Index: i}
+	}
+	return inputs
+}
+
+// RemapInputs is implemented by the devices of sessions that have inputs
+// besides those of the Xbox 360 target.
+type RemapInputs interface {
+	Inputs() *OutputTarget
+}
+
+var Xbox360Target = &OutputTarget{
+	Name: "Xbox 360",
+	Controls: map[string]Control{
+		"A":             {Index: Xbox360ControllerButtonA},
+		"B":             {Index: Xbox360ControllerButtonB},
+		"X":             {Index: Xbox360ControllerButtonX},
+		"Y":             {Index: Xbox360ControllerButtonY},
+		"Up":            {Index: Xbox360ControllerButtonUp},
+		"Down":          {Index: Xbox360ControllerButtonDown},
+		"Left":          {Index: Xbox360ControllerButtonLeft},
+		"Right":         {Index: Xbox360ControllerButtonRight},
+		"Start":         {Index: Xbox360ControllerButtonStart},
+		"Back":          {Index: Xbox360ControllerButtonBack},
+		"Guide":         {Index: Xbox360ControllerButtonGuide},
+		"LeftThumb":     {Index: Xbox360ControllerButtonLeftThumb},
+		"RightThumb":    {Index: Xbox360ControllerButtonRightThumb},
+		"LeftShoulder":  {Index: Xbox360ControllerButtonLeftShoulder},
+		"RightShoulder": {Index: Xbox360ControllerButtonRightShoulder},
+		"LeftX":         {Axis: true, Index: AxisLeftX},
+		"LeftY":         {Axis: true, Index: AxisLeftY},
+		"RightX":        {Axis: true, Index: AxisRightX},
+		"RightY":        {Axis: true, Index: AxisRightY},
+		"LeftTrigger":   {Axis: true, Index: AxisLeftTrigger},
+		"RightTrigger":  {Axis: true, Index: AxisRightTrigger},
+	},
+}
+
+// RemapRule sends the input From as the output To.
+//
+// A button mapped to an axis moves the axis to Value, 1 when unset. An
+// axis mapped to a button presses it past Threshold, which is 0.5 when
+// unset and negative for the negative direction. Axes mapped to axes are
+// copied, inverted with Invert. Triggers cannot be inverted.
+type RemapRule struct {
+	From      string  `json:"from"`
+	To        string  `json:"to"`
+	Value     float32 `json:"value,omitempty"`
+	Threshold float32 `json:"threshold,omitempty"`
+	Invert    bool    `json:"invert,omitempty"`
+}
+
+// ChordRule presses To while all Buttons are held, instead of them.
+type ChordRule struct {
+	Buttons []string `json:"buttons"`
+	To      string   `json:"to"`
+}
+
+// RemapConfig is the remap part of a profile. Controls without a rule keep
+// their input. While Shift is held, the Shifted rules replace the Base
+// rules of the same inputs and Shift itself is not sent.
+type RemapConfig struct {
+	Base    []RemapRule `json:"base,omitempty"`
+	Shift   string      `json:"shift,omitempty"`
+	Shifted []RemapRule `json:"shifted,omitempty"`
+	Chords  []ChordRule `json:"chords,omitempty"`
+}
+
+func (target *OutputTarget) control(name string) (Control, error) {
+	control, ok := target.Controls[name]
+	if !ok {
+		return Control{}, fmt.Errorf("%w %q on %s", ErrUnknownControl, name, target.Name)
+	}
+	return control, nil
+}
+
+// Validate checks that every input of the configuration exists on the
+// source and every output on the target.
+func (config *RemapConfig) Validate(inputs, target *OutputTarget) error {
+	for _, rules := range [][]RemapRule{config.Base, config.Shifted} {
+		for _, rule := range rules {
+			if _, err := inputs.control(rule.From); err != nil {
+				return err
+			}
+			to, err := target.control(rule.To)
+			if err != nil {
+				return err
+			}
+			if rule.Value < -1 || rule.Value > 1 || rule.Threshold < -1 || rule.Threshold > 1 {
+				return fmt.Errorf("%w: %s to %s out of range", ErrBadRemapRule, rule.From, rule.To)
+			}
+			if rule.Invert && to.isTrigger() {
+				return fmt.Errorf("%w: %s to %s, triggers cannot be inverted", ErrBadRemapRule, rule.From, rule.To)
+			}
+		}
+	}
+
+	if config.Shift != "" {
+		control, err := inputs.control(config.Shift)
+		if err != nil {
+			return err
+		}
+		if control.Axis {
+			return fmt.Errorf("%w: shift %s is not a button", ErrBadRemapRule, config.Shift)
+		}
+	}
+
+	for _, chord := range config.Chords {
+		if len(chord.Buttons) < 2 {
+			return fmt.Errorf("%w: chord needs two buttons", ErrBadRemapRule)
+		}
+		for i, name := range append(chord.Buttons, chord.To) {
+			controls := inputs
+			if i == len(chord.Buttons) {
+				controls = target
+			}
+			control, err := controls.control(name)
+			if err != nil {
+				return err
+			}
+			if control.Axis {
+				return fmt.Errorf("%w: chord control %s is not a button", ErrBadRemapRule, name)
+			}
+		}
+	}
+
+	return nil
+}
+
+type compiledRule struct {
+	RemapRule
+	from Control
+	to   Control
+}
+
+// compiledChord holds the buttons of a chord as a ControlState.
+type compiledChord struct {
+	buttons ControlState
+	to      int
+}
+
+// Remapper applies a validated RemapConfig to reports.
+type Remapper struct {
+	base     []compiledRule
+	shifted  []compiledRule
+	shift    Control
+	hasShift bool
+	chords   []compiledChord
+}
+
+// NewRemapper builds the remapper of a configuration reading the inputs of
+// a source and writing the controls of target.
+func NewRemapper(config *RemapConfig, inputs, target *OutputTarget) (*Remapper, error) {
+	err := config.Validate(inputs, target)
+	if err != nil {
+		return nil, err
+	}
+
+	remapper := &Remapper{}
+	compile := func(rules []RemapRule) []compiledRule {
+		compiled := make([]compiledRule, 0, len(rules))
+		for _, rule := range rules {
+			compiled = append(compiled, compiledRule{rule, inputs.Controls[rule.From], target.Controls[rule.To]})
+		}
+		return compiled
+	}
+	remapper.base = compile(config.Base)
+	remapper.shifted = compile(config.Shifted)
+	if config.Shift != "" {
+		remapper.shift = inputs.Controls[config.Shift]
+		remapper.hasShift = true
+	}
+	for _, chord := range config.Chords {
+		compiled := compiledChord{to: target.Controls[chord.To].Index}
+		for _, name := range chord.Buttons {
+			compiled.buttons.press(inputs.Controls[name])
+		}
+		remapper.chords = append(remapper.chords, compiled)
+	}
+
+	return remapper, nil
+}
+
+// press presses a button of the source.
+func (state *ControlState) press(control Control) {
+	if control.Extra {
+		state.Extra |= 1 << uint(control.Index)
+	} else {
+		state.Press(control.Index)
+	}
+}
+
+// Apply remaps a report in place. extra holds the extra buttons of the
+// source, which are dropped when no rule reads them.
+func (remapper *Remapper) Apply(report *Xbox360ControllerReport, extra uint32) {
+	in := StateFromReport(report)
+	in.Extra = extra
+	out := ControlState{}
+
+	// Buttons of consumed are not passed through.
+	var consumed ControlState
+	var consumedAxes [axisCount]bool
+	consume := func(control Control) {
+		if control.Axis {
+			consumedAxes[control.Index] = true
+		} else {
+			consumed.press(control)
+		}
+	}
+
+	rules := remapper.base
+	if remapper.hasShift && in.pressedControl(remapper.shift) {
+		consume(remapper.shift)
+		rules = remapper.layer()
+	}
+
+	for _, chord := range remapper.chords {
+		if in.Buttons&chord.buttons.Buttons == chord.buttons.Buttons && in.Extra&chord.buttons.Extra == chord.buttons.Extra {
+			out.Press(chord.to)
+			consumed.Buttons |= chord.buttons.Buttons
+			consumed.Extra |= chord.buttons.Extra
+		}
+	}
+
+	var active []compiledRule
+	for _, rule := range rules {
+		if rule.from.Axis || !consumed.pressedControl(rule.from) {
+			active = append(active, rule)
+		}
+	}
+	for _, rule := range active {
+		consume(rule.from)
+	}
+
+	out.Buttons |= in.Buttons &^ consumed.Buttons
+	for axis := range in.Axes {
+		if !consumedAxes[axis] {
+			out.Axes[axis] = in.Axes[axis]
+		}
+	}
+
+	for _, rule := range active {
+		rule.apply(&in, &out)
+	}
+
+	// Axes that come out as they went in keep their raw value, which the
+	// round trip through ControlState could move by one.
+	raw := *report
+	*report = out.Report()
+	for axis := range out.Axes {
+		if out.Axes[axis] == in.Axes[axis] {
+			copyAxis(report, &raw, axis)
+		}
+	}
+}
+
+func copyAxis(dst, src *Xbox360ControllerReport, axis int) {
+	lx, ly := dst.GetLeftThumb()
+	rx, ry := dst.GetRightThumb()
+	srcLX, srcLY := src.GetLeftThumb()
+	srcRX, srcRY := src.GetRightThumb()
+	switch axis {
+	case AxisLeftX:
+		dst.SetLeftThumb(srcLX, ly)
+	case AxisLeftY:
+		dst.SetLeftThumb(lx, srcLY)
+	case AxisRightX:
+		dst.SetRightThumb(srcRX, ry)
+	case AxisRightY:
+		dst.SetRightThumb(rx, srcRY)
+	case AxisLeftTrigger:
+		dst.SetLeftTrigger(src.GetLeftTrigger())
+	case AxisRightTrigger:
+		dst.SetRightTrigger(src.GetRightTrigger())
+	}
+}
+
+// layer is the shifted rules followed by the base rules of the inputs the
+// shifted layer leaves alone.
+func (remapper *Remapper) layer() []compiledRule {
+	rules := append([]compiledRule(nil), remapper.shifted...)
+	for _, rule := range remapper.base {
+		overridden := false
+		for _, shifted := range remapper.shifted {
+			if shifted.from == rule.from {
+				overridden = true
+				break
+			}
+		}
+		if !overridden {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+func (rule *compiledRule) apply(in, out *ControlState) {
+	switch {
+	case !rule.from.Axis && !rule.to.Axis:
+		if in.pressedControl(rule.from) {
+			out.Press(rule.to.Index)
+		}
+	case !rule.from.Axis && rule.to.Axis:
+		if in.pressedControl(rule.from) {
+			value := rule.Value
+			if value == 0 {
+				value = 1
+			}
+			mergeAxis(out, rule.to.Index, value)
+		}
+	case rule.from.Axis && !rule.to.Axis:
+		threshold := rule.Threshold
+		if threshold == 0 {
+			threshold = 0.5
+		}
+		value := in.Axes[rule.from.Index]
+		if threshold > 0 && value >= threshold || threshold < 0 && value <= threshold {
+			out.Press(rule.to.Index)
+		}
+	default:
+		value := in.Axes[rule.from.Index]
+		if rule.Invert {
+			value = -value
+		}
+		mergeAxis(out, rule.to.Index, value)
+	}
+}
+
+// mergeAxis keeps the larger deflection when several inputs drive an axis.
+func mergeAxis(state *ControlState, axis int, value float32) {
+	current := state.Axes[axis]
+	if value*value > current*current {
+		state.Axes[axis] = value
+	}
+}
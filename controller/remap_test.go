@@ -0,0 +1,101 @@
+package controller
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRemapValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		inputs *OutputTarget
+		config RemapConfig
+		err    error
+	}{
+		{"button", Xbox360Target, RemapConfig{Base: []RemapRule{{From: "A", To: "B"}}}, nil},
+		{"rail button", JoyConInputs, RemapConfig{Base: []RemapRule{{From: "LeftSL", To: "LeftShoulder"}}}, nil},
+		{"rail button on Xbox input", Xbox360Target, RemapConfig{Base: []RemapRule{{From: "LeftSL", To: "LeftShoulder"}}}, ErrUnknownControl},
+		{"extra output", DualSenseInputs, RemapConfig{Base: []RemapRule{{From: "A", To: "Mute"}}}, ErrUnknownControl},
+		{"touchpad shift", DualSenseInputs, RemapConfig{Shift: "Touchpad"}, nil},
+		{"generic chord", GenericHIDInputs, RemapConfig{Chords: []ChordRule{{Buttons: []string{"Button14", "Button15"}, To: "Guide"}}}, nil},
+		{"axis shift", Xbox360Target, RemapConfig{Shift: "LeftX"}, ErrBadRemapRule},
+		{"inverted stick", Xbox360Target, RemapConfig{Base: []RemapRule{{From: "LeftY", To: "RightY", Invert: true}}}, nil},
+		{"inverted trigger", Xbox360Target, RemapConfig{Base: []RemapRule{{From: "LeftTrigger", To: "RightTrigger", Invert: true}}}, ErrBadRemapRule},
+		{"out of range", Xbox360Target, RemapConfig{Base: []RemapRule{{From: "A", To: "LeftX", Value: 2}}}, ErrBadRemapRule},
+	}
+	for _, test := range tests {
+		err := test.config.Validate(test.inputs, Xbox360Target)
+		if !errors.Is(err, test.err) || (test.err == nil) != (err == nil) {
+			t.Errorf("%s: %v, want %v", test.name, err, test.err)
+		}
+	}
+}
+
+func TestRemapExtraInputs(t *testing.T) {
+	config := &RemapConfig{
+		Base:    []RemapRule{{From: "RightSR", To: "RightShoulder"}, {From: "Capture", To: "Back"}},
+		Shift:   "LeftSL",
+		Shifted: []RemapRule{{From: "A", To: "Guide"}},
+		Chords:  []ChordRule{{Buttons: []string{"LeftSR", "RightSL"}, To: "Y"}},
+	}
+	remapper, err := NewRemapper(config, JoyConInputs, Xbox360Target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	extra := func(names ...string) uint32 {
+		var state ControlState
+		for _, name := range names {
+			state.press(JoyConInputs.Controls[name])
+		}
+		return state.Extra
+	}
+	bit := func(buttons ...int) uint16 {
+		var bits uint16
+		for _, button := range buttons {
+			bits |= 1 << uint(button)
+		}
+		return bits
+	}
+
+	tests := []struct {
+		name    string
+		buttons []int
+		extra   uint32
+		want    uint16
+	}{
+		{"rule", nil, extra("RightSR", "Capture"), bit(Xbox360ControllerButtonRightShoulder, Xbox360ControllerButtonBack)},
+		{"unmapped extra", []int{Xbox360ControllerButtonA}, extra("LeftSR"), bit(Xbox360ControllerButtonA)},
+		{"shift", []int{Xbox360ControllerButtonA}, extra("LeftSL"), bit(Xbox360ControllerButtonGuide)},
+		{"chord", nil, extra("LeftSR", "RightSL"), bit(Xbox360ControllerButtonY)},
+	}
+	for _, test := range tests {
+		report := buttonsReport(test.buttons...)
+		remapper.Apply(report, test.extra)
+		if got := report.GetButtons(); got != test.want {
+			t.Errorf("%s: buttons %04x, want %04x", test.name, got, test.want)
+		}
+	}
+}
+
+// Sticks and triggers without a rule keep their exact value, the remapper
+// does not round them through its float state.
+func TestRemapRawAxes(t *testing.T) {
+	config := &RemapConfig{Base: []RemapRule{{From: "A", To: "B"}, {From: "RightY", To: "RightX"}}}
+	remapper, err := NewRemapper(config, Xbox360Target, Xbox360Target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for value := -32768; value <= 32767; value += 7 {
+		trigger := uint8(value & 0xFF)
+		report := &Xbox360ControllerReport{}
+		report.SetLeftThumb(int16(value), int16(-value-1))
+		report.SetLeftTrigger(trigger)
+		report.SetRightTrigger(^trigger)
+		remapper.Apply(report, 0)
+
+		x, y := report.GetLeftThumb()
+		if x != int16(value) || y != int16(-value-1) || report.GetLeftTrigger() != trigger || report.GetRightTrigger() != ^trigger {
+			t.Fatalf("left thumb %d,%d and triggers %d,%d, want %d,%d and %d,%d", x, y, report.GetLeftTrigger(), report.GetRightTrigger(), value, -value-1, trigger, ^trigger)
+		}
+	}
+}
@@ -0,0 +1,418 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Limits of one call into a script. The Lua VM checks its context before
+// every instruction, which scriptBudget uses to count them.
+const (
+	scriptTimeout         = 5 * time.Millisecond
+	scriptInstructions    = 100000
+	scriptCallStackSize   = 64
+	scriptRegistrySize    = 1024
+	scriptRegistryMaxSize = 64 * 1024
+	// Longest string string.rep builds, which runs as a single instruction.
+	scriptStringSize = 64 * 1024
+)
+
+var ErrScriptInstructions = errors.New("script instruction limit exceeded")
+
+var closedChannel = func() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}()
+
+type scriptBudget struct {
+	context.Context
+	instructions int
+}
+
+func (budget *scriptBudget) Done() <-chan struct{} {
+	budget.instructions--
+	if budget.instructions < 0 {
+		return closedChannel
+	}
+	return budget.Context.Done()
+}
+
+func (budget *scriptBudget) Err() error {
+	if budget.instructions < 0 {
+		return ErrScriptInstructions
+	}
+	return budget.Context.Err()
+}
+
+type scheduledOutput struct {
+	control Control
+	value   float32
+	from    time.Time
+	until   time.Time
+}
+
+// Script is a Lua script run on every frame of a session. It defines
+//
+//	function on_frame(pad)
+//
+// where pad.buttons and pad.axes hold the Xbox 360 controls by name and
+// pad.time the seconds since the script started. Changes to pad are sent.
+// The script can also call
+//
+//	press(button, ms [, delay_ms])       hold a button
+//	move(axis, value, ms [, delay_ms])   hold an axis at a value
+//	led(solid, flash)                    set the player LEDs
+//	notify(text)                         show a notification
+//
+// Only the base, table, string and math libraries are available, with
+// string.rep and the widths of string.format limited. A script that fails
+// or runs over its limits is stopped with a notification.
+type Script struct {
+	Name string
+
+	// mutex serializes the calls into the Lua state. scheduleMutex guards
+	// scheduled, which the pipeline reads while a frame runs.
+	mutex         sync.Mutex
+	state         *lua.LState
+	onFrame       lua.LValue
+	start         time.Time
+	now           time.Time
+	scheduleMutex sync.Mutex
+	scheduled     []scheduledOutput
+	device        interface{}
+	session       string
+	stopped       bool
+
+	// ledMutex guards the last LED state the script set and whether
+	// sendLEDs still has it to send.
+	ledMutex   sync.Mutex
+	led        [2]byte
+	ledSet     bool
+	ledPending bool
+	ledRunning bool
+}
+
+func scriptPath(name string) (string, error) {
+	return DataPath("scripts", SafeFileName(name)+".lua")
+}
+
+// LoadScript loads a script of the scripts directory for a session. The
+// device is used for LED feedback when it has a PlayerLEDControl.
+func LoadScript(name, session string, device interface{}) (*Script, error) {
+	path, err := scriptPath(name)
+	if err != nil {
+		return nil, err
+	}
+	source, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	script := &Script{Name: name, session: session, device: device, start: time.Now()}
+	script.state = lua.NewState(lua.Options{
+		SkipOpenLibs:    true,
+		CallStackSize:   scriptCallStackSize,
+		RegistrySize:    scriptRegistrySize,
+		RegistryMaxSize: scriptRegistryMaxSize,
+	})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		script.state.Push(script.state.NewFunction(lib.open))
+		script.state.Push(lua.LString(lib.name))
+		script.state.Call(1, 0)
+	}
+	for _, global := range []string{"dofile", "loadfile", "load", "loadstring", "require"} {
+		script.state.SetGlobal(global, lua.LNil)
+	}
+	limitStrings(script.state)
+	script.state.SetGlobal("press", script.state.NewFunction(script.luaPress))
+	script.state.SetGlobal("move", script.state.NewFunction(script.luaMove))
+	script.state.SetGlobal("led", script.state.NewFunction(script.luaLED))
+	script.state.SetGlobal("notify", script.state.NewFunction(script.luaNotify))
+
+	err = script.call(func() error { return script.state.DoString(string(source)) })
+	if err != nil {
+		script.state.Close()
+		return nil, err
+	}
+	script.onFrame = script.state.GetGlobal("on_frame")
+	if script.onFrame.Type() != lua.LTFunction {
+		script.state.Close()
+		return nil, errors.New("script has no on_frame function")
+	}
+
+	return script, nil
+}
+
+func (script *Script) call(fn func() error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), scriptTimeout)
+	defer cancel()
+
+	script.state.SetContext(&scriptBudget{Context: ctx, instructions: scriptInstructions})
+	defer script.state.RemoveContext()
+	return fn()
+}
+
+func (script *Script) stop(err error) {
+	script.stopped = true
+	script.scheduleMutex.Lock()
+	script.scheduled = nil
+	script.scheduleMutex.Unlock()
+	NotifyError(script.session, "script "+script.Name+" stopped: "+err.Error())
+}
+
+// Frame runs on_frame on a new input report and returns the report the
+// script made of it.
+func (script *Script) Frame(report Xbox360ControllerReport, now time.Time) Xbox360ControllerReport {
+	script.mutex.Lock()
+	defer script.mutex.Unlock()
+
+	if script.stopped {
+		return report
+	}
+	script.now = now
+
+	state := StateFromReport(&report)
+	L := script.state
+	buttons := L.NewTable()
+	axes := L.NewTable()
+	for name, control := range Xbox360Target.Controls {
+		if control.Axis {
+			axes.RawSetString(name, lua.LNumber(state.Axes[control.Index]))
+		} else {
+			buttons.RawSetString(name, lua.LBool(state.Pressed(control.Index)))
+		}
+	}
+	pad := L.NewTable()
+	pad.RawSetString("buttons", buttons)
+	pad.RawSetString("axes", axes)
+	pad.RawSetString("time", lua.LNumber(now.Sub(script.start).Seconds()))
+
+	err := script.call(func() error {
+		return L.CallByParam(lua.P{Fn: script.onFrame, NRet: 0, Protect: true}, pad)
+	})
+	if err != nil {
+		script.stop(err)
+		return report
+	}
+
+	out := ControlState{}
+	for name, control := range Xbox360Target.Controls {
+		if control.Axis {
+			if value, ok := axes.RawGetString(name).(lua.LNumber); ok {
+				out.Axes[control.Index] = float32(value)
+			}
+		} else if lua.LVAsBool(buttons.RawGetString(name)) {
+			out.Press(control.Index)
+		}
+	}
+	return out.Report()
+}
+
+// Overlay adds the scheduled outputs due at now to a report.
+func (script *Script) Overlay(report *Xbox360ControllerReport, now time.Time) {
+	script.scheduleMutex.Lock()
+	defer script.scheduleMutex.Unlock()
+
+	if len(script.scheduled) == 0 {
+		return
+	}
+
+	state := StateFromReport(report)
+	pending := script.scheduled[:0]
+	for _, output := range script.scheduled {
+		if !now.Before(output.until) {
+			continue
+		}
+		pending = append(pending, output)
+		if now.Before(output.from) {
+			continue
+		}
+		if output.control.Axis {
+			state.Axes[output.control.Index] = output.value
+		} else {
+			state.Press(output.control.Index)
+		}
+	}
+	script.scheduled = pending
+	*report = state.Report()
+}
+
+// Active reports whether outputs are scheduled, so the pipeline keeps
+// sending without new input.
+func (script *Script) Active() bool {
+	script.scheduleMutex.Lock()
+	defer script.scheduleMutex.Unlock()
+
+	return len(script.scheduled) > 0
+}
+
+// Close waits for a running frame and closes the Lua state, later frames
+// return their input.
+func (script *Script) Close() {
+	script.mutex.Lock()
+	defer script.mutex.Unlock()
+
+	script.stopped = true
+	script.state.Close()
+}
+
+func (script *Script) schedule(L *lua.LState, name string, value float32, durationArg int) int {
+	control, err := Xbox360Target.control(name)
+	if err != nil {
+		L.RaiseError("%s", err.Error())
+		return 0
+	}
+	duration := time.Duration(L.CheckInt(durationArg)) * time.Millisecond
+	delay := time.Duration(L.OptInt(durationArg+1, 0)) * time.Millisecond
+
+	from := script.now.Add(delay)
+	script.scheduleMutex.Lock()
+	defer script.scheduleMutex.Unlock()
+	script.scheduled = append(script.scheduled, scheduledOutput{
+		control: control,
+		value:   value,
+		from:    from,
+		until:   from.Add(duration),
+	})
+	return 0
+}
+
+func (script *Script) luaPress(L *lua.LState) int {
+	return script.schedule(L, L.CheckString(1), 1, 2)
+}
+
+func (script *Script) luaMove(L *lua.LState) int {
+	return script.schedule(L, L.CheckString(1), float32(L.CheckNumber(2)), 3)
+}
+
+func (script *Script) luaLED(L *lua.LState) int {
+	solid, flash := byte(L.CheckInt(1)), byte(L.OptInt(2, 0))
+	control, ok := script.device.(PlayerLEDControl)
+	if !ok {
+		return 0
+	}
+
+	// Frames can set the LEDs faster than the controller takes them, only
+	// the last state waits for sendLEDs.
+	led := [2]byte{solid, flash}
+	script.ledMutex.Lock()
+	defer script.ledMutex.Unlock()
+	if script.ledSet && script.led == led {
+		return 0
+	}
+	script.led, script.ledSet, script.ledPending = led, true, true
+	if !script.ledRunning {
+		script.ledRunning = true
+		go script.sendLEDs(control)
+	}
+	return 0
+}
+
+func (script *Script) sendLEDs(control PlayerLEDControl) {
+	for {
+		script.ledMutex.Lock()
+		if !script.ledPending {
+			script.ledRunning = false
+			script.ledMutex.Unlock()
+			return
+		}
+		led := script.led
+		script.ledPending = false
+		script.ledMutex.Unlock()
+
+		control.SetPlayerLEDs(led[0], led[1])
+	}
+}
+
+func (script *Script) luaNotify(L *lua.LState) int {
+	NotifyInfo(script.session, L.CheckString(1))
+	return 0
+}
+
+// limitStrings replaces string.rep with one building at most
+// scriptStringSize bytes, and makes string.format refuse widths and
+// precisions of more than two digits like Lua does, so a single call
+// cannot allocate past the limits of the script.
+func limitStrings(L *lua.LState) {
+	lib, ok := L.GetGlobal(lua.StringLibName).(*lua.LTable)
+	if !ok {
+		return
+	}
+	lib.RawSetString("rep", L.NewFunction(func(L *lua.LState) int {
+		str, n := L.CheckString(1), L.CheckInt(2)
+		if n > 0 && len(str) > 0 && n > scriptStringSize/len(str) {
+			L.RaiseError("string.rep result longer than %d bytes", scriptStringSize)
+			return 0
+		}
+		L.Push(lua.LString(strings.Repeat(str, n)))
+		return 1
+	}))
+
+	format, ok := lib.RawGetString("format").(*lua.LFunction)
+	if !ok || !format.IsG {
+		return
+	}
+	lib.RawSetString("format", L.NewFunction(func(L *lua.LState) int {
+		if !formatWidthsValid(L.CheckString(1)) {
+			L.RaiseError("invalid format (width or precision too long)")
+			return 0
+		}
+		return format.GFunction(L)
+	}))
+}
+
+// formatWidthsValid reports whether the widths and precisions of a format
+// have at most two digits. Widths taken from the arguments and argument
+// indexes, which Lua does not have, are refused too.
+func formatWidthsValid(format string) bool {
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			continue
+		}
+		i++
+		if i < len(format) && format[i] == '%' {
+			continue
+		}
+		for i < len(format) && strings.IndexByte("-+ #0", format[i]) >= 0 {
+			i++
+		}
+		if !skipWidth(format, &i) {
+			return false
+		}
+		if i < len(format) && format[i] == '.' {
+			i++
+			if !skipWidth(format, &i) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// skipWidth skips the width or precision at *i and reports whether it has
+// at most two digits.
+func skipWidth(format string, i *int) bool {
+	if *i < len(format) && (format[*i] == '*' || format[*i] == '[') {
+		return false
+	}
+	start := *i
+	for *i < len(format) && format[*i] >= '0' && format[*i] <= '9' {
+		*i++
+	}
+	return *i-start <= 2
+}
@@ -0,0 +1,107 @@
+package controller
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func loadTestScript(t *testing.T, source string, device interface{}) *Script {
+	path, err := scriptPath("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(source), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	script, err := LoadScript("test", "test", device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(script.Close)
+	return script
+}
+
+// slowLEDs takes LED states one at a time, as slowly as the test lets it.
+type slowLEDs struct {
+	mutex   sync.Mutex
+	states  [][2]byte
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (pad *slowLEDs) SetPlayerLEDs(solid, flash byte) error {
+	pad.entered <- struct{}{}
+	<-pad.release
+	pad.mutex.Lock()
+	defer pad.mutex.Unlock()
+	pad.states = append(pad.states, [2]byte{solid, flash})
+	return nil
+}
+
+func (pad *slowLEDs) sent() [][2]byte {
+	pad.mutex.Lock()
+	defer pad.mutex.Unlock()
+	return append([][2]byte(nil), pad.states...)
+}
+
+func TestScriptLEDs(t *testing.T) {
+	quietNotifications(t)
+	pad := &slowLEDs{entered: make(chan struct{}, 100), release: make(chan struct{})}
+	script := loadTestScript(t, `
+frames = 0
+function on_frame(pad)
+	frames = frames + 1
+	if frames <= 50 then
+		led(1)
+	else
+		led(frames % 16, 1)
+	end
+end`, pad)
+
+	// The first state waits for the pad, the unchanged ones are dropped
+	// and of the others only the last one waits behind it.
+	now := time.Now()
+	script.Frame(Xbox360ControllerReport{}, now)
+	<-pad.entered
+	for frame := 1; frame < 100; frame++ {
+		script.Frame(Xbox360ControllerReport{}, now)
+	}
+	close(pad.release)
+
+	want := [][2]byte{{1, 0}, {100 % 16, 1}}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(pad.sent()) < len(want) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	sent := pad.sent()
+	if len(sent) != len(want) || sent[0] != want[0] || sent[1] != want[1] {
+		t.Errorf("LED states %v, want %v", sent, want)
+	}
+}
+
+func TestScriptStringLimits(t *testing.T) {
+	quietNotifications(t)
+	tests := []struct {
+		name    string
+		call    string
+		stopped bool
+	}{
+		{"short rep", `string.rep("ab", 1000)`, false},
+		{"long rep", `string.rep("ab", 1e9)`, true},
+		{"method rep", `("ab"):rep(1e9)`, true},
+		{"format", `string.format("%5.2f %-10s %%999d", 1, "x")`, false},
+		{"format width", `string.format("%999999d", 1)`, true},
+		{"format precision", `string.format("%.100f", 1)`, true},
+		{"format argument width", `string.format("%*d", 999999, 1)`, true},
+	}
+	for _, test := range tests {
+		script := loadTestScript(t, "function on_frame(pad) local s = "+test.call+" end", nil)
+		script.Frame(Xbox360ControllerReport{}, time.Now())
+		if script.stopped != test.stopped {
+			t.Errorf("%s: stopped %v, want %v", test.name, script.stopped, test.stopped)
+		}
+	}
+}
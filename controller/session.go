@@ -0,0 +1,286 @@
+package controller
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boombuler/hid"
+)
+
+type Transport string
+
+const (
+	TransportUSB       Transport = "usb"
+	TransportBluetooth Transport = "bluetooth"
+	TransportWeb       Transport = "web"
+)
+
+// TransportFromPath guesses how a HID device is connected from its path.
+// Bluetooth paths carry the HID service class UUID on Windows and name the
+// bus elsewhere, everything else is taken as USB.
+func TransportFromPath(path string) Transport {
+	if IsBluetoothPath(path) || strings.Contains(strings.ToLower(path), "bluetooth") {
+		return TransportBluetooth
+	}
+	return TransportUSB
+}
+
+// TransportOf tells how a HID device is connected from the bus type of its
+// HID interface, and from its path when the system does not tell.
+func TransportOf(info *hid.DeviceInfo) Transport {
+	bus, err := hidBusType(info)
+	if err != nil {
+		return TransportFromPath(info.Path)
+	}
+	if bus == busBluetooth {
+		return TransportBluetooth
+	}
+	return TransportUSB
+}
+
+// Session is one physical or web controller feeding a virtual pad. It is
+// registered while the pad is connected so the admin API can list it.
+// Address is the device path of a controller or the address of a web
+// client.
+type Session struct {
+	ID        int
+	Name      string
+	Kind      string
+	Transport Transport
+	Address   string
+	Started   time.Time
+	Telemetry *Telemetry
+	// Log adds the session to every line.
+	Log *slog.Logger
+
+	mutex        sync.Mutex
+	device       interface{}
+	pipeline     *Pipeline
+	identity     *DeviceIdentity
+	battery      *BatteryStatus
+	batteryAlert int
+}
+
+type BatteryStatus struct {
+	Percent    int  `json:"percent"`
+	Charging   bool `json:"charging"`
+	USBPowered bool `json:"usbPowered"`
+}
+
+// Battery levels that raise a notification when the battery drops to them.
+var lowBatteryThresholds = []int{25, 10}
+
+// Width of the battery levels the pads report. An alert rearms once the
+// battery is a whole level above it, so a reading that wobbles between two
+// levels does not notify on every drop.
+const batteryLevelStep = 25
+
+// SessionInfo is the JSON view of a session.
+type SessionInfo struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	Kind      string    `json:"kind"`
+	Transport Transport `json:"transport"`
+	Address   string    `json:"address,omitempty"`
+	Started   time.Time `json:"started"`
+
+	Identity *DeviceIdentity `json:"identity,omitempty"`
+	Battery  *BatteryStatus  `json:"battery,omitempty"`
+	Output   *PumpStats      `json:"output,omitempty"`
+
+	Telemetry TelemetrySnapshot `json:"telemetry"`
+}
+
+// NintendoLabels reports whether the source of a session has its face
+// buttons labelled the Nintendo way. The pipeline of a session and the
+// replay of its recordings set the layout from it.
+func (info SessionInfo) NintendoLabels() bool {
+	switch {
+	case info.Kind == "Web":
+		return webNintendoLabels(info.Name)
+	case info.Kind == "Pro Controller", info.Kind == "Switch Controller", strings.HasPrefix(info.Kind, "Joy-Con"):
+		return true
+	}
+	return false
+}
+
+// Inputs lists the inputs of the source of a session, so a recording
+// replays through the remapping of its source.
+func (info SessionInfo) Inputs() *OutputTarget {
+	switch {
+	case info.Kind == "Joy-Con", info.Kind == "Joy-Con pair":
+		return JoyConInputs
+	case info.Kind == "Pro Controller", info.Kind == "Switch Controller", strings.HasPrefix(info.Kind, "Joy-Con ("):
+		return SwitchProInputs
+	case info.Kind == "DualShock 4":
+		return DualShock4Inputs
+	case info.Kind == "DualSense":
+		return DualSenseInputs
+	case strings.HasPrefix(info.Kind, "Generic HID"):
+		return GenericHIDInputs
+	}
+	return Xbox360Target
+}
+
+var (
+	sessionsMutex sync.Mutex
+	sessions      = make(map[int]*Session)
+	lastSessionID int
+)
+
+// NewSession registers a session. Close removes it.
+func NewSession(name, kind string, transport Transport, address string) *Session {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	lastSessionID++
+	session := &Session{
+		ID:        lastSessionID,
+		Name:      name,
+		Kind:      kind,
+		Transport: transport,
+		Address:   address,
+		Started:   time.Now(),
+		Telemetry: NewTelemetry(kind),
+
+		batteryAlert: 101,
+	}
+	addressKey := "device"
+	if transport == TransportWeb {
+		addressKey = "client"
+	}
+	session.Log = slog.Default().With("session", session.ID, "source", kind, addressKey, address)
+	session.Log.Info("session started", "name", name, "transport", transport)
+
+	sessions[session.ID] = session
+	return session
+}
+
+func (session *Session) Close() {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	delete(sessions, session.ID)
+	session.Log.Info("session closed", "duration", time.Since(session.Started).Round(time.Millisecond))
+}
+
+func (session *Session) Info() SessionInfo {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	info := SessionInfo{
+		ID:        session.ID,
+		Name:      session.Name,
+		Kind:      session.Kind,
+		Transport: session.Transport,
+		Address:   session.Address,
+		Started:   session.Started,
+		Identity:  session.identity,
+		Battery:   session.battery,
+		Telemetry: session.Telemetry.Snapshot(),
+	}
+	if session.pipeline != nil {
+		stats := session.pipeline.Stats()
+		info.Output = &stats
+	}
+	return info
+}
+
+// SetDevice sets the controller behind the session, which the admin API
+// checks for optional controls such as LightbarControl.
+func (session *Session) SetDevice(device interface{}) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	session.device = device
+}
+
+func (session *Session) Device() interface{} {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	return session.device
+}
+
+func (session *Session) SetPipeline(pipeline *Pipeline) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	session.pipeline = pipeline
+	if pipeline != nil {
+		pipeline.setSource(session.Kind, session.Log)
+	}
+}
+
+// Pipeline returns the output pipeline of the session, nil until the
+// virtual pad is connected.
+func (session *Session) Pipeline() *Pipeline {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	return session.pipeline
+}
+
+func (session *Session) SetIdentity(identity DeviceIdentity) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	session.identity = &identity
+}
+
+// SetBattery updates the battery status of the session, notifying once
+// each time the battery drops to one of the low battery thresholds.
+func (session *Session) SetBattery(status BatteryStatus) {
+	session.mutex.Lock()
+	session.battery = &status
+
+	// Charging or going back a level above the last threshold rearms it.
+	if status.Charging || status.Percent >= session.batteryAlert+batteryLevelStep {
+		session.batteryAlert = 101
+	}
+
+	alert := false
+	if !status.Charging {
+		for _, threshold := range lowBatteryThresholds {
+			if status.Percent <= threshold && threshold < session.batteryAlert {
+				session.batteryAlert = threshold
+				alert = true
+			}
+		}
+	}
+	name := session.Name
+	session.mutex.Unlock()
+
+	if alert {
+		session.Log.Warn("battery low", "percent", status.Percent)
+		NotifyWarning(name, fmt.Sprintf("Battery low (%d%%)", status.Percent))
+	}
+}
+
+func SessionByID(id int) *Session {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	return sessions[id]
+}
+
+// Sessions lists the registered sessions by ID.
+func Sessions() []SessionInfo {
+	sessionsMutex.Lock()
+	list := make([]*Session, 0, len(sessions))
+	for _, session := range sessions {
+		list = append(list, session)
+	}
+	sessionsMutex.Unlock()
+
+	infos := make([]SessionInfo, 0, len(list))
+	for _, session := range list {
+		infos = append(infos, session.Info())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
@@ -0,0 +1,65 @@
+package controller
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// eventLog is a notifier keeping the events it gets.
+type eventLog struct {
+	mutex  sync.Mutex
+	events []Event
+}
+
+func (log *eventLog) Notify(event Event) error {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+
+	log.events = append(log.events, event)
+	return nil
+}
+
+func (log *eventLog) count() int {
+	FlushNotifications(time.Second)
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+
+	return len(log.events)
+}
+
+func TestBatteryAlertHysteresis(t *testing.T) {
+	quietNotifications(t)
+	events := &eventLog{}
+	SetNotifications(NewNotifications([]Notifier{events}, SeverityWarning, 0))
+
+	session := NewSession("Pro Controller", "Pro Controller", TransportBluetooth, "test")
+	defer session.Close()
+
+	steps := []struct {
+		percent  int
+		charging bool
+		alerts   int
+	}{
+		{75, false, 0},
+		{25, false, 1},
+		// Wobbling between two levels does not notify again.
+		{37, false, 1},
+		{25, false, 1},
+		{50, false, 1},
+		{25, false, 2},
+		{12, false, 2},
+		{0, false, 3},
+		{25, false, 3},
+		{0, false, 3},
+		// Charging rearms both.
+		{0, true, 3},
+		{0, false, 4},
+	}
+	for i, step := range steps {
+		session.SetBattery(BatteryStatus{Percent: step.percent, Charging: step.charging})
+		if got := events.count(); got != step.alerts {
+			t.Fatalf("step %d (%d%%): %d alerts, want %d", i, step.percent, got, step.alerts)
+		}
+	}
+}
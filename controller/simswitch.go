@@ -0,0 +1,451 @@
+package controller
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"./switchreport"
+	"github.com/boombuler/hid"
+)
+
+const (
+	switchFlashSize = 0x80000
+
+	simulatedReportLength   = 64
+	simulatedReportInterval = 8 * time.Millisecond
+	simulatedStickCenter    = 2048
+	maxSPIReadLength        = 0x1D
+
+	// Full battery, Pro Controller, on battery power.
+	simulatedBattery = 0x80
+)
+
+var ErrDeviceClosed = errors.New("device closed")
+
+// Factory stick parameters of a real Pro Controller, the dead zone is in
+// bytes 3 to 6.
+var factoryStickParameters = []byte{0x0F, 0x30, 0x61, 0x96, 0x30, 0xF3, 0xD4, 0x14, 0x54, 0x41, 0x15, 0x54, 0xC7, 0x79, 0x9C, 0x33, 0x36, 0x63}
+
+// NewSwitchFlash returns the SPI flash image of a Pro Controller with a
+// serial number, colors and factory calibration, and without user
+// calibration.
+func NewSwitchFlash(serial string) []byte {
+	flash := make([]byte, switchFlashSize)
+	for i := range flash {
+		flash[i] = 0xFF
+	}
+
+	serialField := flash[serialNumberAddress : serialNumberAddress+16]
+	for i := range serialField {
+		serialField[i] = 0
+	}
+	copy(serialField, serial)
+
+	imu := flash[0x6020:]
+	for axis := 0; axis < 3; axis++ {
+		binary.LittleEndian.PutUint16(imu[axis*2:], 0)
+		binary.LittleEndian.PutUint16(imu[6+axis*2:], 0x4000)
+		binary.LittleEndian.PutUint16(imu[12+axis*2:], 0)
+		binary.LittleEndian.PutUint16(imu[18+axis*2:], 0x343B)
+	}
+
+	center := switchreport.Stick{X: simulatedStickCenter, Y: simulatedStickCenter}
+	reach := switchreport.Stick{X: 1500, Y: 1500}
+	switchreport.PackStick(reach, flash[0x603D:])
+	switchreport.PackStick(center, flash[0x6040:])
+	switchreport.PackStick(reach, flash[0x6043:])
+	switchreport.PackStick(center, flash[0x6046:])
+	switchreport.PackStick(reach, flash[0x6049:])
+	switchreport.PackStick(reach, flash[0x604C:])
+
+	copy(flash[colorsAddress:], []byte{0x32, 0x32, 0x32, 0xFF, 0xFF, 0xFF, 0x32, 0x32, 0x32, 0x32, 0x32, 0x32})
+	copy(flash[0x6086:], factoryStickParameters)
+	copy(flash[0x6098:], factoryStickParameters)
+	return flash
+}
+
+// LoadSwitchFlash reads a flash dump, like one taken from a real
+// controller. Short dumps are padded with erased bytes.
+func LoadSwitchFlash(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > switchFlashSize {
+		return nil, errors.New("flash image larger than 512KB")
+	}
+
+	flash := make([]byte, switchFlashSize)
+	copy(flash, data)
+	for i := len(data); i < len(flash); i++ {
+		flash[i] = 0xFF
+	}
+	return flash, nil
+}
+
+// SimulatedInput is the input of a simulated controller. Report returns
+// the 0x30 report at a time since the controller started streaming, and
+// false once the input is over, which ends the stream with io.EOF.
+type SimulatedInput interface {
+	Report(elapsed time.Duration) ([]byte, bool)
+}
+
+// SimulatedFrame is the input of a ScriptedInput from At on. Sticks are
+// raw 12-bit values, a zero stick is centered.
+type SimulatedFrame struct {
+	At         time.Duration
+	Buttons    switchreport.Buttons
+	LeftStick  switchreport.Stick
+	RightStick switchreport.Stick
+	Accel      [3]int16
+	Gyro       [3]int16
+}
+
+// ScriptedInput holds each frame until the next one and the last one
+// until Length. Before the first frame the controller is at rest.
+type ScriptedInput struct {
+	Frames []SimulatedFrame
+	Length time.Duration
+}
+
+func (input *ScriptedInput) Report(elapsed time.Duration) ([]byte, bool) {
+	if elapsed >= input.Length {
+		return nil, false
+	}
+
+	i := sort.Search(len(input.Frames), func(i int) bool { return input.Frames[i].At > elapsed }) - 1
+	frame := SimulatedFrame{}
+	if i >= 0 {
+		frame = input.Frames[i]
+	}
+	return frame.report(), true
+}
+
+func (frame *SimulatedFrame) report() []byte {
+	report := make([]byte, switchreport.StandardIMUReportLength)
+	report[0] = switchreport.StandardReportID
+	report[2] = simulatedBattery
+	report[3] = frame.Buttons.Right
+	report[4] = frame.Buttons.Shared
+	report[5] = frame.Buttons.Left
+
+	center := switchreport.Stick{X: simulatedStickCenter, Y: simulatedStickCenter}
+	for i, stick := range []switchreport.Stick{frame.LeftStick, frame.RightStick} {
+		if stick == (switchreport.Stick{}) {
+			stick = center
+		}
+		switchreport.PackStick(stick, report[6+i*3:])
+	}
+
+	for i := 0; i < 3; i++ {
+		sample := report[13+i*12:]
+		for axis := 0; axis < 3; axis++ {
+			binary.LittleEndian.PutUint16(sample[axis*2:], uint16(frame.Accel[axis]))
+			binary.LittleEndian.PutUint16(sample[6+axis*2:], uint16(frame.Gyro[axis]))
+		}
+	}
+	return report
+}
+
+// CaptureInput plays back the 0x30 reports read in a HID capture, timed
+// from the first one.
+type CaptureInput struct {
+	reports []CapturedReport
+}
+
+func NewCaptureInput(captured []CapturedReport) *CaptureInput {
+	input := &CaptureInput{}
+	for _, report := range captured {
+		if !report.Write && len(report.Data) >= switchreport.StandardReportLength && report.Data[0] == switchreport.StandardReportID {
+			input.reports = append(input.reports, report)
+		}
+	}
+	return input
+}
+
+func (input *CaptureInput) Report(elapsed time.Duration) ([]byte, bool) {
+	if len(input.reports) == 0 {
+		return nil, false
+	}
+
+	at := input.reports[0].At + elapsed
+	i := sort.Search(len(input.reports), func(i int) bool { return input.reports[i].At > at }) - 1
+	if i == len(input.reports)-1 && at-input.reports[i].At > simulatedReportInterval {
+		return nil, false
+	}
+	return input.reports[i].Data, true
+}
+
+// SimulatedProState is what the host set on a simulated controller.
+type SimulatedProState struct {
+	Mode       byte
+	PlayerLEDs byte
+	HomeLight  []byte
+	IMU        bool
+	Vibration  bool
+}
+
+// SimulatedProController is a hid.Device that behaves like a Pro
+// Controller. It answers USB commands and subcommands, reads and writes
+// SPI flash in its image and streams 0x30 reports from its input every 8ms
+// once set to the standard report mode. Without input it streams a
+// controller at rest.
+type SimulatedProController struct {
+	Flash []byte
+	MAC   [6]byte
+	Input SimulatedInput
+
+	mutex       sync.Mutex
+	state       SimulatedProState
+	replies     chan []byte
+	closed      chan struct{}
+	closeOnce   sync.Once
+	streamStart time.Time
+	next        time.Time
+	timer       byte
+	last        []byte
+}
+
+func NewSimulatedProController(flash []byte, input SimulatedInput) *SimulatedProController {
+	if flash == nil {
+		flash = NewSwitchFlash("XCW00000000001")
+	}
+	return &SimulatedProController{
+		Flash:   flash,
+		MAC:     [6]byte{0x98, 0xB6, 0xE9, 0x00, 0x00, 0x01},
+		Input:   input,
+		replies: make(chan []byte, 16),
+		closed:  make(chan struct{}),
+		last:    (&SimulatedFrame{}).report()[2:13],
+	}
+}
+
+// DeviceInfo describes the controller at path for AddSimulatedDevice.
+func (sim *SimulatedProController) DeviceInfo(path string) *hid.DeviceInfo {
+	return &hid.DeviceInfo{
+		Path:         path,
+		VendorId:     NintendoVendorID,
+		ProductId:    SwitchProControllerProductID,
+		Manufacturer: "Nintendo Co., Ltd.",
+		Product:      "Pro Controller",
+	}
+}
+
+func (sim *SimulatedProController) State() SimulatedProState {
+	sim.mutex.Lock()
+	defer sim.mutex.Unlock()
+
+	state := sim.state
+	state.HomeLight = append([]byte(nil), sim.state.HomeLight...)
+	return state
+}
+
+func (sim *SimulatedProController) Close() {
+	sim.closeOnce.Do(func() { close(sim.closed) })
+}
+
+func (sim *SimulatedProController) Write(data []byte) error {
+	select {
+	case <-sim.closed:
+		return ErrDeviceClosed
+	default:
+	}
+	if len(data) < 2 {
+		return nil
+	}
+
+	sim.mutex.Lock()
+	defer sim.mutex.Unlock()
+
+	switch data[0] {
+	case 0x80:
+		sim.usbCommand(data[1])
+	case 0x01:
+		if len(data) > 10 {
+			sim.subcommand(data[10], data[11:])
+		}
+	}
+	// 0x10 reports only rumble.
+	return nil
+}
+
+func (sim *SimulatedProController) reply(reply []byte) {
+	select {
+	case sim.replies <- reply:
+	default:
+	}
+}
+
+func (sim *SimulatedProController) usbCommand(cmd byte) {
+	reply := make([]byte, simulatedReportLength)
+	reply[0] = switchreport.USBReplyID
+	reply[1] = cmd
+	switch cmd {
+	case usbCommandStatus:
+		reply[3] = SwitchDeviceProCon
+		for i := range sim.MAC {
+			reply[4+i] = sim.MAC[len(sim.MAC)-1-i]
+		}
+	case usbCommandHandshake, usbCommandHighSpeed:
+	default:
+		// No reply to the others, like usbCommandNoTimeout.
+		return
+	}
+	sim.reply(reply)
+}
+
+func (sim *SimulatedProController) subcommand(sc byte, args []byte) {
+	var ack byte = 0x80
+	var data []byte
+
+	switch sc {
+	case 0x02:
+		ack = 0x82
+		data = append([]byte{0x03, 0x48, SwitchDeviceProCon, 0x02}, sim.MAC[:]...)
+		data = append(data, 0x01, 0x01)
+	case 0x03:
+		if len(args) > 0 {
+			sim.state.Mode = args[0]
+			if args[0] == switchreport.StandardReportID {
+				sim.streamStart = time.Now()
+				sim.next = sim.streamStart
+			}
+		}
+	case 0x10:
+		ack = 0x90
+		if len(args) < 5 {
+			ack = 0
+			break
+		}
+		address := int(binary.LittleEndian.Uint32(args))
+		length := int(args[4])
+		if length > maxSPIReadLength || address+length > len(sim.Flash) {
+			ack = 0
+			break
+		}
+		data = append(append([]byte(nil), args[:5]...), sim.Flash[address:address+length]...)
+	case 0x11:
+		if len(args) < 5 || len(args) < 5+int(args[4]) {
+			ack = 0
+			break
+		}
+		address := int(binary.LittleEndian.Uint32(args))
+		length := int(args[4])
+		if address+length > len(sim.Flash) {
+			data = []byte{0x01}
+			break
+		}
+		copy(sim.Flash[address:], args[5:5+length])
+		data = []byte{0x00}
+	case 0x30:
+		if len(args) > 0 {
+			sim.state.PlayerLEDs = args[0]
+		}
+	case 0x38:
+		sim.state.HomeLight = append([]byte(nil), args...)
+	case 0x40:
+		sim.state.IMU = len(args) > 0 && args[0] != 0
+	case 0x48:
+		sim.state.Vibration = len(args) > 0 && args[0] != 0
+	}
+
+	reply := make([]byte, simulatedReportLength)
+	reply[0] = switchreport.SubcommandReplyID
+	reply[1] = sim.timer
+	copy(reply[2:13], sim.last)
+	reply[13] = ack
+	reply[14] = sc
+	copy(reply[15:], data)
+	sim.reply(reply)
+}
+
+// Read returns the next reply, or the next 0x30 report when it is due.
+func (sim *SimulatedProController) Read() ([]byte, error) {
+	for {
+		select {
+		case reply := <-sim.replies:
+			return reply, nil
+		case <-sim.closed:
+			return nil, ErrDeviceClosed
+		default:
+		}
+
+		sim.mutex.Lock()
+		streaming := sim.state.Mode == switchreport.StandardReportID
+		wait := time.Until(sim.next)
+		sim.mutex.Unlock()
+
+		if !streaming {
+			select {
+			case reply := <-sim.replies:
+				return reply, nil
+			case <-sim.closed:
+				return nil, ErrDeviceClosed
+			}
+		}
+
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case reply := <-sim.replies:
+				timer.Stop()
+				return reply, nil
+			case <-sim.closed:
+				timer.Stop()
+				return nil, ErrDeviceClosed
+			case <-timer.C:
+			}
+		}
+
+		report, err := sim.inputReport()
+		if report != nil || err != nil {
+			return report, err
+		}
+	}
+}
+
+// inputReport builds the next 0x30 report, or nil when the mode changed
+// while waiting.
+func (sim *SimulatedProController) inputReport() ([]byte, error) {
+	sim.mutex.Lock()
+	defer sim.mutex.Unlock()
+
+	if sim.state.Mode != switchreport.StandardReportID {
+		return nil, nil
+	}
+
+	var report []byte
+	if sim.Input == nil {
+		report = (&SimulatedFrame{}).report()
+	} else {
+		input, ok := sim.Input.Report(time.Since(sim.streamStart))
+		if !ok {
+			return nil, io.EOF
+		}
+		report = append([]byte(nil), input...)
+	}
+	if len(report) < switchreport.StandardIMUReportLength {
+		report = append(report, make([]byte, switchreport.StandardIMUReportLength-len(report))...)
+	}
+
+	report[0] = switchreport.StandardReportID
+	report[1] = sim.timer
+	sim.timer++
+	if !sim.state.IMU {
+		for i := 13; i < switchreport.StandardIMUReportLength; i++ {
+			report[i] = 0
+		}
+	}
+	copy(sim.last, report[2:13])
+
+	sim.next = sim.next.Add(simulatedReportInterval)
+	if now := time.Now(); sim.next.Before(now) {
+		sim.next = now
+	}
+	return report, nil
+}
@@ -0,0 +1,239 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"./switchreport"
+	"github.com/boombuler/hid"
+)
+
+// simulatedFlash is a dump of the first 32KB of a simulated controller's
+// flash, loaded back like one read from a real controller. The left stick
+// gets a reach of its own so the test can tell the SPI reads apart.
+func simulatedFlash(t *testing.T) []byte {
+	flash := NewSwitchFlash("XCW10000000042")
+	switchreport.PackStick(switchreport.Stick{X: 1400, Y: 1300}, flash[0x603D:])
+
+	path := filepath.Join(t.TempDir(), "procon.bin")
+	err := os.WriteFile(path, flash[:0x8000], 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flash, err = LoadSwitchFlash(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flash) != switchFlashSize || flash[switchFlashSize-1] != 0xFF {
+		t.Fatalf("loaded flash of %d bytes, want it padded to %d with erased bytes", len(flash), switchFlashSize)
+	}
+	return flash
+}
+
+// waitSession waits for the session of the device at path to get its
+// pipeline.
+func waitSession(t *testing.T, path string) *Session {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, info := range Sessions() {
+			if info.Address != path {
+				continue
+			}
+			session := SessionByID(info.ID)
+			if session != nil && session.Pipeline() != nil {
+				return session
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no session for %s", path)
+	return nil
+}
+
+func TestSwitchProSimulated(t *testing.T) {
+	quietNotifications(t)
+
+	// A held, left stick pushed fully right.
+	input := &ScriptedInput{
+		Frames: []SimulatedFrame{{
+			Buttons:   switchreport.Buttons{Right: 1 << SwitchProControllerButtonA},
+			LeftStick: switchreport.Stick{X: simulatedStickCenter + 1400, Y: simulatedStickCenter},
+		}},
+		Length: time.Hour,
+	}
+	sim := NewSimulatedProController(simulatedFlash(t), input)
+	info := sim.DeviceInfo("simulated/procon-usb")
+	AddSimulatedDevice(info, func() (hid.Device, error) { return sim, nil })
+	defer RemoveSimulatedDevice(info.Path)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		NewSwitchProController(ctx, info)
+	}()
+
+	session := waitSession(t, info.Path)
+	controller := session.Device().(*SwitchProController)
+	if controller.Transport != TransportUSB {
+		t.Errorf("transport %s, want usb", controller.Transport)
+	}
+	left := StickCalibration{MaxX: 1400, MaxY: 1300, CenterX: 2048, CenterY: 2048, MinX: 1500, MinY: 1500, DeadZone: 0x96}
+	if controller.StickCalLeft != left {
+		t.Errorf("left stick calibration %+v, want %+v", controller.StickCalLeft, left)
+	}
+	right := StickCalibration{MaxX: 1500, MaxY: 1500, CenterX: 2048, CenterY: 2048, MinX: 1500, MinY: 1500, DeadZone: 0x96}
+	if controller.StickCalRight != right {
+		t.Errorf("right stick calibration %+v, want %+v", controller.StickCalRight, right)
+	}
+	if identity := session.Info().Identity; identity == nil || identity.Serial != "XCW10000000042" || identity.MAC != "98:B6:E9:00:00:01" {
+		t.Errorf("identity %+v, want the serial and MAC of the simulated controller", identity)
+	}
+
+	state := sim.State()
+	if state.Mode != switchreport.StandardReportID || state.PlayerLEDs != 1 || !state.IMU || !state.Vibration {
+		t.Errorf("state %+v after init, want 0x30 reports, player 1, IMU and vibration on", state)
+	}
+	if !bytes.Equal(state.HomeLight, []byte{0x1F, 0x60, 0x60}) {
+		t.Errorf("home light % x, want it dimmed after the handshake", state.HomeLight)
+	}
+
+	var recorded bytes.Buffer
+	recorder, err := NewInputRecorder(&recorded, session.Info())
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Pipeline().SetRecorder(recorder)
+	time.Sleep(100 * time.Millisecond)
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the controller did not stop")
+	}
+
+	recording, err := ReadRecording(&recorded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recording.Frames) == 0 {
+		t.Fatal("no input reached the pipeline")
+	}
+	report := recording.Frames[len(recording.Frames)-1].Report
+	if report.GetButtons() != 1<<Xbox360ControllerButtonB {
+		t.Errorf("buttons %016b, want B", report.GetButtons())
+	}
+	if x, y := report.GetLeftThumb(); x != 32767 || y != 0 {
+		t.Errorf("left thumb %d,%d, want fully right", x, y)
+	}
+
+	state = sim.State()
+	if state.PlayerLEDs != 0 || state.IMU || state.Vibration || !bytes.Equal(state.HomeLight, []byte{0x00}) {
+		t.Errorf("state %+v after restore, want lights, IMU and vibration off", state)
+	}
+}
+
+// bluetoothProController ignores the USB commands, like a Pro Controller
+// connected over Bluetooth.
+type bluetoothProController struct {
+	*SimulatedProController
+}
+
+func (sim bluetoothProController) Write(data []byte) error {
+	if len(data) > 0 && data[0] == 0x80 {
+		return nil
+	}
+	return sim.SimulatedProController.Write(data)
+}
+
+func TestSwitchProBluetoothFallback(t *testing.T) {
+	quietNotifications(t)
+	sim := NewSimulatedProController(nil, nil)
+	controller := SwitchProController{
+		Name:      "Pro Controller",
+		Device:    bluetoothProController{sim},
+		Transport: TransportUSB,
+	}
+	defer sim.Close()
+
+	err := controller.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if controller.Transport != TransportBluetooth {
+		t.Errorf("transport %s without USB answers, want bluetooth", controller.Transport)
+	}
+	if controller.Serial != "XCW00000000001" {
+		t.Errorf("serial %q, want the one in the flash", controller.Serial)
+	}
+}
+
+func TestSimulatedProControllerCapture(t *testing.T) {
+	input := &ScriptedInput{
+		Frames: []SimulatedFrame{
+			{},
+			{At: 40 * time.Millisecond, Buttons: switchreport.Buttons{Shared: 1 << SwitchProControllerButtonPlus}},
+		},
+		Length: 80 * time.Millisecond,
+	}
+	sim := NewSimulatedProController(nil, input)
+	var captured bytes.Buffer
+	capture := NewCapture(sim, &captured, sim.DeviceInfo("simulated/procon"))
+	err := capture.Write([]byte{0x01, 0x00, 0x00, 0x01, 0x40, 0x40, 0x00, 0x01, 0x40, 0x40, 0x03, switchreport.StandardReportID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		_, err := capture.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	capture.Close()
+
+	reports, err := ReadHIDCapture(&captured)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replay := NewSimulatedProController(nil, NewCaptureInput(reports))
+	defer replay.Close()
+	replay.Write([]byte{0x01, 0x00, 0x00, 0x01, 0x40, 0x40, 0x00, 0x01, 0x40, 0x40, 0x03, switchreport.StandardReportID})
+
+	var plus, total int
+	for {
+		raw, err := replay.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if raw[0] != switchreport.StandardReportID {
+			continue
+		}
+		report, err := switchreport.ParseStandard(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		total++
+		if report.Buttons.Shared&(1<<SwitchProControllerButtonPlus) != 0 {
+			plus++
+		} else if plus > 0 {
+			t.Fatal("Plus released during the replay of a capture where it stays held")
+		}
+	}
+	if total == 0 || plus == 0 || plus == total {
+		t.Errorf("%d of %d replayed reports with Plus, want the capture's rest then Plus", plus, total)
+	}
+}
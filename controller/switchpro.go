@@ -1,9 +1,15 @@
 package controller
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"log/slog"
+	"sync"
+	"time"
 
+	"./switchreport"
 	"github.com/boombuler/hid"
 )
 
@@ -30,157 +36,178 @@ const (
 	SwitchProControllerButtonLeftTrigger  = 7
 )
 
-func NewSwitchProController(DeviceInfo *hid.DeviceInfo) {
-	HIDDeviceMap[DeviceInfo.Path] = DeviceInfo
-	defer delete(HIDDeviceMap, DeviceInfo.Path)
+const (
+	subcommandTimeout = 200 * time.Millisecond
+	subcommandRetries = 3
+
+	// Gyro scale of the factory calibration, and the time between the three
+	// IMU samples of a report.
+	switchGyroDegrees  = 0.06103
+	switchIMUFrameTime = 0.005
 
-	device, err := DeviceInfo.Open()
+	// Input reports buffered while a command waits for its reply. Older
+	// reports are dropped when the consumer falls further behind.
+	inputBufferSize = 64
+)
+
+var (
+	ErrNoAck        = errors.New("no acknowledgement from controller")
+	ErrNack         = errors.New("controller rejected the command")
+	ErrShortReply   = errors.New("controller reply too short")
+	ErrDisconnected = errors.New("controller disconnected")
+)
+
+// Extra inputs of a Pro Controller, which the Xbox 360 controller has no
+// button for.
+const switchProExtraCapture = 0
+
+var SwitchProInputs = sourceInputs("Pro Controller", "Capture")
+
+// USB commands, sent in 0x80 reports and answered with 0x81 reports.
+const (
+	usbCommandStatus    = 0x01
+	usbCommandHandshake = 0x02
+	usbCommandHighSpeed = 0x03
+	usbCommandNoTimeout = 0x04
+	usbCommandTimeout   = 0x05
+)
+
+func NewSwitchProController(ctx context.Context, DeviceInfo *hid.DeviceInfo) {
+	device, err := OpenDevice(DeviceInfo)
 	if err != nil {
-		fmt.Println(err)
+		NotifyError("unable to open controller", err.Error())
+		return
 	}
-	defer device.Close()
+	defer closeOnCancel(ctx, device)()
 
 	var controller SwitchProController
 	controller.Name = DeviceInfo.Manufacturer + " " + DeviceInfo.Product
 	controller.Device = device
+	controller.Transport = TransportOf(DeviceInfo)
 	err = controller.Init()
 	if err != nil {
-		Notification("unable to init controller", err.Error())
+		NotifyError("unable to init controller", err.Error())
 		return
 	}
+	controller.Name = controller.DisplayName()
+	// Deferred before the virtual pad, so it runs once the pad is gone.
+	defer controller.Restore()
 
-	Notification(controller.Name, " Connected")
+	notifyConnected(controller.Name, " Connected")
 
 	emulator, err := NewEmulator(func(vibration Vibration) {})
 	if err != nil {
-		Notification("unable to start ViGEm client", err.Error())
+		NotifyError("unable to start ViGEm client", err.Error())
 		return
 	}
 	defer emulator.Close()
 
 	ctr, err := emulator.CreateXbox360Controller()
 	if err != nil {
-		Notification("unable to create emulated Xbox 360 controller", err.Error())
+		NotifyError("unable to create emulated Xbox 360 controller", err.Error())
 		return
 	}
 	defer ctr.Close()
 
 	err = ctr.Connect()
 	if err != nil {
-		Notification("unable to connect to emulated Xbox 360 controller", err.Error())
+		NotifyError("unable to connect to emulated Xbox 360 controller", err.Error())
 		return
 	}
 	defer ctr.Disconnect()
 
-	for {
-		raw_buf, err := controller.Device.Read()
+	session := NewSession(controller.Name, controller.Kind(), controller.Transport, DeviceInfo.Path)
+	session.SetIdentity(controller.Identity())
+	session.SetDevice(&controller)
+	defer session.Close()
+
+	pipeline := controller.Profile.NewPipeline(controller.Name, ctr, &controller)
+	pipeline.Layout.NintendoLabels = session.Info().NintendoLabels()
+	session.SetPipeline(pipeline)
+	defer pipeline.Close()
+
+	for ctx.Err() == nil {
+		raw_buf, err := controller.ReadInput()
 		if err != nil {
-			Notification(controller.Name, err.Error())
+			if ctx.Err() != nil {
+				return
+			}
+			session.Log.Error("read failed", "err", err)
+			NotifyError(controller.Name, err.Error())
 			return
 		}
-		if len(raw_buf) < 12 {
-			Notification(controller.Name, "Disconnected")
-			return
+
+		input, err := switchreport.ParseStandard(raw_buf)
+		if err != nil {
+			session.Log.Debug("bad input report", "err", err)
+			countDecodeError(session.Kind)
+			continue
 		}
 
-		if raw_buf[0] == 0x30 {
-			ButtonsR := raw_buf[3]
-			ButtonsM := raw_buf[4]
-			ButtonsL := raw_buf[5]
-
-			report := Xbox360ControllerReport{}
-			report.MaybeSetButton(Xbox360ControllerButtonX, ButtonsR&(1<<SwitchProControllerButtonY) != 0)
-			report.MaybeSetButton(Xbox360ControllerButtonY, ButtonsR&(1<<SwitchProControllerButtonX) != 0)
-			report.MaybeSetButton(Xbox360ControllerButtonA, ButtonsR&(1<<SwitchProControllerButtonB) != 0)
-			report.MaybeSetButton(Xbox360ControllerButtonB, ButtonsR&(1<<SwitchProControllerButtonA) != 0)
-			report.MaybeSetButton(Xbox360ControllerButtonRightShoulder, ButtonsR&(1<<SwitchProControllerButtonRightShoulder) != 0)
-			if ButtonsR&(1<<SwitchProControllerButtonRightTrigger) != 0 {
-				report.SetRightTrigger(255)
-			}
+		session.SetBattery(BatteryStatus{
+			Percent:    input.Battery.Percent(),
+			Charging:   input.Battery.Charging,
+			USBPowered: input.Connection.USBPowered(),
+		})
 
-			report.MaybeSetButton(Xbox360ControllerButtonStart, ButtonsM&(1<<SwitchProControllerButtonPlus) != 0)
-			report.MaybeSetButton(Xbox360ControllerButtonBack, ButtonsM&(1<<SwitchProControllerButtonMinus) != 0)
-			report.MaybeSetButton(Xbox360ControllerButtonRightThumb, ButtonsM&(1<<SwitchProControllerButtonRightThumb) != 0)
-			report.MaybeSetButton(Xbox360ControllerButtonLeftThumb, ButtonsM&(1<<SwitchProControllerButtonLeftThumb) != 0)
-			report.MaybeSetButton(Xbox360ControllerButtonGuide, ButtonsM&(1<<SwitchProControllerButtonHome) != 0)
-
-			report.MaybeSetButton(Xbox360ControllerButtonUp, ButtonsL&(1<<SwitchProControllerButtonUp) != 0)
-			report.MaybeSetButton(Xbox360ControllerButtonDown, ButtonsL&(1<<SwitchProControllerButtonDown) != 0)
-			report.MaybeSetButton(Xbox360ControllerButtonLeft, ButtonsL&(1<<SwitchProControllerButtonLeft) != 0)
-			report.MaybeSetButton(Xbox360ControllerButtonRight, ButtonsL&(1<<SwitchProControllerButtonRight) != 0)
-			report.MaybeSetButton(Xbox360ControllerButtonLeftShoulder, ButtonsL&(1<<SwitchProControllerButtonLeftShoulder) != 0)
-			if ButtonsL&(1<<SwitchProControllerButtonLeftTrigger) != 0 {
-				report.SetLeftTrigger(255)
-			}
+		now := time.Now()
+		if controller.calibrationStep(input, now) {
+			pipeline.Send(&Xbox360ControllerReport{})
+			continue
+		}
 
-			LeftThumbX, LeftThumbY := controller.StickCalLeft.StickCalibrate(uint16(raw_buf[7]&0xF)<<8|uint16(raw_buf[6]), (uint16(raw_buf[8])<<4)|uint16(raw_buf[7]>>4))
-			RightThumbX, RightThumbY := controller.StickCalRight.StickCalibrate(uint16(raw_buf[10]&0xF)<<8|uint16(raw_buf[9]), (uint16(raw_buf[11])<<4)|uint16(raw_buf[10]>>4))
-
-			if ButtonsL&(1<<SwitchProControllerButtonLeftTrigger) != 0 {
-				var gyr_x float32 = 0.0
-				var gyr_y float32 = 0.0
-				for i := 0; i < 3; i++ {
-					var acc_r, gyr_r [3]int16
-					acc_r[0] = int16(binary.LittleEndian.Uint16(raw_buf[13+i*12:]))
-					acc_r[1] = int16(binary.LittleEndian.Uint16(raw_buf[15+i*12:]))
-					acc_r[2] = int16(binary.LittleEndian.Uint16(raw_buf[17+i*12:]))
-					gyr_r[0] = int16(binary.LittleEndian.Uint16(raw_buf[19+i*12:]))
-					gyr_r[1] = int16(binary.LittleEndian.Uint16(raw_buf[21+i*12:]))
-					gyr_r[2] = int16(binary.LittleEndian.Uint16(raw_buf[23+i*12:]))
-
-					gyr_x += float32(gyr_r[2]) / 2048.0
-					gyr_y += float32(gyr_r[1]) / 2048.0
-				}
-
-				if gyr_x > 0.0 {
-					gyr_x += 0.1
-				} else {
-					gyr_x -= 0.1
-				}
-				if gyr_y > 0.0 {
-					gyr_y += 0.1
-				} else {
-					gyr_y -= 0.1
-				}
-				RightThumbX -= gyr_x
-				RightThumbY -= gyr_y
-			}
+		report := Xbox360ControllerReport{}
+		report.SetButtonsFromSwitch(input.Buttons.Right, input.Buttons.Shared, input.Buttons.Left)
 
-			if LeftThumbX > 1.0 {
-				LeftThumbX = 1.0
-			} else if LeftThumbX < -1.0 {
-				LeftThumbX = -1.0
-			}
+		LeftThumbX, LeftThumbY := controller.StickCalLeft.StickCalibrate(input.LeftStick.X, input.LeftStick.Y)
+		RightThumbX, RightThumbY := controller.StickCalRight.StickCalibrate(input.RightStick.X, input.RightStick.Y)
 
-			if LeftThumbY > 1.0 {
-				LeftThumbY = 1.0
-			} else if LeftThumbY < -1.0 {
-				LeftThumbY = -1.0
+		if input.HasIMU {
+			var pitch float32
+			for i := 0; i < 3; i++ {
+				pitch += float32(input.IMU[i].Gyro[1]-int16(controller.GyrNeutral[1])) * switchGyroDegrees * switchIMUFrameTime
 			}
+			pipeline.AddPitch(pitch)
+		}
 
-			if RightThumbX > 1.0 {
-				RightThumbX = 1.0
-			} else if RightThumbX < -1.0 {
-				RightThumbX = -1.0
+		if input.Buttons.Left&(1<<SwitchProControllerButtonLeftTrigger) != 0 && input.HasIMU {
+			var gyr_x float32 = 0.0
+			var gyr_y float32 = 0.0
+			for i := 0; i < 3; i++ {
+				gyr_x += float32(input.IMU[i].Gyro[2]-int16(controller.GyrNeutral[2])) / 2048.0
+				gyr_y += float32(input.IMU[i].Gyro[1]-int16(controller.GyrNeutral[1])) / 2048.0
 			}
 
-			if RightThumbY > 1.0 {
-				RightThumbY = 1.0
-			} else if RightThumbY < -1.0 {
-				RightThumbY = -1.0
+			if gyr_x > 0.0 {
+				gyr_x += 0.1
+			} else {
+				gyr_x -= 0.1
 			}
+			if gyr_y > 0.0 {
+				gyr_y += 0.1
+			} else {
+				gyr_y -= 0.1
+			}
+			RightThumbX -= gyr_x
+			RightThumbY -= gyr_y
+		}
 
-			report.SetLeftThumb(int16(LeftThumbX*32767), int16(LeftThumbY*32767))
-			report.SetRightThumb(int16(RightThumbX*32767), int16(RightThumbY*32767))
+		report.SetLeftThumb(StickToInt16(LeftThumbX), StickToInt16(LeftThumbY))
+		report.SetRightThumb(StickToInt16(RightThumbX), StickToInt16(RightThumbY))
 
-			ctr.Send(&report)
+		var extra uint32
+		if input.Buttons.Shared&(1<<SwitchProControllerButtonCapture) != 0 {
+			extra = 1 << switchProExtraCapture
 		}
+		pipeline.SendInput(&report, extra)
+		session.Telemetry.HIDToSend(controller.InputTime(), time.Now())
 	}
 }
 
 type SwitchProController struct {
 	Name          string
 	Device        hid.Device
+	Transport     Transport
 	CommmandID    byte
 	StickCalLeft  StickCalibration
 	StickCalRight StickCalibration
@@ -188,10 +215,55 @@ type SwitchProController struct {
 	AccSensiti    [3]uint16
 	GyrNeutral    [3]uint16
 	GyrSensiti    [3]uint16
+	Serial        string
+	MAC           string
+	Firmware      [2]byte
+	DeviceType    byte
+	Colors        SwitchColors
+	Profile       *Profile
+
+	// In-app calibration, started by holding Capture and Home.
+	calibration *InteractiveCalibration
+	chordSince  time.Time
+	chordHeld   bool
+
+	// Subcommands come from the input loop and the admin API.
+	commandMutex sync.Mutex
+
+	// The reader goroutine owns Device.Read. Subcommand replies go to
+	// replies, everything else to input.
+	input   chan inputReport
+	replies chan []byte
+	done    chan struct{}
+	readErr error
+	inputAt time.Time
+}
+
+type inputReport struct {
+	data []byte
+	at   time.Time
 }
 
 func (Controller *SwitchProController) Init() error {
 	Controller.CommmandID = 0
+	if Controller.done == nil {
+		Controller.input = make(chan inputReport, inputBufferSize)
+		Controller.replies = make(chan []byte, 8)
+		Controller.done = make(chan struct{})
+		go Controller.readLoop()
+	}
+
+	if Controller.Transport == TransportUSB {
+		err := Controller.usbHandshake()
+		if errors.Is(err, ErrNoAck) {
+			// Taken for USB by mistake, a Bluetooth controller ignores the
+			// USB commands.
+			slog.Warn("no answer to the USB handshake, trying Bluetooth", "controller", Controller.Name)
+			Controller.Transport = TransportBluetooth
+		} else if err != nil {
+			return err
+		}
+	}
 
 	//Blink Home Light
 	_, err := Controller.Subcommand(0x38, []byte{0x1F, 0xFF, 0x00})
@@ -200,72 +272,66 @@ func (Controller *SwitchProController) Init() error {
 	}
 
 	// Request Factory Calibration Data
-	response, err := Controller.ReadSPI([]byte{0x3d, 0x60, 0x00, 0x00, 9})
+	response, err := Controller.ReadSPI(0x603D, 9)
 	if err != nil {
 		return err
 	}
-	Controller.StickCalLeft.MaxX = uint16(response[1]&0xF)<<8 | uint16(response[0])
-	Controller.StickCalLeft.MaxY = (uint16(response[2]) << 4) | uint16(response[1]>>4)
-	Controller.StickCalLeft.CenterX = uint16(response[4]&0xF)<<8 | uint16(response[3])
-	Controller.StickCalLeft.CenterY = (uint16(response[5]) << 4) | uint16(response[4]>>4)
-	Controller.StickCalLeft.MinX = uint16(response[7]&0xF)<<8 | uint16(response[6])
-	Controller.StickCalLeft.MinY = (uint16(response[8]) << 4) | uint16(response[7]>>4)
+	Controller.StickCalLeft.SetRange(switchreport.UnpackStick(response[0:3]), switchreport.UnpackStick(response[3:6]), switchreport.UnpackStick(response[6:9]))
 
-	response, err = Controller.ReadSPI([]byte{0x86, 0x60, 0x00, 0x00, 16})
+	response, err = Controller.ReadSPI(0x6086, 16)
 	if err != nil {
 		return err
 	}
-	Controller.StickCalLeft.DeadZone = uint16(response[4]&0xF)<<8 | uint16(response[3])
+	Controller.StickCalLeft.DeadZone = switchreport.UnpackStick(response[3:6]).X
 
 	// Request Factory Calibration Data
-	response, err = Controller.ReadSPI([]byte{0x46, 0x60, 0x00, 0x00, 9})
+	response, err = Controller.ReadSPI(0x6046, 9)
 	if err != nil {
 		return err
 	}
-	Controller.StickCalRight.MaxX = uint16(response[7]&0xF)<<8 | uint16(response[6])
-	Controller.StickCalRight.MaxY = (uint16(response[8]) << 4) | uint16(response[7]>>4)
-	Controller.StickCalRight.CenterX = uint16(response[1]&0xF)<<8 | uint16(response[0])
-	Controller.StickCalRight.CenterY = (uint16(response[2]) << 4) | uint16(response[1]>>4)
-	Controller.StickCalRight.MinX = uint16(response[4]&0xF)<<8 | uint16(response[3])
-	Controller.StickCalRight.MinY = (uint16(response[5]) << 4) | uint16(response[4]>>4)
+	Controller.StickCalRight.SetRange(switchreport.UnpackStick(response[6:9]), switchreport.UnpackStick(response[0:3]), switchreport.UnpackStick(response[3:6]))
 
-	response, err = Controller.ReadSPI([]byte{0x98, 0x60, 0x00, 0x00, 16})
+	response, err = Controller.ReadSPI(0x6098, 16)
 	if err != nil {
 		return err
 	}
-	Controller.StickCalRight.DeadZone = uint16(response[4]&0xF)<<8 | uint16(response[3])
+	Controller.StickCalRight.DeadZone = switchreport.UnpackStick(response[3:6]).X
 
-	response, err = Controller.ReadSPI([]byte{0x20, 0x60, 0x00, 0x00, 10})
+	response, err = Controller.ReadSPI(0x6020, 24)
 	if err != nil {
 		return err
 	}
-	Controller.AccNeutral[0] = binary.LittleEndian.Uint16(response[0:2])
-	Controller.AccNeutral[1] = binary.LittleEndian.Uint16(response[2:4])
-	Controller.AccNeutral[2] = binary.LittleEndian.Uint16(response[4:6])
+	Controller.setIMUCalibration(response)
 
-	response, err = Controller.ReadSPI([]byte{0x26, 0x60, 0x00, 0x00, 10})
+	err = Controller.readUserCalibration()
 	if err != nil {
 		return err
 	}
-	Controller.AccSensiti[0] = binary.LittleEndian.Uint16(response[0:2])
-	Controller.AccSensiti[1] = binary.LittleEndian.Uint16(response[2:4])
-	Controller.AccSensiti[2] = binary.LittleEndian.Uint16(response[4:6])
 
-	response, err = Controller.ReadSPI([]byte{0x2C, 0x60, 0x00, 0x00, 10})
+	err = Controller.readSerial()
 	if err != nil {
 		return err
 	}
-	Controller.GyrNeutral[0] = binary.LittleEndian.Uint16(response[0:2])
-	Controller.GyrNeutral[1] = binary.LittleEndian.Uint16(response[2:4])
-	Controller.GyrNeutral[2] = binary.LittleEndian.Uint16(response[4:6])
 
-	response, err = Controller.ReadSPI([]byte{0x32, 0x60, 0x00, 0x00, 10})
+	err = Controller.readColors()
 	if err != nil {
 		return err
 	}
-	Controller.GyrSensiti[0] = binary.LittleEndian.Uint16(response[0:2])
-	Controller.GyrSensiti[1] = binary.LittleEndian.Uint16(response[2:4])
-	Controller.GyrSensiti[2] = binary.LittleEndian.Uint16(response[4:6])
+
+	err = Controller.readDeviceInfo()
+	if err != nil {
+		return err
+	}
+
+	Controller.Profile, err = LoadProfile(Controller.DeviceKey())
+	if err != nil {
+		NotifyError(Controller.Name, "unable to load profile: "+err.Error())
+	}
+
+	err = Controller.loadStoredCalibration()
+	if err != nil {
+		NotifyError(Controller.Name, "unable to load calibration: "+err.Error())
+	}
 
 	// Set Player LED
 	_, err = Controller.Subcommand(0x30, []byte{1})
@@ -295,47 +361,248 @@ func (Controller *SwitchProController) Init() error {
 	return nil
 }
 
-func (Controller *SwitchProController) Subcommand(sc byte, cmd []byte) ([]byte, error) {
-	header := []byte{0x1, Controller.CommmandID, 0x0, 0x1, 0x40, 0x40, 0x0, 0x1, 0x40, 0x40, sc}
-	Controller.CommmandID++
-	err := Controller.Device.Write(append(header, cmd...))
-	if err != nil {
-		return nil, err
+// Restore undoes Init before the controller is let go: IMU and vibration
+// off, lights off, and over USB the timeout allowed again. It stops at the
+// first error, as the controller is likely gone.
+func (Controller *SwitchProController) Restore() error {
+	// IMU, vibration and player LEDs.
+	for _, command := range [][]byte{{0x40, 0x0}, {0x48, 0x0}, {0x30, 0x0}} {
+		_, err := Controller.Subcommand(command[0], command[1:])
+		if err != nil {
+			return err
+		}
 	}
-	for i := 0; i < 10; i++ {
-		response, err := Controller.Device.Read()
+	if Controller.DeviceType != SwitchDeviceJoyConLeft {
+		_, err := Controller.Subcommand(0x38, []byte{0x0})
 		if err != nil {
-			return nil, err
+			return err
 		}
-		if response[0] == 0x21 && response[14] == sc {
-			return response, nil
+	}
+
+	if Controller.Transport == TransportUSB {
+		return Controller.Device.Write([]byte{0x80, usbCommandTimeout})
+	}
+	return nil
+}
+
+func (Controller *SwitchProController) readLoop() {
+	defer close(Controller.done)
+
+	for {
+		buf, err := Controller.Device.Read()
+		if err != nil {
+			Controller.readErr = err
+			return
+		}
+		if len(buf) == 0 {
+			Controller.readErr = ErrDisconnected
+			return
+		}
+
+		if buf[0] == switchreport.SubcommandReplyID || buf[0] == switchreport.USBReplyID {
+			select {
+			case Controller.replies <- buf:
+			default:
+			}
+			continue
+		}
+
+		report := inputReport{buf, time.Now()}
+		select {
+		case Controller.input <- report:
+		default:
+			// Drop the oldest report to make room, the reader never blocks.
+			select {
+			case <-Controller.input:
+			default:
+			}
+			select {
+			case Controller.input <- report:
+			default:
+			}
 		}
 	}
-	return nil, nil
 }
 
-func (Controller *SwitchProController) ReadSPI(cmd []byte) ([]byte, error) {
-	for i := 0; i < 10; i++ {
-		response, err := Controller.Subcommand(0x10, cmd)
+// usbHandshake switches a controller connected over USB to the 3Mbit link
+// and keeps it from timing out, after which it sends 0x30 reports and takes
+// subcommands as over Bluetooth.
+func (Controller *SwitchProController) usbHandshake() error {
+	for _, cmd := range []byte{usbCommandStatus, usbCommandHandshake, usbCommandHighSpeed, usbCommandHandshake} {
+		err := Controller.usbCommand(cmd)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The controller does not answer this one.
+	return Controller.Device.Write([]byte{0x80, usbCommandNoTimeout})
+}
+
+func (Controller *SwitchProController) usbCommand(cmd byte) error {
+	for attempt := 0; attempt < subcommandRetries; attempt++ {
+		err := Controller.Device.Write([]byte{0x80, cmd})
+		if err != nil {
+			return err
+		}
+
+		err = Controller.waitUSBReply(cmd)
+		if err == ErrNoAck {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("USB command 0x%02X: %w", cmd, err)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("USB command 0x%02X: %w", cmd, ErrNoAck)
+}
+
+func (Controller *SwitchProController) waitUSBReply(cmd byte) error {
+	deadline := time.NewTimer(subcommandTimeout)
+	defer deadline.Stop()
+
+	for {
+		select {
+		case raw := <-Controller.replies:
+			reply, err := switchreport.ParseUSBReply(raw)
+			if err != nil || reply.Command != cmd {
+				continue
+			}
+			return nil
+		case <-Controller.done:
+			return Controller.readErr
+		case <-deadline.C:
+			return ErrNoAck
+		}
+	}
+}
+
+// ReadInput returns the next report that is not a command reply.
+func (Controller *SwitchProController) ReadInput() ([]byte, error) {
+	select {
+	case report := <-Controller.input:
+		Controller.inputAt = report.at
+		return report.data, nil
+	case <-Controller.done:
+		select {
+		case report := <-Controller.input:
+			Controller.inputAt = report.at
+			return report.data, nil
+		default:
+		}
+		return nil, Controller.readErr
+	}
+}
+
+// InputTime is the time the report last returned by ReadInput was read
+// from the device.
+func (Controller *SwitchProController) InputTime() time.Time {
+	return Controller.inputAt
+}
+
+// Subcommand sends a subcommand and waits for its acknowledgement, retrying
+// when none arrives in time.
+func (Controller *SwitchProController) Subcommand(sc byte, cmd []byte) (*switchreport.SubcommandReply, error) {
+	return Controller.subcommand(sc, cmd, nil)
+}
+
+// subcommand is Subcommand with an extra check on the reply, so late
+// replies to an earlier attempt of the same subcommand are skipped.
+func (Controller *SwitchProController) subcommand(sc byte, cmd []byte, match func(*switchreport.SubcommandReply) bool) (*switchreport.SubcommandReply, error) {
+	Controller.commandMutex.Lock()
+	defer Controller.commandMutex.Unlock()
+
+	for attempt := 0; attempt < subcommandRetries; attempt++ {
+		header := []byte{0x1, Controller.CommmandID, 0x0, 0x1, 0x40, 0x40, 0x0, 0x1, 0x40, 0x40, sc}
+		Controller.CommmandID = (Controller.CommmandID + 1) & 0xF
+		err := Controller.Device.Write(append(header, cmd...))
 		if err != nil {
 			return nil, err
 		}
-		if response[15] == cmd[0] && response[16] == cmd[1] {
-			return response[20:], nil
+
+		reply, err := Controller.waitReply(sc, match)
+		if err == ErrNoAck {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("subcommand 0x%02X: %w", sc, err)
+		}
+		return reply, nil
+	}
+
+	return nil, fmt.Errorf("subcommand 0x%02X: %w", sc, ErrNoAck)
+}
+
+func (Controller *SwitchProController) waitReply(sc byte, match func(*switchreport.SubcommandReply) bool) (*switchreport.SubcommandReply, error) {
+	deadline := time.NewTimer(subcommandTimeout)
+	defer deadline.Stop()
+
+	for {
+		select {
+		case raw := <-Controller.replies:
+			if raw[0] != switchreport.SubcommandReplyID {
+				continue
+			}
+			reply, err := switchreport.ParseSubcommandReply(raw)
+			if err != nil {
+				return nil, ErrShortReply
+			}
+			if reply.Subcommand != sc || (match != nil && !match(reply)) {
+				continue
+			}
+			if !reply.Success() {
+				return nil, ErrNack
+			}
+			return reply, nil
+		case <-Controller.done:
+			return nil, Controller.readErr
+		case <-deadline.C:
+			return nil, ErrNoAck
 		}
 	}
+}
+
+// ReadSPI reads length bytes of the SPI flash at address.
+func (Controller *SwitchProController) ReadSPI(address uint32, length byte) ([]byte, error) {
+	cmd := make([]byte, 5)
+	binary.LittleEndian.PutUint32(cmd, address)
+	cmd[4] = length
+
+	// Malformed replies are skipped like late ones, so the read is retried.
+	reply, err := Controller.subcommand(0x10, cmd, func(reply *switchreport.SubcommandReply) bool {
+		replyAddress, _, err := reply.SPIData()
+		return err == nil && replyAddress == address
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	_, data, err := reply.SPIData()
+	if err != nil || len(data) < int(length) {
+		return nil, fmt.Errorf("SPI read at 0x%X: %w", address, ErrShortReply)
+	}
 
-	return nil, nil
+	return data, nil
 }
 
 type StickCalibration struct {
-	MaxX     uint16
-	MaxY     uint16
-	CenterX  uint16
-	CenterY  uint16
-	MinX     uint16
-	MinY     uint16
-	DeadZone uint16
+	MaxX     uint16 `json:"maxX"`
+	MaxY     uint16 `json:"maxY"`
+	CenterX  uint16 `json:"centerX"`
+	CenterY  uint16 `json:"centerY"`
+	MinX     uint16 `json:"minX"`
+	MinY     uint16 `json:"minY"`
+	DeadZone uint16 `json:"deadZone"`
+}
+
+// SetRange sets the calibration from the offsets of the stick maximum and
+// minimum from its center, as stored in the SPI flash.
+func (StickCal *StickCalibration) SetRange(max, center, min switchreport.Stick) {
+	StickCal.MaxX, StickCal.MaxY = max.X, max.Y
+	StickCal.CenterX, StickCal.CenterY = center.X, center.Y
+	StickCal.MinX, StickCal.MinY = min.X, min.Y
 }
 
 func (StickCal StickCalibration) StickCalibrate(ThumbX uint16, ThumbY uint16) (float32, float32) {
@@ -359,3 +626,39 @@ func (StickCal StickCalibration) StickCalibrate(ThumbX uint16, ThumbY uint16) (f
 
 	return x, y
 }
+
+func StickToInt16(v float32) int16 {
+	if v > 1.0 {
+		v = 1.0
+	} else if v < -1.0 {
+		v = -1.0
+	}
+
+	return int16(v * 32767)
+}
+
+func (report *Xbox360ControllerReport) SetButtonsFromSwitch(ButtonsR, ButtonsM, ButtonsL byte) {
+	report.MaybeSetButton(Xbox360ControllerButtonX, ButtonsR&(1<<SwitchProControllerButtonY) != 0)
+	report.MaybeSetButton(Xbox360ControllerButtonY, ButtonsR&(1<<SwitchProControllerButtonX) != 0)
+	report.MaybeSetButton(Xbox360ControllerButtonA, ButtonsR&(1<<SwitchProControllerButtonB) != 0)
+	report.MaybeSetButton(Xbox360ControllerButtonB, ButtonsR&(1<<SwitchProControllerButtonA) != 0)
+	report.MaybeSetButton(Xbox360ControllerButtonRightShoulder, ButtonsR&(1<<SwitchProControllerButtonRightShoulder) != 0)
+	if ButtonsR&(1<<SwitchProControllerButtonRightTrigger) != 0 {
+		report.SetRightTrigger(255)
+	}
+
+	report.MaybeSetButton(Xbox360ControllerButtonStart, ButtonsM&(1<<SwitchProControllerButtonPlus) != 0)
+	report.MaybeSetButton(Xbox360ControllerButtonBack, ButtonsM&(1<<SwitchProControllerButtonMinus) != 0)
+	report.MaybeSetButton(Xbox360ControllerButtonRightThumb, ButtonsM&(1<<SwitchProControllerButtonRightThumb) != 0)
+	report.MaybeSetButton(Xbox360ControllerButtonLeftThumb, ButtonsM&(1<<SwitchProControllerButtonLeftThumb) != 0)
+	report.MaybeSetButton(Xbox360ControllerButtonGuide, ButtonsM&(1<<SwitchProControllerButtonHome) != 0)
+
+	report.MaybeSetButton(Xbox360ControllerButtonUp, ButtonsL&(1<<SwitchProControllerButtonUp) != 0)
+	report.MaybeSetButton(Xbox360ControllerButtonDown, ButtonsL&(1<<SwitchProControllerButtonDown) != 0)
+	report.MaybeSetButton(Xbox360ControllerButtonLeft, ButtonsL&(1<<SwitchProControllerButtonLeft) != 0)
+	report.MaybeSetButton(Xbox360ControllerButtonRight, ButtonsL&(1<<SwitchProControllerButtonRight) != 0)
+	report.MaybeSetButton(Xbox360ControllerButtonLeftShoulder, ButtonsL&(1<<SwitchProControllerButtonLeftShoulder) != 0)
+	if ButtonsL&(1<<SwitchProControllerButtonLeftTrigger) != 0 {
+		report.SetLeftTrigger(255)
+	}
+}
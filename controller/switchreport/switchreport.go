@@ -0,0 +1,328 @@
+// Package switchreport decodes the input reports of the Switch Pro
+// Controller and the Joy-Cons. It only works on byte slices, so it can be
+// used without a device.
+package switchreport
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	StandardReportID        = 0x30
+	SubcommandReplyID       = 0x21
+	SimpleHIDReportID       = 0x3F
+	USBReplyID              = 0x81
+	StandardReportLength    = 13
+	StandardIMUReportLength = 49
+	SubcommandReplyLength   = 15
+	SimpleHIDReportLength   = 12
+	USBReplyLength          = 2
+	SPIReplyHeaderLength    = 5
+)
+
+var (
+	ErrShortReport   = errors.New("switchreport: report too short")
+	ErrWrongReportID = errors.New("switchreport: unexpected report ID")
+)
+
+// Stick is a raw 12-bit stick position.
+type Stick struct {
+	X uint16
+	Y uint16
+}
+
+// UnpackStick unpacks the two 12-bit values stored in 3 bytes, as used by
+// stick positions and the stick calibration data.
+func UnpackStick(data []byte) Stick {
+	return Stick{
+		X: uint16(data[1]&0xF)<<8 | uint16(data[0]),
+		Y: uint16(data[2])<<4 | uint16(data[1]>>4),
+	}
+}
+
+// PackStick is the reverse of UnpackStick.
+func PackStick(stick Stick, data []byte) {
+	data[0] = byte(stick.X)
+	data[1] = byte(stick.X>>8)&0xF | byte(stick.Y<<4)
+	data[2] = byte(stick.Y >> 4)
+}
+
+// Buttons holds the button bytes of the right side, the shared middle
+// byte and the left side, in report order.
+type Buttons struct {
+	Right  byte
+	Shared byte
+	Left   byte
+}
+
+// Battery levels, from the high nibble of byte 2.
+const (
+	BatteryEmpty    = 0
+	BatteryCritical = 2
+	BatteryLow      = 4
+	BatteryMedium   = 6
+	BatteryFull     = 8
+)
+
+type Battery struct {
+	Level    byte
+	Charging bool
+}
+
+// Percent converts the level to the percentage at the top of its bucket.
+func (battery Battery) Percent() int {
+	if battery.Level >= BatteryFull {
+		return 100
+	}
+	return int(battery.Level) * 25 / 2
+}
+
+// ConnectionInfo is the low nibble of byte 2. Bits 1-2 are the controller
+// kind (0 Pro Controller or Charging Grip, 3 Joy-Con) and bit 0 is set when
+// powered over USB.
+type ConnectionInfo byte
+
+func (info ConnectionInfo) IsJoyCon() bool {
+	return (info>>1)&0x3 == 3
+}
+
+func (info ConnectionInfo) USBPowered() bool {
+	return info&0x1 != 0
+}
+
+// IMUFrame is one of the three 5ms samples of a 0x30 report, raw.
+type IMUFrame struct {
+	Accel [3]int16
+	Gyro  [3]int16
+}
+
+type Report interface {
+	ReportID() byte
+}
+
+// StandardReport is the 0x30 report, and the input part of 0x21 replies.
+type StandardReport struct {
+	ID         byte
+	Timer      byte
+	Battery    Battery
+	Connection ConnectionInfo
+	Buttons    Buttons
+	LeftStick  Stick
+	RightStick Stick
+	Vibrator   byte
+	HasIMU     bool
+	IMU        [3]IMUFrame
+}
+
+func (report *StandardReport) ReportID() byte {
+	return report.ID
+}
+
+func parseInput(raw []byte, report *StandardReport) {
+	report.ID = raw[0]
+	report.Timer = raw[1]
+	report.Battery = Battery{Level: (raw[2] >> 4) & 0xE, Charging: raw[2]&0x10 != 0}
+	report.Connection = ConnectionInfo(raw[2] & 0xF)
+	report.Buttons = Buttons{raw[3], raw[4], raw[5]}
+	report.LeftStick = UnpackStick(raw[6:9])
+	report.RightStick = UnpackStick(raw[9:12])
+	report.Vibrator = raw[12]
+}
+
+// ParseStandard decodes a 0x30 report. The IMU frames are only present
+// when the report is long enough, Joy-Cons with the IMU off send them
+// zeroed.
+func ParseStandard(raw []byte) (*StandardReport, error) {
+	if len(raw) < StandardReportLength {
+		return nil, ErrShortReport
+	}
+	if raw[0] != StandardReportID {
+		return nil, ErrWrongReportID
+	}
+
+	report := &StandardReport{}
+	parseInput(raw, report)
+
+	if len(raw) >= StandardIMUReportLength {
+		report.HasIMU = true
+		for i := 0; i < 3; i++ {
+			frame := raw[13+i*12:]
+			for axis := 0; axis < 3; axis++ {
+				report.IMU[i].Accel[axis] = int16(binary.LittleEndian.Uint16(frame[axis*2:]))
+				report.IMU[i].Gyro[axis] = int16(binary.LittleEndian.Uint16(frame[6+axis*2:]))
+			}
+		}
+	}
+
+	return report, nil
+}
+
+// SubcommandReply is the 0x21 report answering a subcommand.
+type SubcommandReply struct {
+	StandardReport
+	Ack        byte
+	Subcommand byte
+	Data       []byte
+}
+
+// Success reports whether the controller acknowledged the subcommand. The
+// low bits of the ACK byte describe the kind of data in the reply.
+func (reply *SubcommandReply) Success() bool {
+	return reply.Ack&0x80 != 0
+}
+
+func ParseSubcommandReply(raw []byte) (*SubcommandReply, error) {
+	if len(raw) < SubcommandReplyLength {
+		return nil, ErrShortReport
+	}
+	if raw[0] != SubcommandReplyID {
+		return nil, ErrWrongReportID
+	}
+
+	reply := &SubcommandReply{}
+	parseInput(raw, &reply.StandardReport)
+	reply.Ack = raw[13]
+	reply.Subcommand = raw[14]
+	reply.Data = raw[15:]
+
+	return reply, nil
+}
+
+// SPIData decodes the reply to a 0x10 SPI flash read: the address and
+// length that were read, followed by the data.
+func (reply *SubcommandReply) SPIData() (uint32, []byte, error) {
+	if len(reply.Data) < SPIReplyHeaderLength {
+		return 0, nil, ErrShortReport
+	}
+
+	address := binary.LittleEndian.Uint32(reply.Data)
+	length := int(reply.Data[4])
+	if len(reply.Data) < SPIReplyHeaderLength+length {
+		return 0, nil, fmt.Errorf("SPI read of %d bytes at 0x%X: %w", length, address, ErrShortReport)
+	}
+
+	return address, reply.Data[SPIReplyHeaderLength : SPIReplyHeaderLength+length], nil
+}
+
+// Buttons of the 0x3F report, byte 1 in the low bits and byte 2 in the
+// high bits.
+const (
+	SimpleButtonDown    = 0
+	SimpleButtonRight   = 1
+	SimpleButtonLeft    = 2
+	SimpleButtonUp      = 3
+	SimpleButtonL       = 4
+	SimpleButtonR       = 5
+	SimpleButtonZL      = 6
+	SimpleButtonZR      = 7
+	SimpleButtonMinus   = 8
+	SimpleButtonPlus    = 9
+	SimpleButtonLStick  = 10
+	SimpleButtonRStick  = 11
+	SimpleButtonHome    = 12
+	SimpleButtonCapture = 13
+	SimpleButtonSL      = 14
+	SimpleButtonSR      = 15
+
+	SimpleHatNeutral = 8
+)
+
+// SimpleHIDReport is the 0x3F report sent before the controller is set to
+// the standard report mode. Sticks are 16-bit and uncalibrated.
+type SimpleHIDReport struct {
+	Buttons    uint16
+	Hat        byte
+	LeftStick  Stick
+	RightStick Stick
+}
+
+func (report *SimpleHIDReport) ReportID() byte {
+	return SimpleHIDReportID
+}
+
+func (report *SimpleHIDReport) Pressed(button int) bool {
+	return report.Buttons&(1<<uint(button)) != 0
+}
+
+func ParseSimpleHID(raw []byte) (*SimpleHIDReport, error) {
+	if len(raw) < SimpleHIDReportLength {
+		return nil, ErrShortReport
+	}
+	if raw[0] != SimpleHIDReportID {
+		return nil, ErrWrongReportID
+	}
+
+	return &SimpleHIDReport{
+		Buttons: binary.LittleEndian.Uint16(raw[1:]),
+		Hat:     raw[3],
+		LeftStick: Stick{
+			X: binary.LittleEndian.Uint16(raw[4:]),
+			Y: binary.LittleEndian.Uint16(raw[6:]),
+		},
+		RightStick: Stick{
+			X: binary.LittleEndian.Uint16(raw[8:]),
+			Y: binary.LittleEndian.Uint16(raw[10:]),
+		},
+	}, nil
+}
+
+// USBReply is the 0x81 report answering a 0x80 USB command.
+type USBReply struct {
+	Command byte
+	Data    []byte
+}
+
+func (reply *USBReply) ReportID() byte {
+	return USBReplyID
+}
+
+func ParseUSBReply(raw []byte) (*USBReply, error) {
+	if len(raw) < USBReplyLength {
+		return nil, ErrShortReport
+	}
+	if raw[0] != USBReplyID {
+		return nil, ErrWrongReportID
+	}
+
+	return &USBReply{Command: raw[1], Data: raw[2:]}, nil
+}
+
+// Parse decodes any of the supported reports.
+func Parse(raw []byte) (Report, error) {
+	if len(raw) == 0 {
+		return nil, ErrShortReport
+	}
+
+	// Each case returns on its own so a failed parse gives a nil Report
+	// instead of a typed nil pointer.
+	switch raw[0] {
+	case StandardReportID:
+		report, err := ParseStandard(raw)
+		if err != nil {
+			return nil, err
+		}
+		return report, nil
+	case SubcommandReplyID:
+		reply, err := ParseSubcommandReply(raw)
+		if err != nil {
+			return nil, err
+		}
+		return reply, nil
+	case SimpleHIDReportID:
+		report, err := ParseSimpleHID(raw)
+		if err != nil {
+			return nil, err
+		}
+		return report, nil
+	case USBReplyID:
+		reply, err := ParseUSBReply(raw)
+		if err != nil {
+			return nil, err
+		}
+		return reply, nil
+	}
+
+	return nil, ErrWrongReportID
+}
@@ -0,0 +1,293 @@
+package switchreport
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the decoded reports of testdata")
+
+// readCapture returns the reads of a file in the HID capture format of the
+// server, by line number.
+func readCapture(t testing.TB, path string) (lines []int, reports [][]byte) {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") || fields[1] != "r" {
+			continue
+		}
+		data, err := hex.DecodeString(fields[2])
+		if err != nil {
+			t.Fatalf("%s:%d: %v", path, line, err)
+		}
+		lines = append(lines, line)
+		reports = append(reports, data)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return lines, reports
+}
+
+// decoded is the JSON form of a report read from a capture.
+type decoded struct {
+	Line   int    `json:"line"`
+	Type   string `json:"type,omitempty"`
+	Error  string `json:"error,omitempty"`
+	Report Report `json:"report,omitempty"`
+	// SPI is the address and data of SPI read replies, in hex.
+	SPI string `json:"spi,omitempty"`
+}
+
+func decodeCapture(t *testing.T, path string) []decoded {
+	lines, reports := readCapture(t, path)
+	var result []decoded
+	for i, raw := range reports {
+		report, err := Parse(raw)
+		entry := decoded{Line: lines[i]}
+		if err != nil {
+			entry.Error = err.Error()
+			result = append(result, entry)
+			continue
+		}
+
+		entry.Type = fmt.Sprintf("%T", report)
+		entry.Report = report
+		if reply, ok := report.(*SubcommandReply); ok && reply.Subcommand == 0x10 {
+			address, data, err := reply.SPIData()
+			if err != nil {
+				entry.SPI = err.Error()
+			} else {
+				entry.SPI = fmt.Sprintf("%X %X", address, data)
+			}
+		}
+		result = append(result, entry)
+	}
+	return result
+}
+
+// TestCaptures decodes the captures of testdata and compares the result
+// with the .json file next to each. The .synthetic captures are written by
+// hand from the documented report layouts, not recorded from controllers,
+// so they pin down the parsers but do not prove them against hardware.
+// Run with -update to rewrite the .json files.
+func TestCaptures(t *testing.T) {
+	captures, err := filepath.Glob(filepath.Join("testdata", "*.hidcap"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(captures) == 0 {
+		t.Fatal("no captures in testdata")
+	}
+
+	for _, capture := range captures {
+		t.Run(filepath.Base(capture), func(t *testing.T) {
+			got, err := json.MarshalIndent(decodeCapture(t, capture), "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, '\n')
+
+			decodedPath := strings.TrimSuffix(capture, ".hidcap") + ".json"
+			if *update {
+				if err := os.WriteFile(decodedPath, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(decodedPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("decoded capture differs from %s:\n%s", decodedPath, got)
+			}
+		})
+	}
+}
+
+func TestProControllerUSBCapture(t *testing.T) {
+	_, reports := readCapture(t, filepath.Join("testdata", "procon_usb.synthetic.hidcap"))
+
+	reply, err := ParseUSBReply(reports[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Command != 0x01 || reply.Data[1] != 0x03 {
+		t.Errorf("status reply %+v", reply)
+	}
+
+	spi, err := ParseSubcommandReply(reports[5])
+	if err != nil {
+		t.Fatal(err)
+	}
+	address, data, err := spi.SPIData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !spi.Success() || address != 0x603D || len(data) != 9 {
+		t.Errorf("SPI reply at 0x%X with %d bytes", address, len(data))
+	}
+	if center := UnpackStick(data[3:6]); center != (Stick{0x7F8, 0x7A2}) {
+		t.Errorf("left stick center %+v", center)
+	}
+
+	// ZR and ZL held, left stick down, right stick left and up.
+	report, err := ParseStandard(reports[11])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Buttons != (Buttons{0x80, 0x00, 0x80}) {
+		t.Errorf("buttons %+v", report.Buttons)
+	}
+	if report.LeftStick != (Stick{0x7F8, 0x1F4}) || report.RightStick != (Stick{0x3A0, 0xC80}) {
+		t.Errorf("sticks %+v %+v", report.LeftStick, report.RightStick)
+	}
+	if !report.HasIMU || report.IMU[2].Gyro != [3]int16{1560, -240, 44} || report.IMU[0].Accel != [3]int16{512, -301, 3870} {
+		t.Errorf("IMU %+v", report.IMU)
+	}
+	if report.Battery.Percent() != 100 || !report.Battery.Charging || !report.Connection.USBPowered() || report.Connection.IsJoyCon() {
+		t.Errorf("battery %+v, connection %x", report.Battery, report.Connection)
+	}
+}
+
+func TestJoyConCapture(t *testing.T) {
+	_, reports := readCapture(t, filepath.Join("testdata", "joycon_left_bt.synthetic.hidcap"))
+
+	report, err := ParseStandard(reports[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Connection.IsJoyCon() || report.Connection.USBPowered() {
+		t.Errorf("connection %x", report.Connection)
+	}
+	if report.Buttons.Shared != 0x20 || report.Buttons.Left != 0x41 {
+		t.Errorf("buttons %+v", report.Buttons)
+	}
+
+	if _, err := Parse(reports[3]); !errors.Is(err, ErrShortReport) {
+		t.Errorf("truncated reply: %v", err)
+	}
+}
+
+// addCaptureSeeds seeds a fuzz test with the reports of every capture.
+func addCaptureSeeds(f *testing.F) {
+	captures, _ := filepath.Glob(filepath.Join("testdata", "*.hidcap"))
+	for _, capture := range captures {
+		_, reports := readCapture(f, capture)
+		for _, raw := range reports {
+			f.Add(raw)
+		}
+	}
+	f.Add([]byte{})
+	f.Add([]byte{StandardReportID})
+	f.Add([]byte{SubcommandReplyID})
+	f.Add([]byte{USBReplyID})
+}
+
+func FuzzParse(f *testing.F) {
+	addCaptureSeeds(f)
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		report, err := Parse(raw)
+		if err != nil {
+			if report != nil {
+				t.Fatalf("report %+v with error %v", report, err)
+			}
+			return
+		}
+		if report.ReportID() != raw[0] {
+			t.Fatalf("report ID %02X from %02X", report.ReportID(), raw[0])
+		}
+	})
+}
+
+func FuzzParseStandard(f *testing.F) {
+	addCaptureSeeds(f)
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		report, err := ParseStandard(raw)
+		if err != nil {
+			return
+		}
+		if len(raw) < StandardReportLength || raw[0] != StandardReportID {
+			t.Fatalf("accepted %X", raw)
+		}
+		if report.HasIMU != (len(raw) >= StandardIMUReportLength) {
+			t.Fatalf("HasIMU %v with %d bytes", report.HasIMU, len(raw))
+		}
+		if report.LeftStick.X > 0xFFF || report.LeftStick.Y > 0xFFF || report.RightStick.X > 0xFFF || report.RightStick.Y > 0xFFF {
+			t.Fatalf("sticks out of 12 bits: %+v %+v", report.LeftStick, report.RightStick)
+		}
+		if percent := report.Battery.Percent(); percent < 0 || percent > 100 {
+			t.Fatalf("battery at %d%%", percent)
+		}
+	})
+}
+
+func FuzzParseSubcommandReply(f *testing.F) {
+	addCaptureSeeds(f)
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		reply, err := ParseSubcommandReply(raw)
+		if err != nil {
+			return
+		}
+		if len(raw) < SubcommandReplyLength || raw[0] != SubcommandReplyID {
+			t.Fatalf("accepted %X", raw)
+		}
+		if reply.Ack != raw[13] || reply.Subcommand != raw[14] || len(reply.Data) != len(raw)-SubcommandReplyLength {
+			t.Fatalf("reply %+v from %X", reply, raw)
+		}
+
+		address, data, err := reply.SPIData()
+		if err != nil {
+			return
+		}
+		if int(reply.Data[4]) != len(data) {
+			t.Fatalf("SPI read at 0x%X of %d bytes gave %d", address, reply.Data[4], len(data))
+		}
+	})
+}
+
+func FuzzParseUSBReply(f *testing.F) {
+	addCaptureSeeds(f)
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		reply, err := ParseUSBReply(raw)
+		if err != nil {
+			return
+		}
+		if len(raw) < USBReplyLength || raw[0] != USBReplyID {
+			t.Fatalf("accepted %X", raw)
+		}
+		if reply.Command != raw[1] || len(reply.Data) != len(raw)-USBReplyLength {
+			t.Fatalf("reply %+v from %X", reply, raw)
+		}
+	})
+}
+
+func FuzzStick(f *testing.F) {
+	f.Add(uint16(0x7F8), uint16(0x7A2))
+	f.Add(uint16(0xFFF), uint16(0))
+	f.Fuzz(func(t *testing.T, x, y uint16) {
+		stick := Stick{x & 0xFFF, y & 0xFFF}
+		data := make([]byte, 3)
+		PackStick(stick, data)
+		if got := UnpackStick(data); got != stick {
+			t.Fatalf("%+v packed and unpacked as %+v", stick, got)
+		}
+	})
+}
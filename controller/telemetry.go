@@ -0,0 +1,348 @@
+package controller
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Upper bounds of the buckets of the latency histograms, in milliseconds.
+// A last bucket takes everything above.
+var LatencyBuckets = []float64{0.25, 0.5, 1, 2, 4, 8, 16, 32, 64, 128, 256, 512}
+
+const (
+	// Histograms cover the last telemetryWindows windows.
+	telemetryWindow  = 10 * time.Second
+	telemetryWindows = 6
+
+	webPingInterval = 2 * time.Second
+	// The clock offset comes from the ping with the shortest round trip
+	// among the last pingSamples.
+	pingSamples = 8
+)
+
+type histogramWindow struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+	max    float64
+}
+
+// RollingHistogram counts values in fixed buckets over the last minute.
+type RollingHistogram struct {
+	bounds  []float64
+	windows [telemetryWindows]histogramWindow
+	current int
+	start   time.Time
+}
+
+func NewRollingHistogram(bounds []float64) *RollingHistogram {
+	histogram := &RollingHistogram{bounds: bounds}
+	for i := range histogram.windows {
+		histogram.windows[i].counts = make([]uint64, len(bounds)+1)
+	}
+	return histogram
+}
+
+func (window *histogramWindow) reset() {
+	for i := range window.counts {
+		window.counts[i] = 0
+	}
+	window.count, window.sum, window.max = 0, 0, 0
+}
+
+func (histogram *RollingHistogram) rotate(now time.Time) {
+	if histogram.start.IsZero() || now.Sub(histogram.start) >= telemetryWindow*telemetryWindows {
+		for i := range histogram.windows {
+			histogram.windows[i].reset()
+		}
+		histogram.start = now
+		return
+	}
+	for now.Sub(histogram.start) >= telemetryWindow {
+		histogram.current = (histogram.current + 1) % telemetryWindows
+		histogram.windows[histogram.current].reset()
+		histogram.start = histogram.start.Add(telemetryWindow)
+	}
+}
+
+func (histogram *RollingHistogram) Observe(value float64, now time.Time) {
+	histogram.rotate(now)
+
+	window := &histogram.windows[histogram.current]
+	bucket := len(histogram.bounds)
+	for i, bound := range histogram.bounds {
+		if value <= bound {
+			bucket = i
+			break
+		}
+	}
+	window.counts[bucket]++
+	window.count++
+	window.sum += value
+	if value > window.max {
+		window.max = value
+	}
+}
+
+// HistogramSnapshot is the JSON view of a histogram. Counts has one more
+// entry than Bounds, for the values above the last bound. Percentiles are
+// the upper bounds of their buckets.
+type HistogramSnapshot struct {
+	Bounds []float64 `json:"bounds"`
+	Counts []uint64  `json:"counts"`
+	Count  uint64    `json:"count"`
+	Mean   float64   `json:"mean"`
+	Max    float64   `json:"max"`
+	P50    float64   `json:"p50"`
+	P95    float64   `json:"p95"`
+	P99    float64   `json:"p99"`
+}
+
+func (histogram *RollingHistogram) Snapshot(now time.Time) HistogramSnapshot {
+	histogram.rotate(now)
+
+	snapshot := HistogramSnapshot{Bounds: histogram.bounds, Counts: make([]uint64, len(histogram.bounds)+1)}
+	var sum float64
+	for _, window := range histogram.windows {
+		for i, count := range window.counts {
+			snapshot.Counts[i] += count
+		}
+		snapshot.Count += window.count
+		sum += window.sum
+		if window.max > snapshot.Max {
+			snapshot.Max = window.max
+		}
+	}
+	if snapshot.Count == 0 {
+		return snapshot
+	}
+
+	snapshot.Mean = sum / float64(snapshot.Count)
+	snapshot.P50 = histogram.percentile(snapshot, 0.50)
+	snapshot.P95 = histogram.percentile(snapshot, 0.95)
+	snapshot.P99 = histogram.percentile(snapshot, 0.99)
+	return snapshot
+}
+
+func (histogram *RollingHistogram) percentile(snapshot HistogramSnapshot, p float64) float64 {
+	rank := uint64(math.Ceil(p * float64(snapshot.Count)))
+	var seen uint64
+	for i, count := range snapshot.Counts {
+		seen += count
+		if seen >= rank {
+			if i < len(histogram.bounds) {
+				return histogram.bounds[i]
+			}
+			break
+		}
+	}
+	return snapshot.Max
+}
+
+type clockSample struct {
+	rtt    float64
+	offset float64
+}
+
+// Telemetry measures the input timing of a session, in milliseconds.
+//
+// Web clients number their frames and stamp them with their clock. Gaps in
+// the numbers count as dropped frames and numbers at or below the last one
+// as out of order frames. Pings give the round trip time and the offset of
+// the client clock, from which the one way latency of each frame follows.
+// Local devices give the time from reading a report to handing it to the
+// pipeline.
+type Telemetry struct {
+	mutex  sync.Mutex
+	source string
+
+	arrival *RollingHistogram
+	jitter  *RollingHistogram
+	latency *RollingHistogram
+	rtt     *RollingHistogram
+	hid     *RollingHistogram
+
+	frames      uint64
+	outOfOrder  uint64
+	dropped     uint64
+	lastSeq     uint64
+	lastArrival time.Time
+	lastClient  float64
+	jitterMs    float64
+
+	nextPing  uint32
+	pings     map[uint32]time.Time
+	samples   []clockSample
+	offset    float64
+	hasOffset bool
+}
+
+// TelemetrySnapshot is the JSON view of the telemetry of a session.
+type TelemetrySnapshot struct {
+	Frames     uint64 `json:"frames"`
+	OutOfOrder uint64 `json:"outOfOrder"`
+	Dropped    uint64 `json:"dropped"`
+	// JitterMs is the smoothed transit time variation of RFC 3550.
+	JitterMs float64 `json:"jitterMs"`
+	// ClockOffsetMs is the client clock minus the server clock.
+	ClockOffsetMs *float64 `json:"clockOffsetMs,omitempty"`
+
+	InterArrival HistogramSnapshot `json:"interArrival"`
+	Jitter       HistogramSnapshot `json:"jitter"`
+	Latency      HistogramSnapshot `json:"latency"`
+	RoundTrip    HistogramSnapshot `json:"roundTrip"`
+	HIDToSend    HistogramSnapshot `json:"hidToSend"`
+}
+
+// NewTelemetry returns the telemetry of a session of a source, which also
+// labels its share of the latency metrics.
+func NewTelemetry(source string) *Telemetry {
+	return &Telemetry{
+		source:  source,
+		arrival: NewRollingHistogram(LatencyBuckets),
+		jitter:  NewRollingHistogram(LatencyBuckets),
+		latency: NewRollingHistogram(LatencyBuckets),
+		rtt:     NewRollingHistogram(LatencyBuckets),
+		hid:     NewRollingHistogram(LatencyBuckets),
+		pings:   make(map[uint32]time.Time),
+	}
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func unixMilliseconds(t time.Time) float64 {
+	return float64(t.UnixNano()) / float64(time.Millisecond)
+}
+
+// Frame counts a web input frame received at now. seq and clientTime are
+// 0 for clients that do not send them.
+func (telemetry *Telemetry) Frame(seq uint64, clientTime float64, now time.Time) {
+	telemetry.mutex.Lock()
+	defer telemetry.mutex.Unlock()
+
+	telemetry.frames++
+	if seq != 0 {
+		switch {
+		case telemetry.lastSeq != 0 && seq <= telemetry.lastSeq:
+			telemetry.outOfOrder++
+			// It was counted as dropped when the numbers skipped it.
+			if telemetry.dropped > 0 {
+				telemetry.dropped--
+			}
+			return
+		case telemetry.lastSeq != 0:
+			telemetry.dropped += seq - telemetry.lastSeq - 1
+		}
+		telemetry.lastSeq = seq
+	}
+
+	if !telemetry.lastArrival.IsZero() {
+		interval := now.Sub(telemetry.lastArrival)
+		telemetry.arrival.Observe(milliseconds(interval), now)
+
+		if clientTime != 0 && telemetry.lastClient != 0 {
+			d := math.Abs(milliseconds(interval) - (clientTime - telemetry.lastClient))
+			telemetry.jitter.Observe(d, now)
+			telemetry.jitterMs += (d - telemetry.jitterMs) / 16
+		}
+	}
+	telemetry.lastArrival = now
+	telemetry.lastClient = clientTime
+
+	if clientTime != 0 && telemetry.hasOffset {
+		latency := unixMilliseconds(now) - (clientTime - telemetry.offset)
+		if latency < 0 {
+			latency = 0
+		}
+		telemetry.latency.Observe(latency, now)
+		metricWebLatency.Observe(latency/1000, telemetry.source)
+	}
+}
+
+// Ping returns the number of a new ping sent at now.
+func (telemetry *Telemetry) Ping(now time.Time) uint32 {
+	telemetry.mutex.Lock()
+	defer telemetry.mutex.Unlock()
+
+	telemetry.nextPing++
+	id := telemetry.nextPing
+	telemetry.pings[id] = now
+	// Pings that were never answered.
+	for old := range telemetry.pings {
+		if id-old > pingSamples {
+			delete(telemetry.pings, old)
+		}
+	}
+	return id
+}
+
+// Pong takes the answer to a ping, stamped with the client clock.
+func (telemetry *Telemetry) Pong(id uint32, clientTime float64, now time.Time) {
+	telemetry.mutex.Lock()
+	defer telemetry.mutex.Unlock()
+
+	sent, ok := telemetry.pings[id]
+	if !ok {
+		return
+	}
+	delete(telemetry.pings, id)
+
+	rtt := milliseconds(now.Sub(sent))
+	telemetry.rtt.Observe(rtt, now)
+	metricWebRoundTrip.Observe(rtt/1000, telemetry.source)
+	if clientTime == 0 {
+		return
+	}
+
+	// The client stamped the pong half way through the round trip.
+	offset := clientTime - (unixMilliseconds(sent) + rtt/2)
+	telemetry.samples = append(telemetry.samples, clockSample{rtt, offset})
+	if len(telemetry.samples) > pingSamples {
+		telemetry.samples = telemetry.samples[1:]
+	}
+	best := telemetry.samples[0]
+	for _, sample := range telemetry.samples[1:] {
+		if sample.rtt < best.rtt {
+			best = sample
+		}
+	}
+	telemetry.offset = best.offset
+	telemetry.hasOffset = true
+}
+
+// HIDToSend counts the time from reading a report at readAt to sending it
+// to the pipeline at now.
+func (telemetry *Telemetry) HIDToSend(readAt, now time.Time) {
+	telemetry.mutex.Lock()
+	defer telemetry.mutex.Unlock()
+
+	latency := milliseconds(now.Sub(readAt))
+	telemetry.hid.Observe(latency, now)
+	metricHIDToSend.Observe(latency/1000, telemetry.source)
+}
+
+func (telemetry *Telemetry) Snapshot() TelemetrySnapshot {
+	telemetry.mutex.Lock()
+	defer telemetry.mutex.Unlock()
+
+	now := time.Now()
+	snapshot := TelemetrySnapshot{
+		Frames:       telemetry.frames,
+		OutOfOrder:   telemetry.outOfOrder,
+		Dropped:      telemetry.dropped,
+		JitterMs:     telemetry.jitterMs,
+		InterArrival: telemetry.arrival.Snapshot(now),
+		Jitter:       telemetry.jitter.Snapshot(now),
+		Latency:      telemetry.latency.Snapshot(now),
+		RoundTrip:    telemetry.rtt.Snapshot(now),
+		HIDToSend:    telemetry.hid.Snapshot(now),
+	}
+	if telemetry.hasOffset {
+		offset := telemetry.offset
+		snapshot.ClockOffsetMs = &offset
+	}
+	return snapshot
+}
@@ -0,0 +1,190 @@
+package controller
+
+import (
+	"fmt"
+	"time"
+)
+
+// Trigger emulation modes for digital triggers.
+type TriggerMode string
+
+const (
+	// TriggerDigital sends 0 or 255, the default.
+	TriggerDigital TriggerMode = ""
+	// TriggerRamp goes from 0 to 255 over RampMs while held and drops to 0
+	// on release.
+	TriggerRamp TriggerMode = "ramp"
+	// TriggerPWM alternates between 255 and 0 while held, at Percent of
+	// each PeriodMs, half when unset.
+	TriggerPWM TriggerMode = "pwm"
+	// TriggerAxis takes the depth from Source: one direction of a stick
+	// axis, or the pitch of the controller since the trigger was pressed.
+	TriggerAxis TriggerMode = "axis"
+)
+
+// Sources of TriggerAxis. Stick sources use the positive direction of the
+// axis, prefix them with "-" for the negative one.
+const (
+	TriggerSourceLeftX     = "leftX"
+	TriggerSourceLeftY     = "leftY"
+	TriggerSourceRightX    = "rightX"
+	TriggerSourceRightY    = "rightY"
+	TriggerSourceGyroPitch = "gyroPitch"
+)
+
+const (
+	defaultTriggerRamp       = 300 * time.Millisecond
+	defaultTriggerPWMPeriod  = 100 * time.Millisecond
+	defaultTriggerPWMPercent = 50
+	defaultTriggerPitch      = 45.0
+)
+
+type TriggerSettings struct {
+	Mode     TriggerMode `json:"mode,omitempty"`
+	RampMs   int         `json:"rampMs,omitempty"`
+	Percent  int         `json:"percent,omitempty"`
+	PeriodMs int         `json:"periodMs,omitempty"`
+	Source   string      `json:"source,omitempty"`
+	// Degrees of pitch for a full press with the gyroPitch source.
+	PitchRange float32 `json:"pitchRange,omitempty"`
+}
+
+// Validate checks the settings of a trigger, as read from a profile.
+func (settings TriggerSettings) Validate() error {
+	switch settings.Mode {
+	case TriggerDigital, TriggerRamp, TriggerPWM:
+	case TriggerAxis:
+		source := settings.Source
+		if len(source) > 0 && source[0] == '-' {
+			source = source[1:]
+		}
+		switch source {
+		case TriggerSourceLeftX, TriggerSourceLeftY, TriggerSourceRightX, TriggerSourceRightY, TriggerSourceGyroPitch:
+		default:
+			return fmt.Errorf("unknown trigger source %q", settings.Source)
+		}
+	default:
+		return fmt.Errorf("unknown trigger mode %q", settings.Mode)
+	}
+
+	if settings.Percent < 0 || settings.Percent > 100 {
+		return fmt.Errorf("trigger percent %d outside 0-100", settings.Percent)
+	}
+	if settings.RampMs < 0 || settings.PeriodMs < 0 || settings.PitchRange < 0 {
+		return fmt.Errorf("negative trigger duration or range")
+	}
+	return nil
+}
+
+// TriggerInput is what a trigger emulation may look at in one report.
+// Sticks are calibrated to -1..1 and PitchDelta is in degrees.
+type TriggerInput struct {
+	Pressed    bool
+	LeftX      float32
+	LeftY      float32
+	RightX     float32
+	RightY     float32
+	PitchDelta float32
+}
+
+type TriggerEmulator struct {
+	Settings TriggerSettings
+
+	pressedSince time.Time
+	pitch        float32
+}
+
+func NewTriggerEmulator(settings TriggerSettings) *TriggerEmulator {
+	return &TriggerEmulator{Settings: settings}
+}
+
+// Value returns the trigger depth for one report.
+func (trigger *TriggerEmulator) Value(input TriggerInput, now time.Time) byte {
+	if !input.Pressed {
+		trigger.pressedSince = time.Time{}
+		trigger.pitch = 0
+	} else if trigger.pressedSince.IsZero() {
+		trigger.pressedSince = now
+	}
+	held := now.Sub(trigger.pressedSince)
+
+	switch trigger.Settings.Mode {
+	case TriggerRamp:
+		if !input.Pressed {
+			return 0
+		}
+		ramp := time.Duration(trigger.Settings.RampMs) * time.Millisecond
+		if ramp <= 0 {
+			ramp = defaultTriggerRamp
+		}
+		if held >= ramp {
+			return 255
+		}
+		return byte(255 * held / ramp)
+	case TriggerPWM:
+		if !input.Pressed {
+			return 0
+		}
+		period := time.Duration(trigger.Settings.PeriodMs) * time.Millisecond
+		if period <= 0 {
+			period = defaultTriggerPWMPeriod
+		}
+		percent := trigger.Settings.Percent
+		if percent == 0 {
+			percent = defaultTriggerPWMPercent
+		}
+		if held%period < period*time.Duration(percent)/100 {
+			return 255
+		}
+		return 0
+	case TriggerAxis:
+		return trigger.axisValue(input)
+	}
+
+	if input.Pressed {
+		return 255
+	}
+	return 0
+}
+
+func (trigger *TriggerEmulator) axisValue(input TriggerInput) byte {
+	var depth float32
+	source := trigger.Settings.Source
+	negative := len(source) > 0 && source[0] == '-'
+	if negative {
+		source = source[1:]
+	}
+
+	switch source {
+	case TriggerSourceLeftX:
+		depth = input.LeftX
+	case TriggerSourceLeftY:
+		depth = input.LeftY
+	case TriggerSourceRightX:
+		depth = input.RightX
+	case TriggerSourceRightY:
+		depth = input.RightY
+	case TriggerSourceGyroPitch:
+		// Only while held, so the controller can be put back level.
+		if !input.Pressed {
+			return 0
+		}
+		trigger.pitch += input.PitchDelta
+		pitchRange := trigger.Settings.PitchRange
+		if pitchRange <= 0 {
+			pitchRange = defaultTriggerPitch
+		}
+		depth = trigger.pitch / pitchRange
+	}
+	if negative {
+		depth = -depth
+	}
+
+	if depth <= 0 {
+		return 0
+	}
+	if depth >= 1 {
+		return 255
+	}
+	return byte(depth * 255)
+}
@@ -0,0 +1,59 @@
+package controller
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTriggerPWMDefaultPercent(t *testing.T) {
+	trigger := NewTriggerEmulator(TriggerSettings{Mode: TriggerPWM, PeriodMs: 100})
+	start := time.Now()
+
+	var on int
+	for at := time.Duration(0); at < 100*time.Millisecond; at += 10 * time.Millisecond {
+		if trigger.Value(TriggerInput{Pressed: true}, start.Add(at)) == 255 {
+			on++
+		}
+	}
+	if on != 5 {
+		t.Errorf("on for %d of 10 steps without a percent, want half", on)
+	}
+}
+
+func TestLoadProfileRejectsTriggerSettings(t *testing.T) {
+	quietNotifications(t)
+	path, err := profilePath("pwm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path, []byte(`{
+		"leftTrigger": {"mode": "pwm", "percent": 150},
+		"rightTrigger": {"mode": "axis", "source": "-rightY"}
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	profile, err := LoadProfile("pwm")
+	if err == nil {
+		t.Error("percent 150 accepted")
+	}
+	if profile.LeftTrigger != (TriggerSettings{}) {
+		t.Errorf("left trigger %+v, want the digital default", profile.LeftTrigger)
+	}
+	if profile.RightTrigger.Mode != TriggerAxis {
+		t.Errorf("right trigger %+v, want it kept", profile.RightTrigger)
+	}
+
+	for _, settings := range []TriggerSettings{
+		{Mode: TriggerPWM, Percent: -1},
+		{Mode: "turbo"},
+		{Mode: TriggerAxis, Source: "leftZ"},
+		{Mode: TriggerRamp, RampMs: -5},
+	} {
+		if settings.Validate() == nil {
+			t.Errorf("%+v accepted", settings)
+		}
+	}
+}
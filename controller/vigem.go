@@ -1,26 +1,7 @@
 package controller
 
-/*
-#include <stdint.h>
-
-typedef struct
-{
-	uint16_t wButtons;
-	uint8_t bLeftTrigger;
-	uint8_t bRightTrigger;
-	int16_t sThumbLX;
-	int16_t sThumbLY;
-	int16_t sThumbRX;
-	int16_t sThumbRY;
-} xusb_report;
-*/
-import "C"
-
 import (
-	"errors"
-	"unsafe"
-
-	"golang.org/x/sys/windows"
+	"fmt"
 )
 
 const (
@@ -43,22 +24,6 @@ const (
 	VIGEM_ERROR_MAX = VIGEM_ERROR_XUSB_USERINDEX_OUT_OF_RANGE + 1
 )
 
-var (
-	client = windows.NewLazyDLL("ViGEmClient.dll")
-
-	procAlloc                            = client.NewProc("vigem_alloc")
-	procFree                             = client.NewProc("vigem_free")
-	procConnect                          = client.NewProc("vigem_connect")
-	procDisconnect                       = client.NewProc("vigem_disconnect")
-	procTargetAdd                        = client.NewProc("vigem_target_add")
-	procTargetFree                       = client.NewProc("vigem_target_free")
-	procTargetRemove                     = client.NewProc("vigem_target_remove")
-	procTargetX360Alloc                  = client.NewProc("vigem_target_x360_alloc")
-	procTargetX360RegisterNotification   = client.NewProc("vigem_target_x360_register_notification")
-	procTargetX360UnregisterNotification = client.NewProc("vigem_target_x360_unregister_notification")
-	procTargetX360Update                 = client.NewProc("vigem_target_x360_update")
-)
-
 type VigemError struct {
 	code uint
 }
@@ -70,7 +35,9 @@ func NewVigemError(rawCode uintptr) *VigemError {
 		return nil
 	}
 
-	return &VigemError{code}
+	err := &VigemError{code}
+	metricVigemErrors.Inc(fmt.Sprintf("0x%08X", code), err.Error())
+	return err
 }
 
 func (err *VigemError) Error() string {
@@ -108,137 +75,25 @@ func (err *VigemError) Error() string {
 	}
 }
 
-type Emulator struct {
-	handle      uintptr
-	onVibration func(vibration Vibration)
-}
-
 type Vibration struct {
 	LargeMotor byte
 	SmallMotor byte
 }
 
-func NewEmulator(onVibration func(vibration Vibration)) (*Emulator, error) {
-	handle, _, err := procAlloc.Call()
-
-	if !errors.Is(err, windows.ERROR_SUCCESS) {
-		return nil, err
-	}
-
-	libErr, _, err := procConnect.Call(handle)
-
-	if !errors.Is(err, windows.ERROR_SUCCESS) {
-		return nil, err
-	}
-	if err := NewVigemError(libErr); err != nil {
-		return nil, err
-	}
-
-	return &Emulator{handle, onVibration}, nil
-}
-
-func (e *Emulator) Close() error {
-	procDisconnect.Call(e.handle)
-	_, _, err := procFree.Call(e.handle)
-
-	return err
-}
-
-func (e *Emulator) CreateXbox360Controller() (*Xbox360Controller, error) {
-	handle, _, err := procTargetX360Alloc.Call()
-
-	if !errors.Is(err, windows.ERROR_SUCCESS) {
-		return nil, err
-	}
-
-	notificationHandler := func(client, target uintptr, largeMotor, smallMotor, ledNumber byte) uintptr {
-		e.onVibration(Vibration{largeMotor, smallMotor})
-
-		return 0
-	}
-	callback := windows.NewCallback(notificationHandler)
-
-	return &Xbox360Controller{e, handle, false, callback}, nil
-}
-
-type x360NotificationHandler func(client, target uintptr, largeMotor, smallMotor, ledNumber byte) uintptr
-
-type Xbox360Controller struct {
-	emulator            *Emulator
-	handle              uintptr
-	connected           bool
-	notificationHandler uintptr
-}
-
-func (c *Xbox360Controller) Close() error {
-	_, _, err := procTargetFree.Call(c.handle)
-
-	return err
-}
-
-func (c *Xbox360Controller) Connect() error {
-	libErr, _, err := procTargetAdd.Call(c.emulator.handle, c.handle)
-
-	if !errors.Is(err, windows.ERROR_SUCCESS) {
-		return err
-	}
-	if err := NewVigemError(libErr); err != nil {
-		return err
-	}
-
-	libErr, _, err = procTargetX360RegisterNotification.Call(c.emulator.handle, c.handle, c.notificationHandler)
-
-	if !errors.Is(err, windows.ERROR_SUCCESS) {
-		return err
-	}
-	if err := NewVigemError(libErr); err != nil {
-		return err
-	}
-
-	c.connected = true
-
-	return nil
-}
-
-func (c *Xbox360Controller) Disconnect() error {
-	libErr, _, err := procTargetX360UnregisterNotification.Call(c.handle)
-
-	if !errors.Is(err, windows.ERROR_SUCCESS) {
-		return err
-	}
-	if err := NewVigemError(libErr); err != nil {
-		return err
-	}
-
-	libErr, _, err = procTargetRemove.Call(c.emulator.handle, c.handle)
-
-	if !errors.Is(err, windows.ERROR_SUCCESS) {
-		return err
-	}
-	if err := NewVigemError(libErr); err != nil {
-		return err
-	}
-
-	c.connected = false
-
-	return nil
-}
-
-func (c *Xbox360Controller) Send(report *Xbox360ControllerReport) error {
-	libErr, _, err := procTargetX360Update.Call(c.emulator.handle, c.handle, uintptr(unsafe.Pointer(&report.native)))
-
-	if !errors.Is(err, windows.ERROR_SUCCESS) {
-		return err
-	}
-	if err := NewVigemError(libErr); err != nil {
-		return err
-	}
-
-	return nil
+// xusbReport is the XUSB_REPORT of ViGEm, which a Go struct lays out the
+// same way.
+type xusbReport struct {
+	wButtons      uint16
+	bLeftTrigger  uint8
+	bRightTrigger uint8
+	sThumbLX      int16
+	sThumbLY      int16
+	sThumbRX      int16
+	sThumbRY      int16
 }
 
 type Xbox360ControllerReport struct {
-	native    C.xusb_report
+	native    xusbReport
 	Capture   bool
 	Assistant bool
 }
@@ -271,7 +126,7 @@ func (r *Xbox360ControllerReport) GetButtons() uint16 {
 }
 
 func (r *Xbox360ControllerReport) SetButtons(buttons uint16) {
-	r.native.wButtons = C.uint16_t(buttons)
+	r.native.wButtons = buttons
 }
 
 func (r *Xbox360ControllerReport) MaybeSetButton(shiftBy int, isSet bool) {
@@ -289,7 +144,7 @@ func (r *Xbox360ControllerReport) GetLeftTrigger() byte {
 }
 
 func (r *Xbox360ControllerReport) SetLeftTrigger(value byte) {
-	r.native.bLeftTrigger = C.uint8_t(value)
+	r.native.bLeftTrigger = value
 }
 
 func (r *Xbox360ControllerReport) GetRightTrigger() byte {
@@ -297,7 +152,7 @@ func (r *Xbox360ControllerReport) GetRightTrigger() byte {
 }
 
 func (r *Xbox360ControllerReport) SetRightTrigger(value byte) {
-	r.native.bRightTrigger = C.uint8_t(value)
+	r.native.bRightTrigger = value
 }
 
 func (r *Xbox360ControllerReport) GetLeftThumb() (x, y int16) {
@@ -305,8 +160,8 @@ func (r *Xbox360ControllerReport) GetLeftThumb() (x, y int16) {
 }
 
 func (r *Xbox360ControllerReport) SetLeftThumb(x, y int16) {
-	r.native.sThumbLX = C.int16_t(x)
-	r.native.sThumbLY = C.int16_t(y)
+	r.native.sThumbLX = x
+	r.native.sThumbLY = y
 }
 
 func (r *Xbox360ControllerReport) GetRightThumb() (x, y int16) {
@@ -314,6 +169,6 @@ func (r *Xbox360ControllerReport) GetRightThumb() (x, y int16) {
 }
 
 func (r *Xbox360ControllerReport) SetRightThumb(x, y int16) {
-	r.native.sThumbRX = C.int16_t(x)
-	r.native.sThumbRY = C.int16_t(y)
+	r.native.sThumbRX = x
+	r.native.sThumbRY = y
 }
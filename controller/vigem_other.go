@@ -0,0 +1,57 @@
+//go:build !windows
+
+package controller
+
+import (
+	"log/slog"
+	"sync"
+)
+
+// Backend of the virtual pads, as labelled in the metrics. ViGEm only
+// exists on Windows, elsewhere the pads drop their reports so sessions,
+// recordings, scripts and metrics still run, on servers and in tests.
+const outputBackend = "none"
+
+var warnNoBackend sync.Once
+
+type Emulator struct {
+	onVibration func(vibration Vibration)
+}
+
+func NewEmulator(onVibration func(vibration Vibration)) (*Emulator, error) {
+	warnNoBackend.Do(func() {
+		slog.Warn("no virtual pad backend on this platform, reports are dropped")
+	})
+	return &Emulator{onVibration}, nil
+}
+
+func (e *Emulator) Close() error {
+	return nil
+}
+
+func (e *Emulator) CreateXbox360Controller() (*Xbox360Controller, error) {
+	return &Xbox360Controller{emulator: e}, nil
+}
+
+type Xbox360Controller struct {
+	emulator  *Emulator
+	connected bool
+}
+
+func (c *Xbox360Controller) Close() error {
+	return nil
+}
+
+func (c *Xbox360Controller) Connect() error {
+	c.connected = true
+	return nil
+}
+
+func (c *Xbox360Controller) Disconnect() error {
+	c.connected = false
+	return nil
+}
+
+func (c *Xbox360Controller) Send(report *Xbox360ControllerReport) error {
+	return nil
+}
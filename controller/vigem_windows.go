@@ -0,0 +1,151 @@
+package controller
+
+import (
+	"errors"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// Backend of the virtual pads, as labelled in the metrics.
+const outputBackend = "vigem-xbox360"
+
+var (
+	client = windows.NewLazyDLL("ViGEmClient.dll")
+
+	procAlloc                            = client.NewProc("vigem_alloc")
+	procFree                             = client.NewProc("vigem_free")
+	procConnect                          = client.NewProc("vigem_connect")
+	procDisconnect                       = client.NewProc("vigem_disconnect")
+	procTargetAdd                        = client.NewProc("vigem_target_add")
+	procTargetFree                       = client.NewProc("vigem_target_free")
+	procTargetRemove                     = client.NewProc("vigem_target_remove")
+	procTargetX360Alloc                  = client.NewProc("vigem_target_x360_alloc")
+	procTargetX360RegisterNotification   = client.NewProc("vigem_target_x360_register_notification")
+	procTargetX360UnregisterNotification = client.NewProc("vigem_target_x360_unregister_notification")
+	procTargetX360Update                 = client.NewProc("vigem_target_x360_update")
+)
+
+type Emulator struct {
+	handle      uintptr
+	onVibration func(vibration Vibration)
+}
+
+func NewEmulator(onVibration func(vibration Vibration)) (*Emulator, error) {
+	handle, _, err := procAlloc.Call()
+
+	if !errors.Is(err, windows.ERROR_SUCCESS) {
+		return nil, err
+	}
+
+	libErr, _, err := procConnect.Call(handle)
+
+	if !errors.Is(err, windows.ERROR_SUCCESS) {
+		return nil, err
+	}
+	if err := NewVigemError(libErr); err != nil {
+		return nil, err
+	}
+
+	return &Emulator{handle, onVibration}, nil
+}
+
+func (e *Emulator) Close() error {
+	procDisconnect.Call(e.handle)
+	_, _, err := procFree.Call(e.handle)
+
+	return err
+}
+
+func (e *Emulator) CreateXbox360Controller() (*Xbox360Controller, error) {
+	handle, _, err := procTargetX360Alloc.Call()
+
+	if !errors.Is(err, windows.ERROR_SUCCESS) {
+		return nil, err
+	}
+
+	notificationHandler := func(client, target uintptr, largeMotor, smallMotor, ledNumber byte) uintptr {
+		e.onVibration(Vibration{largeMotor, smallMotor})
+
+		return 0
+	}
+	callback := windows.NewCallback(notificationHandler)
+
+	return &Xbox360Controller{e, handle, false, callback}, nil
+}
+
+type x360NotificationHandler func(client, target uintptr, largeMotor, smallMotor, ledNumber byte) uintptr
+
+type Xbox360Controller struct {
+	emulator            *Emulator
+	handle              uintptr
+	connected           bool
+	notificationHandler uintptr
+}
+
+func (c *Xbox360Controller) Close() error {
+	_, _, err := procTargetFree.Call(c.handle)
+
+	return err
+}
+
+func (c *Xbox360Controller) Connect() error {
+	libErr, _, err := procTargetAdd.Call(c.emulator.handle, c.handle)
+
+	if !errors.Is(err, windows.ERROR_SUCCESS) {
+		return err
+	}
+	if err := NewVigemError(libErr); err != nil {
+		return err
+	}
+
+	libErr, _, err = procTargetX360RegisterNotification.Call(c.emulator.handle, c.handle, c.notificationHandler)
+
+	if !errors.Is(err, windows.ERROR_SUCCESS) {
+		return err
+	}
+	if err := NewVigemError(libErr); err != nil {
+		return err
+	}
+
+	c.connected = true
+
+	return nil
+}
+
+func (c *Xbox360Controller) Disconnect() error {
+	libErr, _, err := procTargetX360UnregisterNotification.Call(c.handle)
+
+	if !errors.Is(err, windows.ERROR_SUCCESS) {
+		return err
+	}
+	if err := NewVigemError(libErr); err != nil {
+		return err
+	}
+
+	libErr, _, err = procTargetRemove.Call(c.emulator.handle, c.handle)
+
+	if !errors.Is(err, windows.ERROR_SUCCESS) {
+		return err
+	}
+	if err := NewVigemError(libErr); err != nil {
+		return err
+	}
+
+	c.connected = false
+
+	return nil
+}
+
+func (c *Xbox360Controller) Send(report *Xbox360ControllerReport) error {
+	libErr, _, err := procTargetX360Update.Call(c.emulator.handle, c.handle, uintptr(unsafe.Pointer(&report.native)))
+
+	if !errors.Is(err, windows.ERROR_SUCCESS) {
+		return err
+	}
+	if err := NewVigemError(libErr); err != nil {
+		return err
+	}
+
+	return nil
+}
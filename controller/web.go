@@ -1,63 +1,167 @@
 package controller
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
+	"log/slog"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
-func CreateWebControllerService(Addr string) *http.Server {
+// APIToken lets clients other than the local machine use the admin API and
+// the metrics, by sending it as a bearer token. Without it they only answer
+// loopback clients, while the web pad stays open to the network.
+var APIToken = os.Getenv("GAMEPADSERVER_API_TOKEN")
+
+// webClients counts the web clients whose virtual pad is still plugged in.
+// Once WaitWebClients has started no client is added, and webClientsDone
+// is closed when the last one leaves.
+var (
+	webClientsMutex sync.Mutex
+	webClients      int
+	webClosing      bool
+	webClientsDone  = make(chan struct{})
+)
+
+// addWebClient counts a new web client, unless the server is shutting
+// down.
+func addWebClient(ctx context.Context) bool {
+	webClientsMutex.Lock()
+	defer webClientsMutex.Unlock()
+
+	if webClosing || ctx.Err() != nil {
+		return false
+	}
+	webClients++
+	return true
+}
+
+func removeWebClient() {
+	webClientsMutex.Lock()
+	defer webClientsMutex.Unlock()
+
+	webClients--
+	if webClosing && webClients == 0 {
+		close(webClientsDone)
+	}
+}
+
+// CreateWebControllerService returns the web server. When ctx is done, web
+// clients are told the server is going away and their pads are unplugged;
+// WaitWebClients waits for them.
+func CreateWebControllerService(ctx context.Context, Addr string) *http.Server {
 	setupRoutes()
-	return &http.Server{Addr: ":3080"}
+	return &http.Server{
+		Addr:        Addr,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+}
+
+// WaitWebClients refuses new web clients and waits until every web client
+// has unplugged its pad or ctx is done.
+func WaitWebClients(ctx context.Context) error {
+	webClientsMutex.Lock()
+	if !webClosing {
+		webClosing = true
+		if webClients == 0 {
+			close(webClientsDone)
+		}
+	}
+	webClientsMutex.Unlock()
+
+	select {
+	case <-webClientsDone:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func homePage(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "Home Page")
 }
 
+// ControllerMsg is an input frame of the web client. Seq numbers the
+// frames from 1 and TS is the client clock in milliseconds since the Unix
+// epoch when the frame was built. A message with Pong set answers the ping
+// of that number instead, stamped with TS.
 type ControllerMsg struct {
 	Buttons []byte  `json:"buttons"`
 	Axes    []int16 `json:"axes"`
+	Seq     uint64  `json:"seq,omitempty"`
+	TS      float64 `json:"ts,omitempty"`
+	Pong    *uint32 `json:"pong,omitempty"`
 }
 
+// PingMsg asks the web client to answer with a pong.
+type PingMsg struct {
+	Ping uint32 `json:"ping"`
+}
+
+// Time a web client gets to answer the close message of a shutdown.
+const webCloseGrace = time.Second
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
 }
 
 func wsEndpoint(w http.ResponseWriter, r *http.Request) {
+	if !addWebClient(r.Context()) {
+		http.Error(w, "server shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer removeWebClient()
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		Notification("Gamepad Server", err.Error())
+		slog.Warn("websocket upgrade failed", "client", r.RemoteAddr, "err", err)
+		NotifyError("Gamepad Server", err.Error())
 		return
 	}
 	defer conn.Close()
 
+	done := make(chan struct{})
+	defer close(done)
+	go webCloseOnShutdown(r.Context(), conn, done)
+
 	msgType, msgJson, err := conn.ReadMessage()
 	if err != nil {
-		Notification("Bad message", string(msgJson)+"\r\n"+err.Error())
+		slog.Warn("bad first message", "client", r.RemoteAddr, "err", err)
+		notifyBadMessage(msgJson, err)
 		return
 	}
 	ClientName := string(msgJson)
-	Notification(ClientName, "Connected from "+conn.RemoteAddr().String())
+	notifyConnected(ClientName, "Connected from "+conn.RemoteAddr().String())
 
 	emulator, err := NewEmulator(func(vibration Vibration) {})
 	if err != nil {
-		Notification("unable to start ViGEm client", err.Error())
+		NotifyError("unable to start ViGEm client", err.Error())
+		return
 	}
 	defer emulator.Close()
 
 	ctr, err := emulator.CreateXbox360Controller()
 	if err != nil {
-		Notification("unable to create emulated Xbox 360 controller", err.Error())
+		NotifyError("unable to create emulated Xbox 360 controller", err.Error())
+		return
 	}
 	defer ctr.Close()
 
 	err = ctr.Connect()
 	if err != nil {
-		Notification("unable to connect to emulated Xbox 360 controller", err.Error())
+		NotifyError("unable to connect to emulated Xbox 360 controller", err.Error())
 		return
 	}
 	defer ctr.Disconnect()
@@ -66,20 +170,46 @@ func wsEndpoint(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	defer Notification(ClientName, "Disconnected")
+	defer notifyDisconnected(ClientName)
+
+	session := NewSession(ClientName, "Web", TransportWeb, conn.RemoteAddr().String())
+	defer session.Close()
+
+	// Browsers give no serial, so web pads share a profile per model.
+	profile, err := LoadProfile("web " + ClientName)
+	if err != nil {
+		NotifyError(ClientName, "unable to load profile: "+err.Error())
+	}
+	labelOrdered := webLabelOrdered(ClientName)
+
+	pipeline := profile.NewPipeline(ClientName, ctr, nil)
+	pipeline.Layout.NintendoLabels = session.Info().NintendoLabels()
+	session.SetPipeline(pipeline)
+	defer pipeline.Close()
+
+	go webPing(conn, session.Telemetry, done)
 
 	for {
 		_, msgJson, err := conn.ReadMessage()
 		if err != nil {
+			session.Log.Debug("connection closed", "err", err)
 			return
 		}
+		now := time.Now()
 
 		var msg ControllerMsg
 		err = json.Unmarshal(msgJson, &msg)
 		if err != nil {
-			Notification("Bad message", string(msgJson)+"\r\n"+err.Error())
+			session.Log.Warn("bad message", "err", err, "data", string(msgJson))
+			countDecodeError(session.Kind)
+			notifyBadMessage(msgJson, err)
 			return
 		}
+		if msg.Pong != nil {
+			session.Telemetry.Pong(*msg.Pong, msg.TS, now)
+			continue
+		}
+		session.Telemetry.Frame(msg.Seq, msg.TS, now)
 
 		report := Xbox360ControllerReport{}
 		for i := 0; i < len(msg.Buttons) && i < 17; i++ {
@@ -94,7 +224,59 @@ func wsEndpoint(w http.ResponseWriter, r *http.Request) {
 			report.SetRightThumb(msg.Axes[2], -msg.Axes[3])
 		}
 
-		ctr.Send(&report)
+		// Back to positions, the pipeline applies the layout of the
+		// profile.
+		if labelOrdered {
+			report.ApplyLayout(LayoutPolicy{Layout: LayoutLabel}, true)
+		}
+
+		pipeline.Send(&report)
+	}
+}
+
+// notifyBadMessage reports a frame that could not be read. Broken clients
+// send them at frame rate, so they share one key.
+func notifyBadMessage(data []byte, err error) {
+	Notify(Event{
+		Severity: SeverityWarning,
+		Key:      "bad-message",
+		Summary:  "%d bad messages from web clients",
+		Title:    "Bad message",
+		Message:  string(data) + "\r\n" + err.Error(),
+	})
+}
+
+// webCloseOnShutdown tells a web client the server is going away when ctx
+// is done, and gives it webCloseGrace to answer before the reading loop of
+// the connection gives up.
+func webCloseOnShutdown(ctx context.Context, conn *websocket.Conn, done chan struct{}) {
+	select {
+	case <-ctx.Done():
+	case <-done:
+		return
+	}
+
+	message := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+	conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(webCloseGrace))
+	conn.SetReadDeadline(time.Now().Add(webCloseGrace))
+}
+
+// webPing pings a web client until done is closed. The reading loop of the
+// connection hands the pongs to the telemetry.
+func webPing(conn *websocket.Conn, telemetry *Telemetry, done chan struct{}) {
+	ticker := time.NewTicker(webPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			err := conn.WriteJSON(PingMsg{Ping: telemetry.Ping(now)})
+			if err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
 	}
 }
 
@@ -102,6 +284,363 @@ func setupRoutes() {
 	fileServer := http.FileServer(http.Dir("./web/"))
 	http.Handle("/", fileServer)
 	http.HandleFunc("/ws", wsEndpoint)
+	http.HandleFunc("/api/sessions", adminOnly(sessionsEndpoint))
+	http.HandleFunc("/api/sessions/", adminOnly(sessionEndpoint))
+	http.HandleFunc("/api/macros", adminOnly(macrosEndpoint))
+	http.HandleFunc("/api/macros/", adminOnly(macroEndpoint))
+	http.HandleFunc("/metrics", adminOnly(metricsEndpoint))
+}
+
+// adminOnly serves the requests of clients sending APIToken and of
+// loopback clients, and refuses the others. Web pages the local browser
+// opens are loopback clients too: their requests are refused when they name
+// another site as Host or Origin, and changes must be sent as JSON, which
+// pages of other sites cannot do without a preflight the server never
+// answers.
+func adminOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		allowed := hasAPIToken(r)
+		if !allowed && isLoopback(r.RemoteAddr) {
+			allowed = isLoopbackHost(r.Host) && (r.Header.Get("Origin") == "" || isLoopbackOrigin(r.Header.Get("Origin")))
+		}
+		if !allowed {
+			slog.Warn("admin API refused", "client", r.RemoteAddr, "path", r.URL.Path, "host", r.Host, "origin", r.Header.Get("Origin"))
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if err != nil || mediaType != "application/json" {
+				http.Error(w, "content type must be application/json", http.StatusUnsupportedMediaType)
+				return
+			}
+		}
+		handler(w, r)
+	}
+}
+
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// isLoopbackHost reports whether the host of a Host header, with or without
+// a port, is the local machine.
+func isLoopbackHost(host string) bool {
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func isLoopbackOrigin(origin string) bool {
+	u, err := url.Parse(origin)
+	return err == nil && u.Host != "" && isLoopbackHost(u.Host)
+}
+
+func hasAPIToken(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return APIToken != "" && ok && subtle.ConstantTimeCompare([]byte(token), []byte(APIToken)) == 1
+}
+
+func sessionsEndpoint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, Sessions())
+}
+
+// sessionEndpoint serves /api/sessions/{id}/{action}.
+func sessionEndpoint(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/sessions/"), "/")
+	id, err := strconv.Atoi(parts[0])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	session := SessionByID(id)
+	if session == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		writeJSON(w, session.Info())
+	case len(parts) == 2 && parts[1] == "telemetry" && r.Method == http.MethodGet:
+		writeJSON(w, session.Telemetry.Snapshot())
+	case len(parts) == 2 && parts[1] == "lights" && r.Method == http.MethodPost:
+		lightsEndpoint(w, r, session)
+	case len(parts) == 3 && parts[1] == "record" && r.Method == http.MethodPost:
+		recordEndpoint(w, r, session, parts[2])
+	case len(parts) == 3 && parts[1] == "play" && r.Method == http.MethodPost:
+		playEndpoint(w, r, session, parts[2])
+	case len(parts) == 3 && parts[1] == "recording" && r.Method == http.MethodPost:
+		recordingEndpoint(w, r, session, parts[2])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// recordEndpoint serves /api/sessions/{id}/record/start and
+// /api/sessions/{id}/record/stop. Stopping saves the recording under the
+// name and policy given in the body.
+func recordEndpoint(w http.ResponseWriter, r *http.Request, session *Session, action string) {
+	pipeline := session.Pipeline()
+	if pipeline == nil {
+		http.Error(w, "session has no output", http.StatusConflict)
+		return
+	}
+
+	switch action {
+	case "start":
+		pipeline.StartRecording()
+		w.WriteHeader(http.StatusNoContent)
+	case "stop":
+		var req struct {
+			Name   string      `json:"name"`
+			Policy MacroPolicy `json:"policy"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		macro := pipeline.StopRecording()
+		if macro == nil {
+			http.Error(w, "session is not recording", http.StatusConflict)
+			return
+		}
+		macro.Name = req.Name
+		macro.Policy = req.Policy
+		err = SaveMacro(macro)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, macro)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func playEndpoint(w http.ResponseWriter, r *http.Request, session *Session, name string) {
+	pipeline := session.Pipeline()
+	if pipeline == nil {
+		http.Error(w, "session has no output", http.StatusConflict)
+		return
+	}
+
+	macro, err := LoadMacro(name)
+	if err == ErrNoMacro {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	pipeline.Play(macro)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// recordingEndpoint serves /api/sessions/{id}/recording/start and
+// /api/sessions/{id}/recording/stop, which write the input of the session to
+// an input recording for the replay command. Both return the file path.
+func recordingEndpoint(w http.ResponseWriter, r *http.Request, session *Session, action string) {
+	pipeline := session.Pipeline()
+	if pipeline == nil {
+		http.Error(w, "session has no output", http.StatusConflict)
+		return
+	}
+
+	var recorder *InputRecorder
+	switch action {
+	case "start":
+		var err error
+		recorder, err = CreateInputRecording(session.Info())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if previous := pipeline.SetRecorder(recorder); previous != nil {
+			previous.Close()
+		}
+	case "stop":
+		recorder = pipeline.SetRecorder(nil)
+		if recorder == nil {
+			http.Error(w, "session is not recording", http.StatusConflict)
+			return
+		}
+		err := recorder.Close()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	writeJSON(w, struct {
+		Path string `json:"path"`
+	}{recorder.Path})
+}
+
+func macrosEndpoint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	names, err := MacroNames()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, names)
+}
+
+// macroEndpoint reads, replaces and deletes the macro at /api/macros/{name}.
+func macroEndpoint(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/api/macros/")
+
+	switch r.Method {
+	case http.MethodGet:
+		macro, err := LoadMacro(name)
+		if err == ErrNoMacro {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, macro)
+	case http.MethodPut:
+		macro := &Macro{}
+		err := json.NewDecoder(r.Body).Decode(macro)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		macro.Name = name
+		err = SaveMacro(macro)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		err := DeleteMacro(name)
+		if err == ErrNoMacro {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// LightsRequest sets any of the lights of a session. Lightbar is a
+// "#rrggbb" color.
+type LightsRequest struct {
+	Player *struct {
+		Solid byte `json:"solid"`
+		Flash byte `json:"flash"`
+	} `json:"player"`
+	HomeLight *HomeLightPattern `json:"homeLight"`
+	Lightbar  string            `json:"lightbar"`
+}
+
+func lightsEndpoint(w http.ResponseWriter, r *http.Request, session *Session) {
+	var req LightsRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	device := session.Device()
+	if req.Player != nil {
+		control, ok := device.(PlayerLEDControl)
+		if !ok {
+			err = ErrUnsupportedLight
+		} else {
+			err = control.SetPlayerLEDs(req.Player.Solid, req.Player.Flash)
+		}
+		if err != nil {
+			lightsError(w, err)
+			return
+		}
+	}
+
+	if req.HomeLight != nil {
+		control, ok := device.(HomeLightControl)
+		if !ok {
+			err = ErrUnsupportedLight
+		} else {
+			err = control.SetHomeLight(req.HomeLight)
+		}
+		if err != nil {
+			lightsError(w, err)
+			return
+		}
+	}
+
+	if req.Lightbar != "" {
+		var r, g, b byte
+		_, err = fmt.Sscanf(req.Lightbar, "#%02x%02x%02x", &r, &g, &b)
+		if err != nil {
+			lightsError(w, ErrBadLightPattern)
+			return
+		}
+		control, ok := device.(LightbarControl)
+		if !ok {
+			err = ErrUnsupportedLight
+		} else {
+			err = control.SetLightbar(r, g, b)
+		}
+		if err != nil {
+			lightsError(w, err)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func lightsError(w http.ResponseWriter, err error) {
+	switch err {
+	case ErrUnsupportedLight:
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+	case ErrBadLightPattern:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	}
 }
 
 func (r *Xbox360ControllerReport) SetButtonFromGamePadAPI(button int, value byte) {
@@ -0,0 +1,94 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAdminOnly(t *testing.T) {
+	handler := adminOnly(func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		token         string
+		remote        string
+		authorization string
+		host          string
+		origin        string
+		method        string
+		contentType   string
+		want          int
+	}{
+		{"", "127.0.0.1:50000", "", "localhost:3080", "", "POST", "application/json", http.StatusOK},
+		{"", "[::1]:50000", "", "[::1]:3080", "", "POST", "application/json; charset=utf-8", http.StatusOK},
+		{"", "192.168.1.20:50000", "", "localhost:3080", "", "POST", "application/json", http.StatusForbidden},
+		{"", "192.168.1.20:50000", "Bearer ", "localhost:3080", "", "POST", "application/json", http.StatusForbidden},
+		{"secret", "192.168.1.20:50000", "", "192.168.1.10:3080", "", "POST", "application/json", http.StatusForbidden},
+		{"secret", "192.168.1.20:50000", "Bearer guess", "192.168.1.10:3080", "", "POST", "application/json", http.StatusForbidden},
+		{"secret", "192.168.1.20:50000", "secret", "192.168.1.10:3080", "", "POST", "application/json", http.StatusForbidden},
+		{"secret", "192.168.1.20:50000", "Bearer secret", "192.168.1.10:3080", "", "POST", "application/json", http.StatusOK},
+		{"secret", "127.0.0.1:50000", "", "127.0.0.1:3080", "", "POST", "application/json", http.StatusOK},
+		// Pages of other sites in the local browser.
+		{"", "127.0.0.1:50000", "", "localhost:3080", "http://localhost:3080", "POST", "application/json", http.StatusOK},
+		{"", "127.0.0.1:50000", "", "localhost:3080", "https://evil.example", "POST", "text/plain", http.StatusForbidden},
+		{"", "127.0.0.1:50000", "", "localhost:3080", "null", "POST", "application/json", http.StatusForbidden},
+		{"", "127.0.0.1:50000", "", "evil.example:3080", "", "GET", "", http.StatusForbidden},
+		{"", "127.0.0.1:50000", "", "localhost:3080", "", "POST", "text/plain", http.StatusUnsupportedMediaType},
+		{"", "127.0.0.1:50000", "", "localhost:3080", "", "POST", "", http.StatusUnsupportedMediaType},
+		{"", "127.0.0.1:50000", "", "localhost:3080", "", "GET", "", http.StatusOK},
+	}
+	defer func(token string) { APIToken = token }(APIToken)
+	for _, test := range tests {
+		APIToken = test.token
+		r := httptest.NewRequest(test.method, "/api/macros/jump", nil)
+		r.RemoteAddr = test.remote
+		r.Host = test.host
+		if test.authorization != "" {
+			r.Header.Set("Authorization", test.authorization)
+		}
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+		if test.contentType != "" {
+			r.Header.Set("Content-Type", test.contentType)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != test.want {
+			t.Errorf("%+v: status %d, want %d", test, w.Code, test.want)
+		}
+	}
+}
+
+// Web clients arriving once the shutdown waits for the others are refused
+// instead of racing the wait.
+func TestWaitWebClients(t *testing.T) {
+	t.Cleanup(func() {
+		webClientsMutex.Lock()
+		webClients, webClosing, webClientsDone = 0, false, make(chan struct{})
+		webClientsMutex.Unlock()
+	})
+
+	if !addWebClient(context.Background()) {
+		t.Fatal("client refused before the shutdown")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := WaitWebClients(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("wait with a client plugged in: %v, want the deadline", err)
+	}
+
+	recorder := httptest.NewRecorder()
+	wsEndpoint(recorder, httptest.NewRequest(http.MethodGet, "/ws", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("client during the shutdown got %d, want %d", recorder.Code, http.StatusServiceUnavailable)
+	}
+
+	removeWebClient()
+	if err := WaitWebClients(context.Background()); err != nil {
+		t.Errorf("wait after the last client left: %v", err)
+	}
+}
@@ -0,0 +1,2 @@
+// Package icon holds the tray icon, which only the Windows tray uses.
+package icon
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+// acquireInstanceLock listens on an abstract Unix socket named after the
+// user. The kernel frees it with the process, so a crash leaves no stale
+// lock behind.
+func acquireInstanceLock() (net.Listener, error) {
+	name := fmt.Sprintf("@GamepadServer-%d", os.Getuid())
+	listener, err := net.Listen("unix", name)
+	if err != nil {
+		return nil, fmt.Errorf("%s is taken: %w", name, err)
+	}
+	return listener, nil
+}
@@ -0,0 +1,33 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	"./controller"
+)
+
+// acquireInstanceLock holds an exclusive lock on a file of the data
+// directory, which the kernel releases with the process.
+func acquireInstanceLock() (*os.File, error) {
+	path, err := controller.DataPath("gamepadserver.lock")
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s is locked: %w", path, err)
+	}
+	file.Truncate(0)
+	fmt.Fprintf(file, "%d\n", os.Getpid())
+	return file, nil
+}
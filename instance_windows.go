@@ -0,0 +1,18 @@
+package main
+
+import (
+	"github.com/rodolfoag/gow32"
+	"golang.org/x/sys/windows"
+)
+
+type instanceMutex windows.Handle
+
+// acquireInstanceLock creates the named mutex that marks a running server.
+func acquireInstanceLock() (instanceMutex, error) {
+	handle, err := gow32.CreateMutex("GamepadServer")
+	return instanceMutex(handle), err
+}
+
+func (mutex instanceMutex) Close() error {
+	return windows.CloseHandle(windows.Handle(mutex))
+}
@@ -1,141 +1,140 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"flag"
 	"fmt"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"./controller"
-	"./icon"
-	"github.com/getlantern/systray"
-	"github.com/go-toast/toast"
-	"github.com/gorilla/websocket"
-	"github.com/rodolfoag/gow32"
 )
 
-func homePage(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "Home Page")
-}
-
-type ControllerMsg struct {
-	Buttons []byte  `json:"buttons"`
-	Axes    []int16 `json:"axes"`
-}
+// Time the server gets to stop its controllers and send its last
+// notifications when it exits.
+const shutdownTimeout = 5 * time.Second
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-}
+var (
+	headless = flag.Bool("headless", false, "run without the tray icon until interrupted")
+	addr     = flag.String("addr", ":3080", "address of the web server")
+)
 
-func wsEndpoint(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+func main() {
+	closeLog, err := controller.SetupLogging()
 	if err != nil {
-		notification("Gamepad Server", err.Error())
-		return
+		slog.Warn("unable to open the log file", "err", err)
 	}
-	defer conn.Close()
+	defer closeLog()
 
-	msgType, msgJson, err := conn.ReadMessage()
-	if err != nil {
-		notification("Bad message", string(msgJson)+"\r\n"+err.Error())
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		err := replay(os.Args[2:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			closeLog()
+			os.Exit(1)
+		}
 		return
 	}
-	ClientName := string(msgJson)
-	notification(ClientName+" Connected", conn.RemoteAddr().String())
-
-	emulator, err := controller.NewEmulator(func(vibration controller.Vibration) {})
-	if err != nil {
-		notification("unable to start ViGEm client", err.Error())
-	}
-	defer emulator.Close()
-
-	ctr, err := emulator.CreateXbox360Controller()
-	if err != nil {
-		notification("unable to create emulated Xbox 360 controller", err.Error())
-	}
-	defer ctr.Close()
+	flag.Parse()
 
-	err = ctr.Connect()
+	lock, err := acquireInstanceLock()
 	if err != nil {
-		notification("unable to connect to emulated Xbox 360 controller", err.Error())
-		return
-	}
-	defer ctr.Disconnect()
-
-	if err = conn.WriteMessage(msgType, msgJson); err != nil {
+		slog.Warn("already running", "err", err)
+		controller.NotifyWarning("", "GamepadServer is already running!")
+		controller.FlushNotifications(shutdownTimeout)
 		return
 	}
+	defer lock.Close()
 
-	for {
-		_, msgJson, err := conn.ReadMessage()
-		if err != nil {
-			return
-		}
-
-		var msg ControllerMsg
-		err = json.Unmarshal(msgJson, &msg)
-		if err != nil {
-			notification("Bad message", string(msgJson)+"\r\n"+err.Error())
-			return
-		}
-
-		report := controller.Xbox360ControllerReport{}
-		for i := 0; i < len(msg.Buttons) && i < 17; i++ {
-			report.SetButtonFromGamePad(i, msg.Buttons[i])
-		}
-
-		if len(msg.Axes) >= 2 {
-			report.SetLeftThumb(msg.Axes[0], -msg.Axes[1])
-		}
-
-		if len(msg.Axes) >= 4 {
-			report.SetRightThumb(msg.Axes[2], -msg.Axes[3])
-		}
-
-		ctr.Send(&report)
+	if *headless {
+		runHeadless(*addr)
+	} else {
+		runTray(*addr)
 	}
 }
 
-func setupRoutes() {
-	fileServer := http.FileServer(http.Dir("./web/"))
-	http.Handle("/", fileServer)
-	http.HandleFunc("/ws", wsEndpoint)
+// server runs the web server and the local controllers.
+type server struct {
+	http *http.Server
+	// stop cancels the context of the controllers and web clients, which
+	// unplug their virtual pads.
+	stop        context.CancelFunc
+	devicesDone chan struct{}
+	// failed receives the error of the web server when it cannot serve.
+	failed chan error
 }
 
-var HTTPServer *http.Server
-
-func main() {
-	_, err := gow32.CreateMutex("GamepadServer")
-	if err != nil {
-		notification("", "GamepadServer is already running!")
-	} else {
-		systray.Run(onReady, onExit)
+func startServer(addr string) *server {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &server{
+		http:        controller.CreateWebControllerService(ctx, addr),
+		stop:        cancel,
+		devicesDone: make(chan struct{}),
+		failed:      make(chan error, 1),
 	}
-}
 
-func onReady() {
-	systray.SetIcon(icon.Data)
-	mQuit := systray.AddMenuItem("Quit", "")
 	go func() {
-		<-mQuit.ClickedCh
-		systray.Quit()
+		defer close(s.devicesDone)
+		controller.CreateLocalControllerService(ctx)
+	}()
+	go func() {
+		err := s.http.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			slog.Error("web server stopped", "addr", addr, "err", err)
+			controller.NotifyError("Gamepad Server", err.Error())
+			s.failed <- err
+		}
 	}()
 
-	setupRoutes()
-	HTTPServer = &http.Server{Addr: ":3080"}
-	HTTPServer.ListenAndServe()
+	slog.Info("started", "addr", addr, "headless", *headless)
+	return s
 }
 
-func onExit() {
-	HTTPServer.Close()
+// Stop stops accepting connections, tells the web clients the server is
+// going away, and unplugs every virtual pad and restores the controllers,
+// giving them up to timeout.
+func (s *server) Stop(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	// Shutdown does not wait for the websockets, they follow s.stop.
+	s.stop()
+	err := s.http.Shutdown(ctx)
+	if err != nil {
+		slog.Warn("web server did not stop in time", "err", err)
+	}
+	select {
+	case <-s.devicesDone:
+	case <-ctx.Done():
+		slog.Warn("controllers did not stop in time")
+	}
+	err = controller.WaitWebClients(ctx)
+	if err != nil {
+		slog.Warn("web clients did not stop in time", "err", err)
+	}
+
+	controller.FlushNotifications(time.Until(deadline))
+	slog.Info("stopped")
 }
 
-func notification(title, message string) {
-	notification := toast.Notification{
-		AppID:   "GamepadServer",
-		Title:   title,
-		Message: message,
+// runHeadless serves until SIGINT or SIGTERM, for servers and services
+// without a desktop.
+func runHeadless(addr string) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	s := startServer(addr)
+	select {
+	case <-ctx.Done():
+		slog.Info("shutting down")
+	case <-s.failed:
 	}
-
-	notification.Push()
+	// A second interrupt kills the server right away.
+	stop()
+	s.Stop(shutdownTimeout)
 }
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"./controller"
+)
+
+// replay plays an input recording into a new virtual pad:
+//
+//	GamepadServer replay [-speed 1] [-loop] [-profile key] file
+//
+// With -profile the frames go through the layout, remapping, button modes,
+// macros and script of that profile, as they did live. Layout switches are
+// not saved.
+func replay(args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	speed := flags.Float64("speed", 1, "playback speed, 0 sends the frames without waiting")
+	loop := flags.Bool("loop", false, "replay until interrupted")
+	profileKey := flags.String("profile", "", "profile whose pipeline the frames go through")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: GamepadServer replay [-speed 1] [-loop] [-profile key] file")
+	}
+
+	recording, err := controller.LoadRecording(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	emulator, err := controller.NewEmulator(func(vibration controller.Vibration) {})
+	if err != nil {
+		return err
+	}
+	defer emulator.Close()
+
+	ctr, err := emulator.CreateXbox360Controller()
+	if err != nil {
+		return err
+	}
+	defer ctr.Close()
+
+	err = ctr.Connect()
+	if err != nil {
+		return err
+	}
+	defer ctr.Disconnect()
+
+	var sink controller.ReportSink = ctr
+	var pipeline *controller.Pipeline
+	if *profileKey != "" {
+		profile, err := controller.LoadProfile(*profileKey)
+		if err != nil {
+			return err
+		}
+		// The recorded session stands in for the source, for its extra
+		// inputs.
+		pipeline = profile.NewPipeline(recording.Header.Session.Name, ctr, recording.Header.Session)
+		pipeline.OnLayout = nil
+		pipeline.Layout.NintendoLabels = recording.Header.Session.NintendoLabels()
+		defer pipeline.Close()
+		sink = pipeline
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	fmt.Printf("replaying %d frames of %s (%s, %v)\n", len(recording.Frames), recording.Header.Session.Name,
+		recording.Header.Session.Kind, recording.Duration())
+	err = recording.Replay(ctx, sink, controller.ReplayOptions{Speed: *speed, Loop: *loop})
+	if err == context.Canceled {
+		err = nil
+	}
+	if err == nil && pipeline != nil {
+		err = pipeline.Flush()
+	}
+	return err
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+
+package main
+
+import (
+	"log/slog"
+)
+
+// The tray icon needs cgo and a desktop outside Windows, so other
+// platforms always run headless.
+func runTray(addr string) {
+	slog.Info("no tray icon on this platform, running headless")
+	runHeadless(addr)
+}
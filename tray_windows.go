@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"./icon"
+	"github.com/getlantern/systray"
+)
+
+// runTray serves until Quit is clicked in the tray menu or the process is
+// interrupted.
+func runTray(addr string) {
+	var s *server
+	onReady := func() {
+		systray.SetIcon(icon.Data)
+		mQuit := systray.AddMenuItem("Quit", "")
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		go func() {
+			defer stop()
+			select {
+			case <-mQuit.ClickedCh:
+			case <-ctx.Done():
+			}
+			systray.Quit()
+		}()
+
+		s = startServer(addr)
+	}
+	onExit := func() {
+		if s != nil {
+			s.Stop(shutdownTimeout)
+		}
+	}
+	systray.Run(onReady, onExit)
+}
@@ -7,17 +7,27 @@ const configs = {
     
     // Safari
     'Xbox Wireless Controller Extended Gamepad': [0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17],
-    'Pro Controller Extended Gamepad': [1, 0, 3, 2, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17],
+    'Pro Controller Extended Gamepad': [0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17],
 }
 
 var haveEvents = 'GamepadEvent' in window;
 var haveWebkitEvents = 'WebKitGamepadEvent' in window;
 var controllers = {};
 var sockets = {};
+var sequences = {};
 var rAF = window.mozRequestAnimationFrame ||
   window.webkitRequestAnimationFrame ||
   window.requestAnimationFrame;
 
+// Client clock in milliseconds since the Unix epoch, for the latency
+// telemetry of the server.
+function clientTime() {
+  if (window.performance && performance.timeOrigin) {
+    return performance.timeOrigin + performance.now();
+  }
+  return Date.now();
+}
+
 function connecthandler(e) {
   addgamepad(e.gamepad);
 }
@@ -33,6 +43,26 @@ function addgamepad(gamepad) {
   socket.addEventListener('open', function (event) {
     socket.send(gamepad.id);
     sockets[gamepad.index] = socket;
+    sequences[gamepad.index] = 0;
+  });
+  socket.addEventListener('message', function (event) {
+    var msg;
+    try {
+      msg = JSON.parse(event.data);
+    } catch (err) {
+      return;
+    }
+    if (msg && msg.ping !== undefined) {
+      socket.send(JSON.stringify({pong: msg.ping, ts: clientTime()}));
+    }
+  });
+  socket.addEventListener('close', function (event) {
+    if (sockets[gamepad.index] === socket) {
+      delete sockets[gamepad.index];
+    }
+    if (event.reason) {
+      console.log("gamepad " + gamepad.index + " disconnected: " + event.reason);
+    }
   });
 
   var d = document.createElement("div");
@@ -76,8 +106,11 @@ function removegamepad(gamepad) {
   var d = document.getElementById("controller" + gamepad.index);
   document.body.removeChild(d);
   delete controllers[gamepad.index];
-  sockets[gamepad.index].close();
+  if (sockets[gamepad.index]) {
+    sockets[gamepad.index].close();
+  }
   delete sockets[gamepad.index];
+  delete sequences[gamepad.index];
 }
 
 function updateStatus() {
@@ -129,6 +162,9 @@ function updateStatus() {
     
     var socket = sockets[j];
     if (socket) {
+      sequences[j]++;
+      msg['seq'] = sequences[j];
+      msg['ts'] = clientTime();
       socket.send(JSON.stringify(msg));
     }
   }